@@ -1 +1,153 @@
 package bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Environment variable holding the Telegram bot token
+const TokenEnv = "TELEGRAM_BOT_TOKEN"
+
+// Environment variable holding the comma separated IDs of the chats allowed to use the bot
+const AllowedChatsEnv = "TELEGRAM_ALLOWED_CHATS"
+
+var ErrMissingToken = errors.New(TokenEnv + " is not set")
+
+// Sender is the part of the Telegram client used by the handlers.
+// *tgbotapi.BotAPI implement it.
+type Sender interface {
+	Send(c tgbotapi.Chattable) (tgbotapi.Message, error)
+	Request(c tgbotapi.Chattable) (*tgbotapi.APIResponse, error)
+	GetFileDirectURL(fileID string) (string, error)
+}
+
+// Bot receive the Telegram updates and dispatch them to its router
+type Bot struct {
+	API    *tgbotapi.BotAPI
+	Sender Sender
+	Router *Router
+	States *ChatStates
+}
+
+// Create a bot authenticated with the provided token
+func New(token string) (*Bot, error) {
+	api, err := tgbotapi.NewBotAPI(token)
+	if err != nil {
+		return nil, fmt.Errorf("error during the telegram bot authentication : %v", err)
+	}
+	return &Bot{
+		API:    api,
+		Sender: api,
+		Router: NewRouter(),
+		States: NewChatStates(),
+	}, nil
+}
+
+// Create a bot authenticated with the token of the TELEGRAM_BOT_TOKEN variable
+func NewFromEnv() (*Bot, error) {
+	token := os.Getenv(TokenEnv)
+	if token == "" {
+		return nil, ErrMissingToken
+	}
+	return New(token)
+}
+
+// Read the chat IDs of the TELEGRAM_ALLOWED_CHATS variable, see AllowChats.
+// The list is empty when the variable is not set.
+func AllowedChatsFromEnv() ([]int64, error) {
+	var chatIDs []int64
+	for _, value := range strings.Split(os.Getenv(AllowedChatsEnv), ",") {
+		if value = strings.TrimSpace(value); value == "" {
+			continue
+		}
+		id, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid chat ID %q in %s", value, AllowedChatsEnv)
+		}
+		chatIDs = append(chatIDs, id)
+	}
+	return chatIDs, nil
+}
+
+// Receive and handle the updates until the context is done
+func (b *Bot) Run(ctx context.Context) error {
+	if b.API == nil {
+		return errors.New("bot has no telegram client")
+	}
+
+	u := tgbotapi.NewUpdate(0)
+	u.Timeout = 60
+	updates := b.API.GetUpdatesChan(u)
+	defer b.API.StopReceivingUpdates()
+
+	log.Printf("bot: authorized as @%s", b.API.Self.UserName)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case update, ok := <-updates:
+			if !ok {
+				return nil
+			}
+			go b.HandleUpdate(ctx, update)
+		}
+	}
+}
+
+// Dispatch a single update to the router
+func (b *Bot) HandleUpdate(ctx context.Context, update tgbotapi.Update) {
+	c := b.newContext(ctx, update)
+	if c == nil {
+		return
+	}
+	if err := b.Router.Dispatch(c); err != nil {
+		log.Printf("bot: error during the update %d handling: %v", update.UpdateID, err)
+	}
+}
+
+func (b *Bot) newContext(ctx context.Context, update tgbotapi.Update) *Context {
+	if query := update.CallbackQuery; query != nil {
+		if query.Message == nil || query.Message.Chat == nil {
+			return nil
+		}
+		action, args := ParseCallbackData(query.Data)
+		return &Context{
+			Context:  ctx,
+			Bot:      b,
+			Update:   update,
+			Message:  query.Message,
+			Callback: query,
+			ChatID:   query.Message.Chat.ID,
+			Command:  action,
+			Args:     args,
+			State:    b.States.Get(query.Message.Chat.ID),
+		}
+	}
+
+	message := update.Message
+	if message == nil || message.Chat == nil {
+		return nil
+	}
+
+	command, args := ParseCommand(message.Text)
+	if command == "" {
+		command, args = ParseCommand(message.Caption)
+	}
+	return &Context{
+		Context: ctx,
+		Bot:     b,
+		Update:  update,
+		Message: message,
+		ChatID:  message.Chat.ID,
+		Command: command,
+		Args:    args,
+		State:   b.States.Get(message.Chat.ID),
+	}
+}
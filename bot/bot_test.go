@@ -0,0 +1,116 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// fakeSender record the sent messages instead of calling Telegram
+type fakeSender struct {
+	mu       sync.Mutex
+	sent     []tgbotapi.Chattable
+	fileURLs map[string]string
+}
+
+func (s *fakeSender) Send(c tgbotapi.Chattable) (tgbotapi.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sent = append(s.sent, c)
+	return tgbotapi.Message{MessageID: len(s.sent)}, nil
+}
+
+func (s *fakeSender) Request(c tgbotapi.Chattable) (*tgbotapi.APIResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sent = append(s.sent, c)
+	return &tgbotapi.APIResponse{Ok: true}, nil
+}
+
+func (s *fakeSender) GetFileDirectURL(fileID string) (string, error) {
+	url, ok := s.fileURLs[fileID]
+	if !ok {
+		return "", fmt.Errorf("unknown file %s", fileID)
+	}
+	return url, nil
+}
+
+// Get the text of the last sent message
+func (s *fakeSender) lastText() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := len(s.sent) - 1; i >= 0; i-- {
+		if msg, ok := s.sent[i].(tgbotapi.MessageConfig); ok {
+			return msg.Text
+		}
+	}
+	return ""
+}
+
+func newTestBot() (*Bot, *fakeSender) {
+	sender := &fakeSender{}
+	return &Bot{Sender: sender, Router: NewRouter(), States: NewChatStates()}, sender
+}
+
+// Build a text message update sent in the provided chat
+func textUpdate(chatID int64, text string) tgbotapi.Update {
+	return tgbotapi.Update{Message: &tgbotapi.Message{
+		Chat: &tgbotapi.Chat{ID: chatID},
+		Text: text,
+	}}
+}
+
+func TestNewFromEnvWithoutToken(t *testing.T) {
+	t.Setenv(TokenEnv, "")
+	if _, err := NewFromEnv(); err != ErrMissingToken {
+		t.Errorf("expected ErrMissingToken, got %v", err)
+	}
+}
+
+func TestAllowedChatsFromEnv(t *testing.T) {
+	t.Setenv(AllowedChatsEnv, "")
+	if chatIDs, err := AllowedChatsFromEnv(); err != nil || len(chatIDs) != 0 {
+		t.Errorf("expected no allowed chat, got %v %v", chatIDs, err)
+	}
+
+	t.Setenv(AllowedChatsEnv, "42, -100123,")
+	chatIDs, err := AllowedChatsFromEnv()
+	if err != nil || len(chatIDs) != 2 || chatIDs[0] != 42 || chatIDs[1] != -100123 {
+		t.Errorf("expected the 2 chat IDs, got %v %v", chatIDs, err)
+	}
+
+	t.Setenv(AllowedChatsEnv, "42,@channel")
+	if _, err := AllowedChatsFromEnv(); err == nil {
+		t.Error("expected an error for an invalid chat ID")
+	}
+}
+
+func TestHandleUpdate(t *testing.T) {
+	b, sender := newTestBot()
+
+	var got *Context
+	b.Router.Handle(Command{Name: "echo", Handler: func(c *Context) error {
+		got = c
+		return c.Reply(c.Arg(0))
+	}})
+
+	b.HandleUpdate(context.Background(), textUpdate(7, "/echo@GhostifyBot hello"))
+	if got == nil || got.ChatID != 7 || got.Command != "echo" {
+		t.Fatalf("unexpected context: %+v", got)
+	}
+	if got.State != b.States.Get(7) {
+		t.Error("expected the chat state to be attached to the context")
+	}
+	if sender.lastText() != "hello" {
+		t.Errorf("expected the echo reply, got %q", sender.lastText())
+	}
+
+	// Plain messages are ignored without NotFound handler
+	b.HandleUpdate(context.Background(), textUpdate(7, "just chatting"))
+	if len(sender.sent) != 1 {
+		t.Errorf("expected no reply to a plain message, got %d messages", len(sender.sent))
+	}
+}
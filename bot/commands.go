@@ -0,0 +1,366 @@
+package bot
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/DoniLite/GhostifyBot/services"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Chat state key of the default quality used by /download
+const qualityKey = "quality"
+
+var qualities = []string{"low", "high", "ultra"}
+
+// Argument of /download transcoding the files while they are downloading
+const streamArg = "stream"
+
+// Reply of the attached documents which can't be fetched, the details stay in the logs
+// because the file URLs of the Bot API contain the bot token
+var errAttachedFile = errors.New("could not fetch the attached file")
+
+// Inline keyboard actions of the job messages
+const (
+	cancelAction  = "cancel"
+	pauseAction   = "pause"
+	resumeAction  = "resume"
+	detailsAction = "details"
+)
+
+// JobCommands expose the job queue through the bot commands
+type JobCommands struct {
+	Queue      *services.JobQueue
+	TorrentDir string            // Where the attached .torrent documents are saved
+	Progress   *ProgressMessages // Keep the job messages up to date when set
+}
+
+// Register /download, /quality, /status and /cancel on the router.
+// Magnet links, .torrent URLs and .torrent documents sent without command are queued too.
+func (j *JobCommands) Register(r *Router) {
+	r.Handle(Command{
+		Name:        "download",
+		Usage:       "<magnet|url> [low|high|ultra] [stream]",
+		Description: "Download, optimize and send back the media files of a torrent, a .torrent document can be attached instead. With stream the files are optimized while downloading",
+		Handler:     j.Download,
+	})
+	r.Handle(Command{
+		Name:        "quality",
+		Usage:       "<low|high|ultra>",
+		Description: "Set the default quality of your downloads",
+		Handler:     j.Quality,
+	})
+	r.Handle(Command{
+		Name:        "status",
+		Usage:       "[job id]",
+		Description: "Show the state of a job or of every job of this chat",
+		Handler:     j.Status,
+	})
+	r.Handle(Command{
+		Name:        "cancel",
+		Usage:       "<job id>",
+		Description: "Cancel a job",
+		Handler:     j.Cancel,
+	})
+	r.Default = j.Auto
+
+	r.HandleCallback(cancelAction, j.cancelCallback)
+	r.HandleCallback(pauseAction, j.pauseCallback)
+	r.HandleCallback(resumeAction, j.resumeCallback)
+	r.HandleCallback(detailsAction, j.detailsCallback)
+}
+
+// Queue the torrent of the command argument or of the attached document
+func (j *JobCommands) Download(c *Context) error {
+	args := c.Args
+	var source string
+	if document := c.Message.Document; document != nil {
+		path, err := j.fetchDocument(c, document)
+		if err != nil {
+			return c.Reply(err.Error())
+		}
+		source = path
+	} else {
+		if len(args) == 0 {
+			return c.Reply("Usage: /download <magnet|url> [low|high|ultra] [stream] or attach a .torrent file")
+		}
+		source, args = args[0], args[1:]
+		if !services.IsMagnet(source) && !isURL(source) {
+			return c.Reply("The source must be a magnet link, a .torrent URL or a .torrent file")
+		}
+	}
+
+	quality := c.State.String(qualityKey, "high")
+	streaming := false
+	for _, arg := range args {
+		arg = strings.ToLower(arg)
+		switch {
+		case arg == streamArg:
+			streaming = true
+		case isQuality(arg):
+			quality = arg
+		default:
+			return c.Reply(fmt.Sprintf("Unknown quality %q, expected one of %s", arg, strings.Join(qualities, ", ")))
+		}
+	}
+
+	enqueue := j.Queue.Enqueue
+	if streaming {
+		enqueue = j.Queue.EnqueueStreaming
+	}
+	job, err := enqueue(source, c.ChatID, quality)
+	if err != nil {
+		return err
+	}
+
+	msg := tgbotapi.NewMessage(c.ChatID, fmt.Sprintf("Job %s queued (%s quality)", job.ID, quality))
+	msg.ReplyMarkup = jobKeyboard(job)
+	sent, err := c.Send(msg)
+	if err != nil {
+		return err
+	}
+	if j.Progress != nil {
+		j.Progress.Track(job.ID, c.ChatID, sent.MessageID)
+	}
+	return nil
+}
+
+// Queue the messages which are a magnet link, a .torrent URL or a .torrent document
+func (j *JobCommands) Auto(c *Context) error {
+	if document := c.Message.Document; document != nil {
+		if !isTorrentDocument(document) {
+			return nil
+		}
+		return j.Download(c)
+	}
+
+	text := strings.TrimSpace(c.Message.Text)
+	if !services.IsMagnet(text) && !(isURL(text) && strings.HasSuffix(strings.ToLower(text), ".torrent")) {
+		return nil
+	}
+	c.Args = []string{text}
+	return j.Download(c)
+}
+
+// Save an attached .torrent document fetched through the Bot API file endpoint
+func (j *JobCommands) fetchDocument(c *Context, document *tgbotapi.Document) (string, error) {
+	if !isTorrentDocument(document) {
+		return "", fmt.Errorf("the attached file must be a .torrent file")
+	}
+	if int64(document.FileSize) > services.TorrentFileMaxSize {
+		return "", fmt.Errorf("the attached .torrent file is too large")
+	}
+
+	fileURL, err := c.Bot.Sender.GetFileDirectURL(document.FileID)
+	if err != nil {
+		log.Printf("bot: error during the file %s url request: %s", document.FileID, redactURL(err, fileURL))
+		return "", errAttachedFile
+	}
+	dir := j.TorrentDir
+	if dir == "" {
+		dir = filepath.Join(services.DefaultDownloadDir(), "torrents")
+	}
+	path, err := services.DownloadTorrentFileContext(c, fileURL, dir)
+	if err != nil {
+		log.Printf("bot: error during the file %s download: %s", document.FileID, redactURL(err, fileURL))
+		return "", errAttachedFile
+	}
+	return path, nil
+}
+
+// Get the message of an error without the URLs it contains
+func redactURL(err error, fileURL string) string {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return fmt.Sprintf("%s <redacted>: %v", urlErr.Op, urlErr.Err)
+	}
+	if fileURL == "" {
+		return err.Error()
+	}
+	return strings.ReplaceAll(err.Error(), fileURL, "<redacted>")
+}
+
+func (j *JobCommands) Quality(c *Context) error {
+	quality := strings.ToLower(c.Arg(0))
+	if !isQuality(quality) {
+		return c.Reply(fmt.Sprintf("Usage: /quality <%s>, current: %s", strings.Join(qualities, "|"), c.State.String(qualityKey, "high")))
+	}
+	c.State.Set(qualityKey, quality)
+	return c.Reply("Default quality set to " + quality)
+}
+
+func (j *JobCommands) Status(c *Context) error {
+	if id := c.Arg(0); id != "" {
+		job, err := j.chatJob(c, id)
+		if err != nil {
+			return c.Reply(err.Error())
+		}
+		return c.Reply(formatJob(job))
+	}
+
+	jobs, err := j.Queue.Jobs()
+	if err != nil {
+		return err
+	}
+	var lines []string
+	for _, job := range jobs {
+		if job.ChatID == c.ChatID {
+			lines = append(lines, formatJob(job))
+		}
+	}
+	if len(lines) == 0 {
+		return c.Reply("No job yet, send /download to start one")
+	}
+	return c.Reply(strings.Join(lines, "\n"))
+}
+
+func (j *JobCommands) Cancel(c *Context) error {
+	id := c.Arg(0)
+	if id == "" {
+		return c.Reply("Usage: /cancel <job id>")
+	}
+	if _, err := j.chatJob(c, id); err != nil {
+		return c.Reply(err.Error())
+	}
+	if err := j.Queue.Cancel(id); err != nil {
+		return c.Reply(fmt.Sprintf("Can't cancel job %s: %v", id, err))
+	}
+	return c.Reply(fmt.Sprintf("Job %s cancelled", id))
+}
+
+// Get a job of the context chat, the jobs of the other chats are reported as unknown
+func (j *JobCommands) chatJob(c *Context, id string) (*services.Job, error) {
+	job, err := j.Queue.Job(id)
+	if errors.Is(err, services.ErrJobNotFound) || (err == nil && job.ChatID != c.ChatID) {
+		return nil, fmt.Errorf("unknown job %s", id)
+	}
+	return job, err
+}
+
+func (j *JobCommands) cancelCallback(c *Context) error {
+	job, err := j.callbackJob(c)
+	if err != nil || job == nil {
+		return err
+	}
+	if err := j.Queue.Cancel(job.ID); err != nil {
+		return c.Answer(err.Error())
+	}
+	c.Answer("Job cancelled")
+	if j.Progress.Tracking(job.ID) {
+		return nil
+	}
+	_, err = c.Send(tgbotapi.NewEditMessageText(c.ChatID, c.Message.MessageID, renderProgress(job.ID, services.JobCancelled, services.PipelineProgress{})))
+	return err
+}
+
+func (j *JobCommands) pauseCallback(c *Context) error {
+	job, err := j.callbackJob(c)
+	if err != nil || job == nil {
+		return err
+	}
+	if err := j.Queue.Pause(job.ID); err != nil {
+		return c.Answer(err.Error())
+	}
+	c.Answer("Job paused")
+	job.State = services.JobPaused
+	return j.refreshKeyboard(c, job)
+}
+
+func (j *JobCommands) resumeCallback(c *Context) error {
+	job, err := j.callbackJob(c)
+	if err != nil || job == nil {
+		return err
+	}
+	if err := j.Queue.Resume(job.ID); err != nil {
+		return c.Answer(err.Error())
+	}
+	c.Answer("Job resumed")
+	job.State = services.JobQueued
+	return j.refreshKeyboard(c, job)
+}
+
+func (j *JobCommands) detailsCallback(c *Context) error {
+	job, err := j.callbackJob(c)
+	if err != nil || job == nil {
+		return err
+	}
+	c.Answer("")
+	return c.Reply(formatJobDetails(job))
+}
+
+// Get the job of the clicked button, answering the callback when it's unknown
+func (j *JobCommands) callbackJob(c *Context) (*services.Job, error) {
+	job, err := j.chatJob(c, c.Arg(0))
+	if err != nil {
+		return nil, c.Answer(err.Error())
+	}
+	return job, nil
+}
+
+func (j *JobCommands) refreshKeyboard(c *Context, job *services.Job) error {
+	if j.Progress.Tracking(job.ID) {
+		return nil
+	}
+	_, err := c.Send(tgbotapi.NewEditMessageReplyMarkup(c.ChatID, c.Message.MessageID, jobKeyboard(job)))
+	return err
+}
+
+// Build the Cancel / Pause / Details keyboard of a job, Pause become Resume for paused jobs
+func jobKeyboard(job *services.Job) tgbotapi.InlineKeyboardMarkup {
+	pause := tgbotapi.NewInlineKeyboardButtonData("Pause", CallbackData(pauseAction, job.ID))
+	if job.State == services.JobPaused {
+		pause = tgbotapi.NewInlineKeyboardButtonData("Resume", CallbackData(resumeAction, job.ID))
+	}
+	return tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("Cancel", CallbackData(cancelAction, job.ID)),
+			pause,
+			tgbotapi.NewInlineKeyboardButtonData("Details", CallbackData(detailsAction, job.ID)),
+		),
+	)
+}
+
+func formatJobDetails(job *services.Job) string {
+	lines := []string{
+		"Job " + job.ID,
+		"State: " + string(job.State),
+		"Source: " + job.Source,
+		"Quality: " + job.Quality,
+		fmt.Sprintf("Attempts: %d", job.Attempts),
+		"Created: " + job.CreatedAt.Format(time.DateTime),
+	}
+	if job.LastError != "" {
+		lines = append(lines, "Last error: "+job.LastError)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func formatJob(job *services.Job) string {
+	line := fmt.Sprintf("%s: %s", job.ID, job.State)
+	if job.LastError != "" {
+		line += " (" + job.LastError + ")"
+	}
+	return line
+}
+
+func isTorrentDocument(document *tgbotapi.Document) bool {
+	return strings.HasSuffix(strings.ToLower(document.FileName), ".torrent") || document.MimeType == "application/x-bittorrent"
+}
+
+func isURL(text string) bool {
+	return strings.HasPrefix(text, "http://") || strings.HasPrefix(text, "https://")
+}
+
+func isQuality(quality string) bool {
+	for _, q := range qualities {
+		if q == quality {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,237 @@
+package bot
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/DoniLite/GhostifyBot/services"
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func newTestJobCommands(t *testing.T) (*Bot, *fakeSender, *services.JobQueue) {
+	store, err := services.OpenJobStore(filepath.Join(t.TempDir(), "jobs.db"))
+	if err != nil {
+		t.Fatalf("job store opening error: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	queue := services.NewJobQueue(store, nil)
+	b, sender := newTestBot()
+	(&JobCommands{Queue: queue}).Register(b.Router)
+	return b, sender, queue
+}
+
+func TestDownloadCommand(t *testing.T) {
+	b, sender, queue := newTestJobCommands(t)
+	ctx := context.Background()
+
+	b.HandleUpdate(ctx, textUpdate(5, "/download ftp://example.com/file.torrent"))
+	if !strings.Contains(sender.lastText(), "magnet link") {
+		t.Errorf("expected a source error, got %q", sender.lastText())
+	}
+
+	b.HandleUpdate(ctx, textUpdate(5, "/quality low"))
+	b.HandleUpdate(ctx, textUpdate(5, "/download magnet:?xt=urn:btih:abc"))
+	b.HandleUpdate(ctx, textUpdate(6, "/download https://example.com/file.torrent Ultra"))
+
+	jobs, err := queue.Jobs()
+	if err != nil || len(jobs) != 2 {
+		t.Fatalf("expected 2 jobs, got %d (%v)", len(jobs), err)
+	}
+	qualities := map[int64]string{}
+	for _, job := range jobs {
+		qualities[job.ChatID] = job.Quality
+	}
+	if qualities[5] != "low" || qualities[6] != "ultra" {
+		t.Errorf("unexpected job qualities: %v", qualities)
+	}
+	b.HandleUpdate(ctx, textUpdate(7, "/download magnet:?xt=urn:btih:def STREAM low"))
+	jobs, _ = queue.Jobs()
+	for _, job := range jobs {
+		if job.Streaming != (job.ChatID == 7) || (job.ChatID == 7 && job.Quality != "low") {
+			t.Errorf("expected only the job of chat 7 to be streamed, got %+v", job)
+		}
+	}
+}
+
+func TestStatusAndCancelCommands(t *testing.T) {
+	b, sender, queue := newTestJobCommands(t)
+	ctx := context.Background()
+
+	job, err := queue.Enqueue("magnet:?xt=urn:btih:abc", 5, "high")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b.HandleUpdate(ctx, textUpdate(5, "/status"))
+	if !strings.Contains(sender.lastText(), job.ID+": queued") {
+		t.Errorf("unexpected status: %q", sender.lastText())
+	}
+
+	// Jobs of the other chats are hidden
+	b.HandleUpdate(ctx, textUpdate(6, "/cancel "+job.ID))
+	if !strings.Contains(sender.lastText(), "unknown job") {
+		t.Errorf("expected an unknown job reply, got %q", sender.lastText())
+	}
+
+	b.HandleUpdate(ctx, textUpdate(5, "/cancel "+job.ID))
+	if !strings.Contains(sender.lastText(), "cancelled") {
+		t.Errorf("unexpected cancel reply: %q", sender.lastText())
+	}
+	b.HandleUpdate(ctx, textUpdate(5, "/status "+job.ID))
+	if !strings.Contains(sender.lastText(), "cancelled") {
+		t.Errorf("expected the cancelled state, got %q", sender.lastText())
+	}
+}
+
+// Serve a valid .torrent file and return its URL
+func serveTestTorrent(t *testing.T) string {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "episode.mkv"), bytes.Repeat([]byte("ghostify"), 4096), 0644); err != nil {
+		t.Fatal(err)
+	}
+	info := metainfo.Info{PieceLength: 16 << 10}
+	if err := info.BuildFromFilePath(filepath.Join(dir, "episode.mkv")); err != nil {
+		t.Fatal(err)
+	}
+	infoBytes, err := bencode.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data bytes.Buffer
+	if err := (&metainfo.MetaInfo{InfoBytes: infoBytes}).Write(&data); err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(data.Bytes())
+	}))
+	t.Cleanup(server.Close)
+	return server.URL + "/file/bot-token/documents/file_1.torrent"
+}
+
+func TestDownloadAttachedTorrent(t *testing.T) {
+	b, sender, queue := newTestJobCommands(t)
+	sender.fileURLs = map[string]string{"file-1": serveTestTorrent(t)}
+	torrentDir := t.TempDir()
+	(&JobCommands{Queue: queue, TorrentDir: torrentDir}).Register(b.Router)
+
+	update := tgbotapi.Update{Message: &tgbotapi.Message{
+		Chat:     &tgbotapi.Chat{ID: 5},
+		Caption:  "/download low",
+		Document: &tgbotapi.Document{FileID: "file-1", FileName: "episode.torrent", FileSize: 512},
+	}}
+	b.HandleUpdate(context.Background(), update)
+
+	jobs, _ := queue.Jobs()
+	if len(jobs) != 1 {
+		t.Fatalf("expected 1 job, got %d (last reply %q)", len(jobs), sender.lastText())
+	}
+	if filepath.Dir(jobs[0].Source) != torrentDir || jobs[0].Quality != "low" {
+		t.Errorf("unexpected job: %+v", jobs[0])
+	}
+
+	// A document sent without command is queued too, other documents are ignored
+	update.Message.Caption = ""
+	b.HandleUpdate(context.Background(), update)
+	update.Message.Document = &tgbotapi.Document{FileID: "file-2", FileName: "notes.txt"}
+	b.HandleUpdate(context.Background(), update)
+	if jobs, _ := queue.Jobs(); len(jobs) != 2 {
+		t.Errorf("expected 2 jobs, got %d", len(jobs))
+	}
+}
+
+func TestDownloadAttachedTorrentHidesToken(t *testing.T) {
+	b, sender, _ := newTestJobCommands(t)
+	server := httptest.NewServer(http.NotFoundHandler())
+	fileURL := server.URL + "/file/bot123456:secret-token/documents/file_1.torrent"
+	server.Close()
+	sender.fileURLs = map[string]string{"file-1": fileURL}
+
+	update := tgbotapi.Update{Message: &tgbotapi.Message{
+		Chat:     &tgbotapi.Chat{ID: 5},
+		Document: &tgbotapi.Document{FileID: "file-1", FileName: "episode.torrent", FileSize: 512},
+	}}
+	b.HandleUpdate(context.Background(), update)
+
+	reply := sender.lastText()
+	if reply == "" || strings.Contains(reply, "secret-token") {
+		t.Errorf("expected an error reply without the token, got %q", reply)
+	}
+}
+
+func TestDownloadReplyKeyboard(t *testing.T) {
+	b, sender, queue := newTestJobCommands(t)
+	b.HandleUpdate(context.Background(), textUpdate(5, "magnet:?xt=urn:btih:abc"))
+
+	jobs, _ := queue.Jobs()
+	if len(jobs) != 1 {
+		t.Fatalf("expected the magnet link to be queued, got %d jobs", len(jobs))
+	}
+	reply, ok := sender.sent[0].(tgbotapi.MessageConfig)
+	if !ok {
+		t.Fatalf("unexpected reply %T", sender.sent[0])
+	}
+	keyboard, ok := reply.ReplyMarkup.(tgbotapi.InlineKeyboardMarkup)
+	if !ok || len(keyboard.InlineKeyboard[0]) != 3 {
+		t.Fatalf("expected a 3 buttons keyboard, got %+v", reply.ReplyMarkup)
+	}
+	expected := []string{"cancel:" + jobs[0].ID, "pause:" + jobs[0].ID, "details:" + jobs[0].ID}
+	for i, button := range keyboard.InlineKeyboard[0] {
+		if *button.CallbackData != expected[i] {
+			t.Errorf("button %d data = %s, expected %s", i, *button.CallbackData, expected[i])
+		}
+	}
+}
+
+func TestJobKeyboardCallbacks(t *testing.T) {
+	b, sender, queue := newTestJobCommands(t)
+	job, _ := queue.Enqueue("magnet:?xt=urn:btih:abc", 5, "high")
+
+	click := func(chatID int64, data string) {
+		b.HandleUpdate(context.Background(), tgbotapi.Update{CallbackQuery: &tgbotapi.CallbackQuery{
+			ID:      "query",
+			Data:    data,
+			Message: &tgbotapi.Message{MessageID: 10, Chat: &tgbotapi.Chat{ID: chatID}},
+		}})
+	}
+
+	click(5, CallbackData(pauseAction, job.ID))
+	if paused, _ := queue.Job(job.ID); paused.State != services.JobPaused {
+		t.Fatalf("expected the job to be paused, got %s", paused.State)
+	}
+	edit, ok := sender.sent[len(sender.sent)-1].(tgbotapi.EditMessageReplyMarkupConfig)
+	if !ok || *edit.ReplyMarkup.InlineKeyboard[0][1].CallbackData != "resume:"+job.ID {
+		t.Errorf("expected the keyboard to offer Resume, got %+v", sender.sent[len(sender.sent)-1])
+	}
+
+	click(5, CallbackData(resumeAction, job.ID))
+	if resumed, _ := queue.Job(job.ID); resumed.State != services.JobQueued {
+		t.Fatalf("expected the job to be queued again, got %s", resumed.State)
+	}
+
+	click(5, CallbackData(detailsAction, job.ID))
+	if !strings.Contains(sender.lastText(), "Source: magnet:?xt=urn:btih:abc") {
+		t.Errorf("unexpected details: %q", sender.lastText())
+	}
+
+	// Buttons clicked from another chat are ignored
+	click(6, CallbackData(cancelAction, job.ID))
+	if current, _ := queue.Job(job.ID); current.State != services.JobQueued {
+		t.Errorf("expected the job to be untouched, got %s", current.State)
+	}
+
+	click(5, CallbackData(cancelAction, job.ID))
+	if cancelled, _ := queue.Job(job.ID); cancelled.State != services.JobCancelled {
+		t.Errorf("expected the job to be cancelled, got %s", cancelled.State)
+	}
+}
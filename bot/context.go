@@ -0,0 +1,56 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Context carry a command update to its handler.
+// The embedded context is cancelled when the bot stop.
+type Context struct {
+	context.Context
+	Bot      *Bot
+	Update   tgbotapi.Update
+	Message  *tgbotapi.Message
+	Callback *tgbotapi.CallbackQuery // Set for the inline keyboard button clicks
+	ChatID   int64
+	Command  string // Command name or callback action
+	Args     []string
+	State    *ChatState
+}
+
+// Get the argument at the provided position or an empty string
+func (c *Context) Arg(i int) string {
+	if i < 0 || i >= len(c.Args) {
+		return ""
+	}
+	return c.Args[i]
+}
+
+// Send a text message to the chat of the command
+func (c *Context) Reply(text string) error {
+	_, err := c.Send(tgbotapi.NewMessage(c.ChatID, text))
+	return err
+}
+
+// Acknowledge the button click of a callback, showing the text as a notification
+func (c *Context) Answer(text string) error {
+	if c.Callback == nil {
+		return nil
+	}
+	if c.Bot == nil || c.Bot.Sender == nil {
+		return fmt.Errorf("bot has no telegram client")
+	}
+	_, err := c.Bot.Sender.Request(tgbotapi.NewCallback(c.Callback.ID, text))
+	return err
+}
+
+// Send any message through the bot client
+func (c *Context) Send(msg tgbotapi.Chattable) (tgbotapi.Message, error) {
+	if c.Bot == nil || c.Bot.Sender == nil {
+		return tgbotapi.Message{}, fmt.Errorf("bot has no telegram client")
+	}
+	return c.Bot.Sender.Send(msg)
+}
@@ -0,0 +1,313 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DoniLite/GhostifyBot/services"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Default minimal delay between two edits of the same status message.
+// Telegram reject the bots editing a chat more than about once per second.
+const DefaultEditInterval = 3 * time.Second
+
+const progressBarWidth = 10
+
+// ProgressMessages keep one status message per job up to date with the
+// pipeline events. The edits of a message are coalesced and rate-limited.
+type ProgressMessages struct {
+	Sender   Sender
+	Interval time.Duration
+
+	mu       sync.Mutex
+	messages map[string]*progressMessage
+	offset   uint64 // First logged record needed by Restore
+}
+
+type progressMessage struct {
+	chatID    int64
+	messageID int
+	state     services.JobState
+	progress  services.PipelineProgress
+	lastEdit  time.Time
+	lastText  string
+	pending   *time.Timer
+}
+
+// Topic published when a message become the status message of a job.
+// Logged with the job states, it let Restore rebuild the status messages after a restart.
+var StatusMessageTopic = services.NewTopic(services.EventBus, "bot.status", encodeStatusMessage, decodeStatusMessage)
+
+// StatusMessage identify the status message of a job
+type StatusMessage struct {
+	JobID     string
+	ChatID    int64
+	MessageID int
+}
+
+func encodeStatusMessage(m StatusMessage) (*services.EventData, []string) {
+	return &services.EventData{Message: "status message of " + m.JobID}, []string{m.JobID, strconv.FormatInt(m.ChatID, 10), strconv.Itoa(m.MessageID)}
+}
+
+func decodeStatusMessage(data *services.EventData, args []string) (StatusMessage, error) {
+	if len(args) != 3 {
+		return StatusMessage{}, fmt.Errorf("expected 3 status message arguments, got %d", len(args))
+	}
+	chatID, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return StatusMessage{}, err
+	}
+	messageID, err := strconv.Atoi(args[2])
+	if err != nil {
+		return StatusMessage{}, err
+	}
+	return StatusMessage{JobID: args[0], ChatID: chatID, MessageID: messageID}, nil
+}
+
+func NewProgressMessages(sender Sender) *ProgressMessages {
+	return &ProgressMessages{
+		Sender:   sender,
+		Interval: DefaultEditInterval,
+		messages: make(map[string]*progressMessage),
+	}
+}
+
+// Listen to the job and pipeline events. Must be called once.
+func (p *ProgressMessages) Subscribe() {
+	services.JobStateTopic.Subscribe(func(ctx context.Context, change services.JobStateChange) {
+		p.setState(change.ID, change.State)
+	})
+	services.PipelineProgressTopic.Subscribe(func(ctx context.Context, progress services.PipelineProgress) {
+		p.setProgress(progress)
+	})
+}
+
+// Use the provided message as the status message of the job
+func (p *ProgressMessages) Track(jobID string, chatID int64, messageID int) {
+	p.mu.Lock()
+	p.messages[jobID] = &progressMessage{
+		chatID:    chatID,
+		messageID: messageID,
+		state:     services.JobQueued,
+		lastEdit:  time.Now(),
+	}
+	p.mu.Unlock()
+
+	StatusMessageTopic.Publish(context.Background(), StatusMessage{JobID: jobID, ChatID: chatID, MessageID: messageID})
+}
+
+// Rebuild the status messages of the unfinished jobs from the event log of the
+// EventBus after a restart, their text is refreshed with the last job state.
+// Must be called before Subscribe and before the job queue start.
+func (p *ProgressMessages) Restore() error {
+	tracked := make(map[string]StatusMessage)
+	firstSeqs := make(map[string]uint64) // First record of each job
+	first := func(jobID string, seq uint64) {
+		if current, ok := firstSeqs[jobID]; !ok || seq < current {
+			firstSeqs[jobID] = seq
+		}
+	}
+	end, err := StatusMessageTopic.ReplaySeq(0, func(seq uint64, message StatusMessage) {
+		tracked[message.JobID] = message
+		first(message.JobID, seq)
+	})
+	if err != nil {
+		return fmt.Errorf("error during the status messages replay: %v", err)
+	}
+
+	states := make(map[string]services.JobState)
+	stateEnd, err := services.JobStateTopic.ReplaySeq(0, func(seq uint64, change services.JobStateChange) {
+		states[change.ID] = change.State
+		first(change.ID, seq)
+	})
+	if err != nil {
+		return fmt.Errorf("error during the job states replay: %v", err)
+	}
+
+	keep := max(end, stateEnd)
+	var edits []*tgbotapi.EditMessageTextConfig
+	p.mu.Lock()
+	for jobID, tracked := range tracked {
+		state, ok := states[jobID]
+		if !ok || isFinal(state) {
+			continue
+		}
+		keep = min(keep, firstSeqs[jobID])
+		message := &progressMessage{chatID: tracked.ChatID, messageID: tracked.MessageID, state: state}
+		p.messages[jobID] = message
+		if edit := p.schedule(jobID, message); edit != nil {
+			edits = append(edits, edit)
+		}
+	}
+	p.offset = keep
+	p.mu.Unlock()
+
+	for _, edit := range edits {
+		p.send(edit)
+	}
+	return nil
+}
+
+// Get the first logged record the next Restore need, the older records can be
+// removed from the event log
+func (p *ProgressMessages) Offset() uint64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.offset
+}
+
+// Check if the status message of the job is kept up to date
+func (p *ProgressMessages) Tracking(jobID string) bool {
+	if p == nil {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, ok := p.messages[jobID]
+	return ok
+}
+
+func (p *ProgressMessages) setState(jobID string, state services.JobState) {
+	p.mu.Lock()
+	message, ok := p.messages[jobID]
+	if !ok {
+		p.mu.Unlock()
+		return
+	}
+	message.state = state
+	edit := p.schedule(jobID, message)
+	p.mu.Unlock()
+
+	p.send(edit)
+}
+
+func (p *ProgressMessages) setProgress(progress services.PipelineProgress) {
+	p.mu.Lock()
+	message, ok := p.messages[progress.ID]
+	if !ok || isFinal(message.state) {
+		p.mu.Unlock()
+		return
+	}
+	message.progress = progress
+	edit := p.schedule(progress.ID, message)
+	p.mu.Unlock()
+
+	p.send(edit)
+}
+
+// Return the edit to send now or send it once the interval since the last edit elapsed.
+// Must be called with the lock held, the returned edit is sent once unlocked.
+func (p *ProgressMessages) schedule(jobID string, message *progressMessage) *tgbotapi.EditMessageTextConfig {
+	if message.pending != nil {
+		return nil
+	}
+	wait := p.Interval - time.Since(message.lastEdit)
+	if wait <= 0 {
+		return p.edit(jobID, message)
+	}
+	message.pending = time.AfterFunc(wait, func() {
+		p.mu.Lock()
+		message.pending = nil
+		edit := p.edit(jobID, message)
+		p.mu.Unlock()
+
+		p.send(edit)
+	})
+	return nil
+}
+
+// Build the edit of the message, nil when its text is unchanged.
+// Must be called with the lock held.
+func (p *ProgressMessages) edit(jobID string, message *progressMessage) *tgbotapi.EditMessageTextConfig {
+	if isFinal(message.state) {
+		delete(p.messages, jobID)
+	}
+
+	text := renderProgress(jobID, message.state, message.progress)
+	if text == message.lastText {
+		return nil
+	}
+	message.lastText = text
+	message.lastEdit = time.Now()
+
+	edit := tgbotapi.NewEditMessageText(message.chatID, message.messageID, text)
+	if !isFinal(message.state) {
+		keyboard := jobKeyboard(&services.Job{ID: jobID, State: message.state})
+		edit.ReplyMarkup = &keyboard
+	}
+	return &edit
+}
+
+// Send an edit built by edit, the Telegram request must not hold the lock
+func (p *ProgressMessages) send(edit *tgbotapi.EditMessageTextConfig) {
+	if edit == nil {
+		return
+	}
+	if _, err := p.Sender.Send(*edit); err != nil {
+		log.Printf("bot: error during the message %d status edit: %v", edit.MessageID, err)
+	}
+}
+
+// Pipeline stage reporting the progress of each running job state
+var stateStages = map[services.JobState]services.PipelineStage{
+	services.JobDownloading: services.StageDownload,
+	services.JobTranscoding: services.StageTranscode,
+	services.JobUploading:   services.StageUpload,
+}
+
+// Render the status text of a job.
+// The job state and pipeline events are not ordered, so the progress of
+// another stage than the one of the state is ignored.
+func renderProgress(jobID string, state services.JobState, progress services.PipelineProgress) string {
+	lines := []string{fmt.Sprintf("Job %s: %s", jobID, state)}
+	stage, running := stateStages[state]
+	if !running {
+		return lines[0]
+	}
+	if progress.Stage != stage {
+		progress = services.PipelineProgress{}
+	}
+
+	lines = append(lines, fmt.Sprintf("%s %.1f%%", progressBar(progress.Percent), progress.Percent))
+
+	var details []string
+	if progress.Rate > 0 {
+		details = append(details, "Speed: "+formatBytes(progress.Rate)+"/s")
+	}
+	if progress.ETA > 0 {
+		details = append(details, "ETA: "+progress.ETA.Round(time.Second).String())
+	}
+	if len(details) > 0 {
+		lines = append(lines, strings.Join(details, " | "))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func progressBar(percent float64) string {
+	filled := int(percent / 100 * progressBarWidth)
+	filled = max(0, min(filled, progressBarWidth))
+	return "[" + strings.Repeat("█", filled) + strings.Repeat("░", progressBarWidth-filled) + "]"
+}
+
+func formatBytes(bytes float64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	unit := 0
+	for bytes >= 1024 && unit < len(units)-1 {
+		bytes /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%.0f %s", bytes, units[unit])
+	}
+	return fmt.Sprintf("%.1f %s", bytes, units[unit])
+}
+
+func isFinal(state services.JobState) bool {
+	return (&services.Job{State: state}).Finished()
+}
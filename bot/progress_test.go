@@ -0,0 +1,167 @@
+package bot
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DoniLite/GhostifyBot/services"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func TestRenderProgress(t *testing.T) {
+	text := renderProgress("abc", services.JobDownloading, services.PipelineProgress{
+		Stage:   services.StageDownload,
+		Percent: 42,
+		Rate:    1536 * 1024,
+		ETA:     90*time.Second + 300*time.Millisecond,
+	})
+	expected := "Job abc: downloading\n[████░░░░░░] 42.0%\nSpeed: 1.5 MB/s | ETA: 1m30s"
+	if text != expected {
+		t.Errorf("unexpected status:\n%s\nexpected:\n%s", text, expected)
+	}
+
+	if text := renderProgress("abc", services.JobDone, services.PipelineProgress{Percent: 100}); text != "Job abc: done" {
+		t.Errorf("unexpected final status: %q", text)
+	}
+	if bar := progressBar(150); bar != "[██████████]" {
+		t.Errorf("expected a full bar, got %s", bar)
+	}
+}
+
+// Collect the status message edits sent by the tracker
+func (s *fakeSender) edits() []tgbotapi.EditMessageTextConfig {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var edits []tgbotapi.EditMessageTextConfig
+	for _, c := range s.sent {
+		if edit, ok := c.(tgbotapi.EditMessageTextConfig); ok {
+			edits = append(edits, edit)
+		}
+	}
+	return edits
+}
+
+func TestProgressMessagesRateLimit(t *testing.T) {
+	sender := &fakeSender{}
+	progress := NewProgressMessages(sender)
+	progress.Interval = 100 * time.Millisecond
+	progress.Subscribe()
+
+	progress.Track("job-1", 5, 42)
+	services.EventBus.Emit(services.JobStateEvent, &services.EventData{}, "job-1", string(services.JobDownloading))
+	for percent := 10.0; percent <= 50; percent += 10 {
+		progress.setProgress(services.PipelineProgress{ID: "job-1", Stage: services.StageDownload, Percent: percent})
+	}
+	services.EventBus.Wait()
+
+	if edits := sender.edits(); len(edits) != 0 {
+		t.Fatalf("expected the edits to wait for the interval, got %d", len(edits))
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	edits := sender.edits()
+	if len(edits) != 1 {
+		t.Fatalf("expected the updates to be coalesced in 1 edit, got %d", len(edits))
+	}
+	if edits[0].MessageID != 42 || !strings.Contains(edits[0].Text, "50.0%") {
+		t.Errorf("expected the last progress in the edit, got %+v", edits[0])
+	}
+	if edits[0].ReplyMarkup == nil {
+		t.Error("expected the job keyboard to be kept")
+	}
+
+	progress.setState("job-1", services.JobDone)
+	time.Sleep(150 * time.Millisecond)
+	edits = sender.edits()
+	if len(edits) != 2 || edits[1].Text != "Job job-1: done" || edits[1].ReplyMarkup != nil {
+		t.Fatalf("expected a final edit without keyboard, got %+v", edits)
+	}
+	if progress.Tracking("job-1") {
+		t.Error("expected the finished job to be untracked")
+	}
+}
+
+// blockingSender hold every Send until released
+type blockingSender struct {
+	fakeSender
+	sending chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingSender) Send(c tgbotapi.Chattable) (tgbotapi.Message, error) {
+	s.sending <- struct{}{}
+	<-s.release
+	return s.fakeSender.Send(c)
+}
+
+func TestProgressMessagesSendUnlocked(t *testing.T) {
+	sender := &blockingSender{sending: make(chan struct{}), release: make(chan struct{})}
+	progress := NewProgressMessages(sender)
+	progress.Interval = 0
+	progress.Track("job-1", 5, 42)
+
+	go progress.setState("job-1", services.JobDownloading)
+	<-sender.sending
+
+	// A slow Telegram request must not block the other jobs updates
+	tracked := make(chan bool)
+	go func() { tracked <- progress.Tracking("job-1") }()
+	select {
+	case ok := <-tracked:
+		if !ok {
+			t.Error("expected the job to be tracked")
+		}
+	case <-time.After(time.Second):
+		t.Error("the tracker lock is held during the edit request")
+	}
+	close(sender.release)
+}
+
+func TestProgressMessagesRestore(t *testing.T) {
+	eventLog, err := services.OpenEventLog(filepath.Join(t.TempDir(), "events.db"))
+	if err != nil {
+		t.Fatalf("event log opening error: %v", err)
+	}
+	defer eventLog.Close()
+	if err := services.EventBus.SetLog(eventLog, "job.*", "bot.*"); err != nil {
+		t.Fatal(err)
+	}
+	defer services.EventBus.SetLog(nil)
+
+	// Before the restart
+	before := NewProgressMessages(&fakeSender{})
+	before.Track("job-finished", 5, 43)
+	before.Track("job-running", 5, 42)
+	services.JobStateTopic.Publish(context.Background(), services.JobStateChange{ID: "job-finished", State: services.JobDone})
+	services.JobStateTopic.Publish(context.Background(), services.JobStateChange{ID: "job-running", State: services.JobTranscoding})
+	services.EventBus.Wait()
+
+	sender := &fakeSender{}
+	after := NewProgressMessages(sender)
+	if err := after.Restore(); err != nil {
+		t.Fatalf("restore error: %v", err)
+	}
+
+	if !after.Tracking("job-running") || after.Tracking("job-finished") {
+		t.Error("expected only the unfinished job to be tracked again")
+	}
+	edits := sender.edits()
+	if len(edits) != 1 || edits[0].MessageID != 42 || !strings.HasPrefix(edits[0].Text, "Job job-running: transcoding") {
+		t.Errorf("expected the status message to be refreshed, got %+v", edits)
+	}
+
+	// The event log is left untouched, the offset skip the finished job only
+	var replayed []string
+	StatusMessageTopic.ReplaySeq(0, func(seq uint64, message StatusMessage) {
+		replayed = append(replayed, message.JobID)
+		if message.JobID == "job-running" && seq != after.Offset() {
+			t.Errorf("expected the offset %d of the unfinished job, got %d", seq, after.Offset())
+		}
+	})
+	if len(replayed) != 2 {
+		t.Errorf("expected every status message in the event log, got %v", replayed)
+	}
+}
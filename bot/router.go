@@ -0,0 +1,241 @@
+package bot
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// HandlerFunc handle a command
+type HandlerFunc func(c *Context) error
+
+// Middleware wrap a handler to run code around it
+type Middleware func(next HandlerFunc) HandlerFunc
+
+// Command describe a registered command
+type Command struct {
+	Name        string // Without the leading slash
+	Usage       string // Arguments shown in the help, e.g. "<job id>"
+	Description string
+	Handler     HandlerFunc
+}
+
+// Router dispatch the commands to their handler through the middleware chain
+type Router struct {
+	commands    map[string]Command
+	callbacks   map[string]HandlerFunc
+	middlewares []Middleware
+	// Called for the unknown commands, reply with a help hint when nil
+	NotFound HandlerFunc
+	// Called for the messages which are not commands, ignored when nil
+	Default HandlerFunc
+}
+
+// Create a router with the help command registered
+func NewRouter() *Router {
+	r := &Router{
+		commands:  make(map[string]Command),
+		callbacks: make(map[string]HandlerFunc),
+	}
+	r.Handle(Command{
+		Name:        "help",
+		Description: "Show this help",
+		Handler: func(c *Context) error {
+			return c.Reply(r.Help())
+		},
+	})
+	return r
+}
+
+// Append middlewares to the chain. The first one is the outermost.
+func (r *Router) Use(middlewares ...Middleware) {
+	r.middlewares = append(r.middlewares, middlewares...)
+}
+
+// Register a command, replacing any command with the same name
+func (r *Router) Handle(command Command) {
+	command.Name = strings.ToLower(strings.TrimPrefix(command.Name, "/"))
+	r.commands[command.Name] = command
+}
+
+// Register the handler of the inline keyboard buttons with the provided action.
+// The button data must be built with CallbackData.
+func (r *Router) HandleCallback(action string, handler HandlerFunc) {
+	r.callbacks[action] = handler
+}
+
+// List the registered commands sorted by name
+func (r *Router) Commands() []Command {
+	commands := make([]Command, 0, len(r.commands))
+	for _, command := range r.commands {
+		commands = append(commands, command)
+	}
+	sort.Slice(commands, func(i, j int) bool {
+		return commands[i].Name < commands[j].Name
+	})
+	return commands
+}
+
+// Generate the help text from the registered commands
+func (r *Router) Help() string {
+	var b strings.Builder
+	b.WriteString("Available commands:\n")
+	for _, command := range r.Commands() {
+		b.WriteString("/" + command.Name)
+		if command.Usage != "" {
+			b.WriteString(" " + command.Usage)
+		}
+		if command.Description != "" {
+			b.WriteString(" - " + command.Description)
+		}
+		b.WriteString("\n")
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// Run the handler of the context command or callback through the middleware chain
+func (r *Router) Dispatch(c *Context) error {
+	handler := r.route(c)
+	if handler == nil {
+		return nil
+	}
+
+	for i := len(r.middlewares) - 1; i >= 0; i-- {
+		handler = r.middlewares[i](handler)
+	}
+	return handler(c)
+}
+
+func (r *Router) route(c *Context) HandlerFunc {
+	if c.Callback != nil {
+		return r.callbacks[c.Command]
+	}
+	if c.Command == "" {
+		return r.Default
+	}
+	if command, ok := r.commands[c.Command]; ok {
+		return command.Handler
+	}
+	if r.NotFound != nil {
+		return r.NotFound
+	}
+	return func(c *Context) error {
+		return c.Reply(fmt.Sprintf("Unknown command /%s, send /help to list the commands", c.Command))
+	}
+}
+
+// Build the data of an inline keyboard button handled by HandleCallback.
+// Telegram limit the data to 64 bytes.
+func CallbackData(action string, args ...string) string {
+	return strings.Join(append([]string{action}, args...), ":")
+}
+
+// Split the data of an inline keyboard button into its action and arguments
+func ParseCallbackData(data string) (string, []string) {
+	parts := strings.Split(data, ":")
+	return parts[0], parts[1:]
+}
+
+// Split a command message into the lowercase command name and its arguments.
+// The bot mention of "/cmd@MyBot" is dropped and double quoted arguments may contain spaces.
+// An empty name is returned when the text is not a command.
+func ParseCommand(text string) (string, []string) {
+	text = strings.TrimSpace(text)
+	if !strings.HasPrefix(text, "/") {
+		return "", nil
+	}
+
+	fields := splitArgs(text[1:])
+	if len(fields) == 0 {
+		return "", nil
+	}
+	name, _, _ := strings.Cut(fields[0], "@")
+	return strings.ToLower(name), fields[1:]
+}
+
+func splitArgs(text string) []string {
+	var (
+		args    []string
+		current strings.Builder
+		quoted  bool
+		started bool
+	)
+	for _, r := range text {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			started = true
+		case unicode.IsSpace(r) && !quoted:
+			if started {
+				args = append(args, current.String())
+				current.Reset()
+				started = false
+			}
+		default:
+			current.WriteRune(r)
+			started = true
+		}
+	}
+	if started {
+		args = append(args, current.String())
+	}
+	return args
+}
+
+// Recover the handler panics and turn them into errors
+func Recover() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(c *Context) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					err = fmt.Errorf("panic in /%s handler: %v", c.Command, r)
+				}
+			}()
+			return next(c)
+		}
+	}
+}
+
+// Log every handled command with its error
+func Logger() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(c *Context) error {
+			err := next(c)
+			if c.Command != "" {
+				log.Printf("bot: chat %d /%s %v -> %v", c.ChatID, c.Command, c.Args, err)
+			}
+			return err
+		}
+	}
+}
+
+// Reply with the handler error so the user know the command failed
+func ReplyErrors() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(c *Context) error {
+			err := next(c)
+			if err != nil {
+				c.Reply("Error: " + err.Error())
+			}
+			return err
+		}
+	}
+}
+
+// Restrict the bot to the provided chats. Every chat is allowed when the list is empty.
+func AllowChats(chatIDs ...int64) Middleware {
+	allowed := make(map[int64]bool, len(chatIDs))
+	for _, id := range chatIDs {
+		allowed[id] = true
+	}
+	return func(next HandlerFunc) HandlerFunc {
+		return func(c *Context) error {
+			if len(allowed) > 0 && !allowed[c.ChatID] {
+				return nil
+			}
+			return next(c)
+		}
+	}
+}
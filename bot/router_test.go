@@ -0,0 +1,108 @@
+package bot
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseCommand(t *testing.T) {
+	tests := []struct {
+		text    string
+		command string
+		args    []string
+	}{
+		{"/status", "status", []string{}},
+		{"/Download@GhostifyBot magnet:?xt=abc low", "download", []string{"magnet:?xt=abc", "low"}},
+		{`/download "my file.torrent"  high`, "download", []string{"my file.torrent", "high"}},
+		{`/cancel ""`, "cancel", []string{""}},
+		{"hello", "", nil},
+		{"/", "", nil},
+	}
+
+	for _, tt := range tests {
+		command, args := ParseCommand(tt.text)
+		if command != tt.command {
+			t.Errorf("ParseCommand(%q) command = %q, expected %q", tt.text, command, tt.command)
+		}
+		if len(args) != len(tt.args) || (len(args) > 0 && !reflect.DeepEqual(args, tt.args)) {
+			t.Errorf("ParseCommand(%q) args = %q, expected %q", tt.text, args, tt.args)
+		}
+	}
+}
+
+func TestRouterMiddlewareOrder(t *testing.T) {
+	r := NewRouter()
+	var calls []string
+	trace := func(name string) Middleware {
+		return func(next HandlerFunc) HandlerFunc {
+			return func(c *Context) error {
+				calls = append(calls, name)
+				return next(c)
+			}
+		}
+	}
+	r.Use(trace("first"), trace("second"))
+	r.Handle(Command{Name: "/ping", Handler: func(c *Context) error {
+		calls = append(calls, "handler")
+		return nil
+	}})
+
+	if err := r.Dispatch(&Context{Command: "ping"}); err != nil {
+		t.Fatalf("dispatch error: %v", err)
+	}
+	expected := []string{"first", "second", "handler"}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Errorf("expected %v, got %v", expected, calls)
+	}
+}
+
+func TestRouterRecover(t *testing.T) {
+	r := NewRouter()
+	r.Use(Recover())
+	r.Handle(Command{Name: "boom", Handler: func(c *Context) error {
+		panic("unexpected")
+	}})
+
+	err := r.Dispatch(&Context{Command: "boom"})
+	if err == nil || !strings.Contains(err.Error(), "unexpected") {
+		t.Errorf("expected the panic as error, got %v", err)
+	}
+}
+
+func TestRouterHelpAndUnknownCommand(t *testing.T) {
+	b, sender := newTestBot()
+	b.Router.Handle(Command{Name: "cancel", Usage: "<job id>", Description: "Cancel a job", Handler: func(c *Context) error {
+		return errors.New("not called")
+	}})
+
+	help := b.Router.Help()
+	if !strings.Contains(help, "/cancel <job id> - Cancel a job") || !strings.Contains(help, "/help - Show this help") {
+		t.Errorf("unexpected help text:\n%s", help)
+	}
+	if strings.Index(help, "/cancel") > strings.Index(help, "/help") {
+		t.Error("expected the commands sorted by name")
+	}
+
+	b.HandleUpdate(t.Context(), textUpdate(1, "/unknown"))
+	if !strings.Contains(sender.lastText(), "/help") {
+		t.Errorf("expected a help hint, got %q", sender.lastText())
+	}
+}
+
+func TestAllowChats(t *testing.T) {
+	r := NewRouter()
+	r.Use(AllowChats(1))
+	called := 0
+	r.Handle(Command{Name: "ping", Handler: func(c *Context) error {
+		called++
+		return nil
+	}})
+
+	r.Dispatch(&Context{Command: "ping", ChatID: 1})
+	r.Dispatch(&Context{Command: "ping", ChatID: 2})
+	if called != 1 {
+		t.Errorf("expected only the allowed chat to be handled, got %d calls", called)
+	}
+}
@@ -0,0 +1,63 @@
+package bot
+
+import "sync"
+
+// ChatState hold the values kept between the commands of a chat
+type ChatState struct {
+	mu     sync.RWMutex
+	values map[string]any
+}
+
+// Get a value of the chat state
+func (s *ChatState) Get(key string) (any, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	value, ok := s.values[key]
+	return value, ok
+}
+
+// Get a string value, or the fallback when the key is missing or not a string
+func (s *ChatState) String(key, fallback string) string {
+	if value, ok := s.Get(key); ok {
+		if str, ok := value.(string); ok {
+			return str
+		}
+	}
+	return fallback
+}
+
+// Set a value of the chat state
+func (s *ChatState) Set(key string, value any) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values[key] = value
+}
+
+// Remove a value of the chat state
+func (s *ChatState) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.values, key)
+}
+
+// ChatStates keep one state per chat in memory
+type ChatStates struct {
+	mu     sync.Mutex
+	states map[int64]*ChatState
+}
+
+func NewChatStates() *ChatStates {
+	return &ChatStates{states: make(map[int64]*ChatState)}
+}
+
+// Get the state of a chat, creating it on first use
+func (s *ChatStates) Get(chatID int64) *ChatState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state, ok := s.states[chatID]
+	if !ok {
+		state = &ChatState{values: make(map[string]any)}
+		s.states[chatID] = state
+	}
+	return state
+}
@@ -0,0 +1,28 @@
+package bot
+
+import "testing"
+
+func TestChatStates(t *testing.T) {
+	states := NewChatStates()
+
+	first := states.Get(1)
+	first.Set("quality", "low")
+	if states.Get(1) != first {
+		t.Fatal("expected the same state for the same chat")
+	}
+	if got := states.Get(1).String("quality", "high"); got != "low" {
+		t.Errorf("expected low, got %s", got)
+	}
+	if got := states.Get(2).String("quality", "high"); got != "high" {
+		t.Errorf("expected the fallback for another chat, got %s", got)
+	}
+
+	first.Set("count", 3)
+	if got := first.String("count", "none"); got != "none" {
+		t.Errorf("expected the fallback for a non string value, got %s", got)
+	}
+	first.Delete("quality")
+	if _, ok := first.Get("quality"); ok {
+		t.Error("expected the value to be deleted")
+	}
+}
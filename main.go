@@ -1,181 +1,99 @@
 package main
 
 import (
-	"bufio"
 	"context"
 	"log"
 	"os"
-	"strings"
-
-	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
-)
-
-var (
-	// Menu texts
-	firstMenu  = "<b>Menu 1</b>\n\nA beautiful menu with a shiny inline button."
-	secondMenu = "<b>Menu 2</b>\n\nA better menu with even more shiny inline buttons."
-
-	// Button texts
-	nextButton     = "Next"
-	backButton     = "Back"
-	tutorialButton = "Tutorial"
-
-	// Store bot screaming status
-	screaming = false
-	bot       *tgbotapi.BotAPI
-
-	// Keyboard layout for the first menu. One button, one row
-	firstMenuMarkup = tgbotapi.NewInlineKeyboardMarkup(
-		tgbotapi.NewInlineKeyboardRow(
-			tgbotapi.NewInlineKeyboardButtonData(nextButton, nextButton),
-		),
-	)
-
-	// Keyboard layout for the second menu. Two buttons, one per row
-	secondMenuMarkup = tgbotapi.NewInlineKeyboardMarkup(
-		tgbotapi.NewInlineKeyboardRow(
-			tgbotapi.NewInlineKeyboardButtonData(backButton, backButton),
-		),
-		tgbotapi.NewInlineKeyboardRow(
-			tgbotapi.NewInlineKeyboardButtonURL(tutorialButton, "https://core.telegram.org/bots/api"),
-		),
-	)
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/DoniLite/GhostifyBot/bot"
+	"github.com/DoniLite/GhostifyBot/services"
 )
 
 func main() {
-	var err error
-	bot, err = tgbotapi.NewBotAPI("<YOUR_BOT_TOKEN_HERE>")
+	ghostify, err := bot.NewFromEnv()
 	if err != nil {
 		// Abort if something is wrong
 		log.Panic(err)
 	}
 
-	// Set this to true to log all interactions with telegram servers
-	bot.Debug = false
-
-	u := tgbotapi.NewUpdate(0)
-	u.Timeout = 60
-
-	// Create a new cancellable background context. Calling `cancel()` leads to the cancellation of the context
-	ctx := context.Background()
-	ctx, cancel := context.WithCancel(ctx)
-
-	// `updates` is a golang channel which receives telegram updates
-	updates := bot.GetUpdatesChan(u)
-
-	// Pass cancellable context to goroutine
-	go receiveUpdates(ctx, updates)
-
-	// Tell the user the bot is online
-	log.Println("Start listening for updates. Press enter to stop")
-
-	// Wait for a newline symbol, then cancel handling updates
-	bufio.NewReader(os.Stdin).ReadBytes('\n')
-	cancel()
-
-}
-
-func receiveUpdates(ctx context.Context, updates tgbotapi.UpdatesChannel) {
-	// `for {` means the loop is infinite until we manually stop it
-	for {
-		select {
-		// stop looping if ctx is cancelled
-		case <-ctx.Done():
-			return
-		// receive update from channel and then handle it
-		case update := <-updates:
-			handleUpdate(update)
-		}
+	downloadDir := services.DefaultDownloadDir()
+	store, err := services.OpenJobStore(filepath.Join(downloadDir, "jobs.db"))
+	if err != nil {
+		log.Panic(err)
 	}
-}
-
-func handleUpdate(update tgbotapi.Update) {
-	switch {
-	// Handle messages
-	case update.Message != nil:
-		handleMessage(update.Message)
+	defer store.Close()
 
-	// Handle button clicks
-	case update.CallbackQuery != nil:
-		handleButton(update.CallbackQuery)
+	// The job states and the status messages survive the restarts
+	eventLog, err := services.OpenEventLog(filepath.Join(downloadDir, "events.db"))
+	if err != nil {
+		log.Panic(err)
+	}
+	defer eventLog.Close()
+	if err := services.EventBus.SetLog(eventLog, "job.*", "pipeline.stage", "pipeline.done", "pipeline.failed", "bot.*"); err != nil {
+		log.Panic(err)
 	}
-}
 
-func handleMessage(message *tgbotapi.Message) {
-	user := message.From
-	text := message.Text
+	stopBridge, err := services.EventBridgeFromEnv(services.EventBus, eventLog)
+	if err != nil {
+		log.Panic(err)
+	}
+	if stopBridge != nil {
+		defer func() {
+			// Give the webhook a chance to deliver the last events
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			stopBridge(ctx)
+		}()
+	}
 
-	if user == nil {
-		return
+	progress := bot.NewProgressMessages(ghostify.Sender)
+	if err := progress.Restore(); err != nil {
+		log.Print(err)
 	}
+	progress.Subscribe()
 
-	// Print to console
-	log.Printf("%s wrote %s", user.FirstName, text)
+	// Only the last records are kept, with the ones of the status messages to restore
+	if retention := os.Getenv(services.EventsRetentionEnv); retention != "" {
+		count, err := strconv.ParseUint(retention, 10, 64)
+		if err != nil {
+			log.Panicf("invalid %s %q: %v", services.EventsRetentionEnv, retention, err)
+		}
+		if err := services.EventBus.RetainLog(count, progress.Offset()); err != nil {
+			log.Print(err)
+		}
+	}
 
-	var err error
-	if strings.HasPrefix(text, "/") {
-		err = handleCommand(message.Chat.ID, text)
-	} else if screaming && len(text) > 0 {
-		msg := tgbotapi.NewMessage(message.Chat.ID, strings.ToUpper(text))
-		// To preserve markdown, we attach entities (bold, italic..)
-		msg.Entities = message.Entities
-		_, err = bot.Send(msg)
-	} else {
-		// This is equivalent to forwarding, without the sender's name
-		copyMsg := tgbotapi.NewCopyMessage(message.Chat.ID, message.Chat.ID, message.MessageID)
-		_, err = bot.CopyMessage(copyMsg)
+	runner := services.PipelineJobRunner(downloadDir, filepath.Join(downloadDir, "optimized"), services.NewTelegramUploader(ghostify.API))
+	queue := services.NewJobQueue(store, runner)
+	if err := queue.Start(); err != nil {
+		log.Panic(err)
 	}
+	defer queue.Stop()
 
+	ghostify.Router.Use(bot.Recover(), bot.Logger(), bot.ReplyErrors())
+	// Without allowlist anyone finding the bot can download into the server
+	allowedChats, err := bot.AllowedChatsFromEnv()
 	if err != nil {
-		log.Printf("An error occured: %s", err.Error())
+		log.Panic(err)
 	}
-}
-
-// When we get a command, we react accordingly
-func handleCommand(chatId int64, command string) error {
-	var err error
-
-	switch command {
-	case "/scream":
-		screaming = true
-
-	case "/whisper":
-		screaming = false
-
-	case "/menu":
-		err = sendMenu(chatId)
+	if len(allowedChats) > 0 {
+		ghostify.Router.Use(bot.AllowChats(allowedChats...))
+	} else {
+		log.Printf("%s is not set, every chat can use the bot", bot.AllowedChatsEnv)
 	}
+	(&bot.JobCommands{Queue: queue, Progress: progress}).Register(ghostify.Router)
 
-	return err
-}
-
-func handleButton(query *tgbotapi.CallbackQuery) {
-	var text string
-
-	markup := tgbotapi.NewInlineKeyboardMarkup()
-	message := query.Message
+	// Stop handling updates on Ctrl+C or when the container stop
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
 
-	if query.Data == nextButton {
-		text = secondMenu
-		markup = secondMenuMarkup
-	} else if query.Data == backButton {
-		text = firstMenu
-		markup = firstMenuMarkup
+	log.Println("Start listening for updates. Press Ctrl+C to stop")
+	if err := ghostify.Run(ctx); err != nil {
+		log.Print(err)
 	}
-
-	callbackCfg := tgbotapi.NewCallback(query.ID, "")
-	bot.Send(callbackCfg)
-
-	// Replace menu text and keyboard
-	msg := tgbotapi.NewEditMessageTextAndMarkup(message.Chat.ID, message.MessageID, text, markup)
-	msg.ParseMode = tgbotapi.ModeHTML
-	bot.Send(msg)
-}
-
-func sendMenu(chatId int64) error {
-	msg := tgbotapi.NewMessage(chatId, firstMenu)
-	msg.ParseMode = tgbotapi.ModeHTML
-	msg.ReplyMarkup = firstMenuMarkup
-	_, err := bot.Send(msg)
-	return err
 }
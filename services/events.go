@@ -1,8 +1,11 @@
 package services
 
 import (
+	"fmt"
+	"path"
 	"reflect"
 	"sync"
+	"time"
 )
 
 var (
@@ -10,29 +13,65 @@ var (
 )
 
 func init() {
-	EventBus = &EventFactory{
+	EventBus = newEventFactory()
+}
+
+func newEventFactory() *EventFactory {
+	return &EventFactory{
 		Mu:             &sync.Mutex{},
 		Wg:             &sync.WaitGroup{},
 		eventGroup:     []*Event{},
-		registeredFunc: make(map[*Event][]EventHandler),
+		registeredFunc: make(map[*Event][]*subscriber),
 	}
 }
 
 type Event struct {
 	Name string
+
+	// Deliver the emitted data to the subscribers of the typed topic of the event
+	bridge   func(data *EventData, args ...string)
+	delivery DeliveryOptions
 }
 
 type EventData struct {
 	Message string
+	Seq     uint64    // Sequence number in the event log, 0 when the emission is not logged
+	Time    time.Time // Emission time, set by the bus
 }
 
 type EventHandler func(event *EventData, args ...string)
 
+// PatternHandler receive the events matching the pattern of an OnPattern subscription
+type PatternHandler func(event *Event, data *EventData, args ...string)
+
+// Subscription is a registered handler, see Unsubscribe
+type Subscription struct {
+	unsubscribe func()
+	once        sync.Once
+}
+
+// Remove the handler, it is not called by the next emissions. Calling it again does nothing.
+func (s *Subscription) Unsubscribe() {
+	s.once.Do(s.unsubscribe)
+}
+
+// A registered handler, its address is its identity
+type subscriber struct {
+	handler EventHandler
+	pattern string
+	matched PatternHandler
+	once    bool
+	queueSlot
+}
+
 type EventFactory struct {
 	Mu             *sync.Mutex
 	Wg             *sync.WaitGroup
 	eventGroup     []*Event
-	registeredFunc map[*Event][]EventHandler
+	registeredFunc map[*Event][]*subscriber
+	patterns       []*subscriber
+	eventLog       *EventLog
+	logPatterns    []string
 }
 
 func (bus *EventFactory) CreateEvent(eventName string) *Event {
@@ -49,32 +88,66 @@ func (bus *EventFactory) CreateEvent(eventName string) *Event {
 	return newEvent
 }
 
-func (bus *EventFactory) On(event *Event, handler EventHandler) {
-	bus.Mu.Lock()
-	defer bus.Mu.Unlock()
+// Call the handler on every emission of the event until the subscription is cancelled.
+// Registering the same handler twice call it twice.
+func (bus *EventFactory) On(event *Event, handler EventHandler) *Subscription {
+	return bus.subscribe(event, &subscriber{handler: handler})
+}
 
-	handlers := bus.registeredFunc[event]
-	for _, fn := range handlers {
-		if &fn == &handler {
-			return
-		}
+// Call the handler on the next emission of the event only
+func (bus *EventFactory) Once(event *Event, handler EventHandler) *Subscription {
+	return bus.subscribe(event, &subscriber{handler: handler, once: true})
+}
+
+// Call the handler on the emissions of every event whose name match the pattern,
+// like "torrent.*" or "pipeline.[df]*". The pattern syntax is the path.Match one.
+func (bus *EventFactory) OnPattern(pattern string, handler PatternHandler) (*Subscription, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("invalid event pattern %q : %v", pattern, err)
 	}
-	bus.registeredFunc[event] = append(handlers, handler)
+
+	sub := &subscriber{pattern: pattern, matched: handler}
+	bus.Mu.Lock()
+	bus.patterns = append(bus.patterns, sub)
+	bus.Mu.Unlock()
+
+	return &Subscription{unsubscribe: func() {
+		bus.Mu.Lock()
+		defer bus.Mu.Unlock()
+		bus.patterns = removeSubscriber(bus.patterns, sub)
+	}}, nil
 }
 
+func (bus *EventFactory) subscribe(event *Event, sub *subscriber) *Subscription {
+	bus.Mu.Lock()
+	bus.registeredFunc[event] = append(bus.registeredFunc[event], sub)
+	bus.Mu.Unlock()
+
+	return &Subscription{unsubscribe: func() {
+		bus.Mu.Lock()
+		defer bus.Mu.Unlock()
+		bus.removeSubscriber(event, sub)
+	}}
+}
+
+// Remove every registration of the handler function.
+//
+// Deprecated: the closures created from the same function literal can't be told
+// apart so they are all removed, use the Subscription returned by On instead.
 func (bus *EventFactory) Off(event *Event, handler EventHandler) {
 	bus.Mu.Lock()
 	defer bus.Mu.Unlock()
 
-	handlers := bus.registeredFunc[event]
-	filtered := make([]EventHandler, 0)
-
-	for _, h := range handlers {
-		if reflect.ValueOf(h).Pointer() != reflect.ValueOf(handler).Pointer() {
-			filtered = append(filtered, h)
+	for _, sub := range bus.registeredFunc[event] {
+		if reflect.ValueOf(sub.handler).Pointer() == reflect.ValueOf(handler).Pointer() {
+			bus.removeSubscriber(event, sub)
 		}
 	}
+}
 
+// Must be called with the lock held
+func (bus *EventFactory) removeSubscriber(event *Event, sub *subscriber) {
+	filtered := removeSubscriber(bus.registeredFunc[event], sub)
 	if len(filtered) == 0 {
 		delete(bus.registeredFunc, event)
 	} else {
@@ -82,17 +155,55 @@ func (bus *EventFactory) Off(event *Event, handler EventHandler) {
 	}
 }
 
+// Copy the subscribers without the removed one, the emissions in progress keep their slice
+func removeSubscriber(subscribers []*subscriber, removed *subscriber) []*subscriber {
+	filtered := make([]*subscriber, 0, len(subscribers))
+	for _, sub := range subscribers {
+		if sub != removed {
+			filtered = append(filtered, sub)
+		}
+	}
+	return filtered
+}
+
 func (bus *EventFactory) Emit(event *Event, data *EventData, args ...string) {
 	bus.Mu.Lock()
-	handlers := bus.registeredFunc[event]
+	bridge := event.bridge
 	bus.Mu.Unlock()
 
-	for _, handler := range handlers {
-		bus.Wg.Add(1)
-		go func(fn EventHandler) {
-			defer bus.Wg.Done()
-			fn(data, args...)
-		}(handler)
+	if bridge != nil {
+		bridge(data, args...)
+	}
+	bus.emitHandlers(event, data, args...)
+}
+
+// Call the untyped handlers of the event and the handlers of the matching patterns
+func (bus *EventFactory) emitHandlers(event *Event, data *EventData, args ...string) {
+	data = bus.appendLog(event, data, args)
+
+	bus.Mu.Lock()
+	subscribers := bus.registeredFunc[event]
+	for _, sub := range subscribers {
+		// Removed before the call so a concurrent emission can't call it again
+		if sub.once {
+			bus.removeSubscriber(event, sub)
+		}
+	}
+	var patterns []*subscriber
+	for _, sub := range bus.patterns {
+		if ok, _ := path.Match(sub.pattern, event.Name); ok {
+			patterns = append(patterns, sub)
+		}
+	}
+	options := event.delivery
+	bus.Mu.Unlock()
+
+	key := emissionKey(args)
+	for _, sub := range subscribers {
+		bus.deliver(event, options, &sub.queueSlot, key, func() { sub.handler(data, args...) })
+	}
+	for _, sub := range patterns {
+		bus.deliver(event, options, &sub.queueSlot, key, func() { sub.matched(event, data, args...) })
 	}
 }
 
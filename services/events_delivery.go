@@ -0,0 +1,204 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sync"
+)
+
+// DeliveryMode define how the emissions of an event reach its handlers
+type DeliveryMode int
+
+const (
+	DeliverAsync      DeliveryMode = iota // A goroutine per handler and emission, unordered
+	DeliverSync                           // Handlers called by Emit itself, in subscription order
+	DeliverOrdered                        // A queue per handler, Emit block while the queue is full (see SetDelivery)
+	DeliverDropOldest                     // A queue per handler, the oldest pending emission is dropped when full
+	DeliverCoalesce                       // Like DeliverDropOldest but a pending emission is replaced by a newer one of the same key
+)
+
+// Default number of pending emissions per handler in the queued modes
+const DefaultQueueSize = 64
+
+// DeliveryOptions of an event, see EventFactory.SetDelivery
+type DeliveryOptions struct {
+	Mode      DeliveryMode
+	QueueSize int // DefaultQueueSize when 0
+}
+
+// Topic published when an event handler panicked
+var HandlerErrorTopic *Topic[HandlerError]
+
+// Untyped event of HandlerErrorTopic with the name of the event as argument
+var HandlerErrorEvent *Event
+
+// HandlerError is a recovered panic of an event handler
+type HandlerError struct {
+	Event string
+	Panic string
+	Stack string
+}
+
+func (e HandlerError) Error() string {
+	return fmt.Sprintf("handler of the %s event panicked: %s", e.Event, e.Panic)
+}
+
+func encodeHandlerError(e HandlerError) (*EventData, []string) {
+	return &EventData{Message: e.Error()}, []string{e.Event, e.Panic}
+}
+
+func decodeHandlerError(data *EventData, args []string) (HandlerError, error) {
+	if len(args) != 2 {
+		return HandlerError{}, fmt.Errorf("expected 2 handler error arguments, got %d", len(args))
+	}
+	return HandlerError{Event: args[0], Panic: args[1]}, nil
+}
+
+// Set how the next emissions of the event are delivered.
+// The emissions already queued are still delivered with the previous mode.
+//
+// In the DeliverOrdered mode a handler must not emit the event it handles:
+// once its queue is full the emission wait for the handler itself and never return.
+func (bus *EventFactory) SetDelivery(event *Event, options DeliveryOptions) {
+	bus.Mu.Lock()
+	defer bus.Mu.Unlock()
+	event.delivery = options
+}
+
+// Call the handler with the delivery mode of the event.
+// The key identify the emissions replacing each other in the DeliverCoalesce mode.
+func (bus *EventFactory) deliver(event *Event, options DeliveryOptions, slot *queueSlot, key string, call func()) {
+	bus.Wg.Add(1)
+	run := func() {
+		defer bus.Wg.Done()
+		bus.call(event, call)
+	}
+
+	switch options.Mode {
+	case DeliverSync:
+		run()
+	case DeliverOrdered, DeliverDropOldest, DeliverCoalesce:
+		slot.get(event).push(bus, options, key, run)
+	default:
+		go run()
+	}
+}
+
+// Call the handler, a panic is recovered and published on HandlerErrorTopic
+func (bus *EventFactory) call(event *Event, call func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			handlerErr := HandlerError{Event: event.Name, Panic: fmt.Sprint(r), Stack: string(debug.Stack())}
+			// A panicking error handler would report itself forever
+			if HandlerErrorTopic == nil || event == HandlerErrorTopic.Event() {
+				log.Printf("event bus: %v\n%s", handlerErr, handlerErr.Stack)
+				return
+			}
+			HandlerErrorTopic.Publish(context.Background(), handlerErr)
+		}
+	}()
+	call()
+}
+
+// queueSlot hold the delivery queues of a handler, one per event so the
+// pattern handlers keep the order of each event. Created on the first queued emission.
+type queueSlot struct {
+	mu     sync.Mutex
+	queues map[*Event]*deliveryQueue
+}
+
+func (s *queueSlot) get(event *Event) *deliveryQueue {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.queues == nil {
+		s.queues = make(map[*Event]*deliveryQueue)
+	}
+	queue, ok := s.queues[event]
+	if !ok {
+		queue = newDeliveryQueue()
+		s.queues[event] = queue
+	}
+	return queue
+}
+
+// deliveryQueue call the pending emissions of a handler one at a time, in order.
+// Its goroutine only runs while emissions are pending. The queue is kept when
+// the delivery options change, each push apply the options of its emission.
+type deliveryQueue struct {
+	mu      sync.Mutex
+	space   *sync.Cond
+	pending []pendingEmission
+	running bool
+}
+
+type pendingEmission struct {
+	key string
+	run func()
+}
+
+func newDeliveryQueue() *deliveryQueue {
+	q := &deliveryQueue{}
+	q.space = sync.NewCond(&q.mu)
+	return q
+}
+
+func (q *deliveryQueue) push(bus *EventFactory, options DeliveryOptions, key string, run func()) {
+	if options.QueueSize <= 0 {
+		options.QueueSize = DefaultQueueSize
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if options.Mode == DeliverCoalesce {
+		for i, pending := range q.pending {
+			if pending.key == key {
+				bus.Wg.Done()
+				q.pending[i].run = run
+				return
+			}
+		}
+	}
+
+	for len(q.pending) >= options.QueueSize {
+		if options.Mode == DeliverOrdered {
+			// Backpressure until the drain free a place
+			q.space.Wait()
+			continue
+		}
+		q.pending = q.pending[1:]
+		bus.Wg.Done()
+	}
+	q.pending = append(q.pending, pendingEmission{key: key, run: run})
+
+	if !q.running {
+		q.running = true
+		go q.drain()
+	}
+}
+
+func (q *deliveryQueue) drain() {
+	for {
+		q.mu.Lock()
+		if len(q.pending) == 0 {
+			q.running = false
+			q.mu.Unlock()
+			return
+		}
+		next := q.pending[0]
+		q.pending = q.pending[1:]
+		q.space.Broadcast()
+		q.mu.Unlock()
+
+		next.run()
+	}
+}
+
+// Key of an emission: every event carry the ID of its subject as first argument
+func emissionKey(args []string) string {
+	if len(args) == 0 {
+		return ""
+	}
+	return args[0]
+}
@@ -0,0 +1,316 @@
+package services
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var eventsBucket = []byte("events")
+
+// Number of event log records kept across restarts, every record when unset
+const EventsRetentionEnv = "EVENTS_RETENTION"
+
+// EventRecord is an emission persisted by the EventLog
+type EventRecord struct {
+	Seq     uint64    `json:"seq"`
+	Event   string    `json:"event"`
+	Message string    `json:"message,omitempty"`
+	Args    []string  `json:"args,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// EventLog is an append-only log of the bus emissions inside an embedded bbolt
+// database. The sequence numbers start at 1 and keep growing across restarts.
+type EventLog struct {
+	db *bolt.DB
+}
+
+// Open or create the event log at the provided path
+func OpenEventLog(path string) (*EventLog, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("can't create event log dir: %v", err)
+	}
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("error during the event log opening : %v", err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(eventsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error during the event log initialization : %v", err)
+	}
+
+	return &EventLog{db: db}, nil
+}
+
+// Persist the emission and return its sequence number
+func (l *EventLog) Append(event string, data *EventData, args []string) (uint64, error) {
+	record := EventRecord{Event: event, Args: args, Time: time.Now()}
+	if data != nil {
+		record.Message = data.Message
+		if !data.Time.IsZero() {
+			record.Time = data.Time
+		}
+	}
+
+	err := l.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(eventsBucket)
+		seq, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		record.Seq = seq
+		encoded, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(seqKey(seq), encoded)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error during the event log append : %v", err)
+	}
+	return record.Seq, nil
+}
+
+// Number of records copied out of a read transaction at once
+const eventLogReadBatch = 256
+
+// Call fn with every record from the provided sequence number, in order.
+// The records are read by batches and fn is called outside of the transactions,
+// so it can append to the log.
+func (l *EventLog) Read(from uint64, fn func(EventRecord) error) error {
+	for {
+		var records []EventRecord
+		err := l.db.View(func(tx *bolt.Tx) error {
+			cursor := tx.Bucket(eventsBucket).Cursor()
+			for key, encoded := cursor.Seek(seqKey(from)); key != nil && len(records) < eventLogReadBatch; key, encoded = cursor.Next() {
+				var record EventRecord
+				if err := json.Unmarshal(encoded, &record); err != nil {
+					return err
+				}
+				records = append(records, record)
+			}
+			return nil
+		})
+		if err != nil || len(records) == 0 {
+			return err
+		}
+
+		for _, record := range records {
+			if err := fn(record); err != nil {
+				return err
+			}
+		}
+		from = records[len(records)-1].Seq + 1
+	}
+}
+
+// Remove the records before the provided sequence number
+func (l *EventLog) Truncate(before uint64) error {
+	return l.db.Update(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(eventsBucket).Cursor()
+		for key, _ := cursor.First(); key != nil && binary.BigEndian.Uint64(key) < before; key, _ = cursor.Next() {
+			if err := cursor.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Get the sequence number of the last appended record, 0 for an empty log
+func (l *EventLog) LastSeq() (uint64, error) {
+	var seq uint64
+	err := l.db.View(func(tx *bolt.Tx) error {
+		seq = tx.Bucket(eventsBucket).Sequence()
+		return nil
+	})
+	return seq, err
+}
+
+func (l *EventLog) Close() error {
+	return l.db.Close()
+}
+
+// Big endian keys keep the records sorted by sequence number
+func seqKey(seq uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return key
+}
+
+// Persist the next emissions of the events matching one of the patterns, every
+// event when no pattern is provided. The high frequency events like the
+// progress ones are better left out. A nil log stop the persistence.
+func (bus *EventFactory) SetLog(eventLog *EventLog, patterns ...string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid event pattern %q : %v", pattern, err)
+		}
+	}
+
+	bus.Mu.Lock()
+	defer bus.Mu.Unlock()
+	bus.eventLog, bus.logPatterns = eventLog, patterns
+	return nil
+}
+
+// Must be called with the lock held
+func (bus *EventFactory) logged(event *Event) bool {
+	if bus.eventLog == nil {
+		return false
+	}
+	if len(bus.logPatterns) == 0 {
+		return true
+	}
+	for _, pattern := range bus.logPatterns {
+		if ok, _ := path.Match(pattern, event.Name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Stamp the emission time and persist the emission when its event is logged.
+// The returned data carry the time and the sequence number of the record, the
+// data of the caller is not modified.
+func (bus *EventFactory) appendLog(event *Event, data *EventData, args []string) *EventData {
+	var record EventData
+	if data != nil {
+		record = *data
+	}
+	if record.Time.IsZero() {
+		record.Time = time.Now()
+	}
+
+	bus.Mu.Lock()
+	eventLog, logged := bus.eventLog, bus.logged(event)
+	bus.Mu.Unlock()
+	if !logged {
+		return &record
+	}
+
+	seq, err := eventLog.Append(event.Name, &record, args)
+	if err != nil {
+		// The live handlers are still called
+		log.Printf("event bus: %v", err)
+		return &record
+	}
+	record.Seq = seq
+	return &record
+}
+
+// Remove the logged emissions before the provided sequence number, once no
+// consumer need to replay them
+func (bus *EventFactory) TruncateLog(before uint64) error {
+	bus.Mu.Lock()
+	eventLog := bus.eventLog
+	bus.Mu.Unlock()
+	if eventLog == nil {
+		return fmt.Errorf("the event bus has no log")
+	}
+	return eventLog.Truncate(before)
+}
+
+// Remove the oldest logged emissions to keep only the last count ones.
+// The records from the keep sequence number are never removed.
+func (bus *EventFactory) RetainLog(count, keep uint64) error {
+	bus.Mu.Lock()
+	eventLog := bus.eventLog
+	bus.Mu.Unlock()
+	if eventLog == nil {
+		return fmt.Errorf("the event bus has no log")
+	}
+
+	last, err := eventLog.LastSeq()
+	if err != nil || last <= count {
+		return err
+	}
+	return eventLog.Truncate(min(last-count+1, keep))
+}
+
+// Call the handler synchronously with every logged emission from the provided
+// sequence number of the events matching the pattern. The sequence number
+// following the last record is returned, to replay the next emissions later.
+func (bus *EventFactory) Replay(from uint64, pattern string, handler PatternHandler) (uint64, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return from, fmt.Errorf("invalid event pattern %q : %v", pattern, err)
+	}
+	bus.Mu.Lock()
+	eventLog := bus.eventLog
+	bus.Mu.Unlock()
+	if eventLog == nil {
+		return from, fmt.Errorf("the event bus has no log")
+	}
+
+	next := from
+	err := eventLog.Read(from, func(record EventRecord) error {
+		next = record.Seq + 1
+		if ok, _ := path.Match(pattern, record.Event); ok {
+			handler(bus.CreateEvent(record.Event), &EventData{Message: record.Message, Seq: record.Seq, Time: record.Time}, record.Args...)
+		}
+		return nil
+	})
+	return next, err
+}
+
+// Same as OnPattern but the logged emissions from the provided sequence number
+// are replayed first. The live emissions wait for the end of the replay and
+// the ones already replayed are skipped, the handler see every emission once.
+func (bus *EventFactory) OnPatternFrom(from uint64, pattern string, handler PatternHandler) (*Subscription, error) {
+	replayed := make(chan struct{})
+	var next uint64
+	sub, err := bus.OnPattern(pattern, func(event *Event, data *EventData, args ...string) {
+		<-replayed
+		// Unlogged emissions have no sequence number
+		if data != nil && data.Seq != 0 && data.Seq < next {
+			return
+		}
+		handler(event, data, args...)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	next, err = bus.Replay(from, pattern, handler)
+	close(replayed)
+	if err != nil {
+		sub.Unsubscribe()
+		return nil, err
+	}
+	return sub, nil
+}
+
+// Call the handler synchronously with every logged value of the topic from the
+// provided sequence number, see EventFactory.Replay
+func (t *Topic[T]) Replay(from uint64, handler func(ctx context.Context, value T)) (uint64, error) {
+	return t.ReplaySeq(from, func(seq uint64, value T) {
+		handler(context.Background(), value)
+	})
+}
+
+// Same as Replay but the handler receive the sequence number of each value
+func (t *Topic[T]) ReplaySeq(from uint64, handler func(seq uint64, value T)) (uint64, error) {
+	if t.decode == nil {
+		return from, fmt.Errorf("the %s topic can't decode its logged values", t.Name)
+	}
+	return t.bus.Replay(from, t.Name, func(event *Event, data *EventData, args ...string) {
+		if value, err := t.decode(data, args); err == nil {
+			handler(data.Seq, value)
+		}
+	})
+}
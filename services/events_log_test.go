@@ -0,0 +1,209 @@
+package services
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func newTestEventLog(t *testing.T) (*EventLog, string) {
+	path := filepath.Join(t.TempDir(), "events.db")
+	eventLog, err := OpenEventLog(path)
+	if err != nil {
+		t.Fatalf("event log opening error: %v", err)
+	}
+	t.Cleanup(func() { eventLog.Close() })
+	return eventLog, path
+}
+
+func readRecords(t *testing.T, eventLog *EventLog, from uint64) []EventRecord {
+	var records []EventRecord
+	if err := eventLog.Read(from, func(record EventRecord) error {
+		records = append(records, record)
+		return nil
+	}); err != nil {
+		t.Fatalf("event log read error: %v", err)
+	}
+	return records
+}
+
+func TestEventLogSequence(t *testing.T) {
+	eventLog, path := newTestEventLog(t)
+
+	for _, message := range []string{"a", "b", "c"} {
+		if _, err := eventLog.Append("job.state", &EventData{Message: message}, []string{"job-1", message}); err != nil {
+			t.Fatalf("append error: %v", err)
+		}
+	}
+	records := readRecords(t, eventLog, 2)
+	if len(records) != 2 || records[0].Seq != 2 || records[0].Message != "b" || records[1].Args[1] != "c" {
+		t.Fatalf("expected the records from the offset, got %+v", records)
+	}
+
+	if err := eventLog.Truncate(3); err != nil {
+		t.Fatalf("truncate error: %v", err)
+	}
+	if records := readRecords(t, eventLog, 0); len(records) != 1 || records[0].Seq != 3 {
+		t.Errorf("expected only the last record, got %+v", records)
+	}
+
+	// The sequence keep growing after a reopening
+	eventLog.Close()
+	reopened, err := OpenEventLog(path)
+	if err != nil {
+		t.Fatalf("event log reopening error: %v", err)
+	}
+	defer reopened.Close()
+	if seq, err := reopened.Append("job.state", nil, nil); err != nil || seq != 4 {
+		t.Errorf("expected the sequence 4 after the reopening, got %d %v", seq, err)
+	}
+}
+
+func TestEventLogReadAppending(t *testing.T) {
+	eventLog, _ := newTestEventLog(t)
+	for range 300 {
+		eventLog.Append("job.state", nil, nil)
+	}
+
+	// The handler can write to the log, the records appended meanwhile are read too
+	count := 0
+	err := eventLog.Read(0, func(record EventRecord) error {
+		count++
+		if record.Seq == 300 {
+			_, err := eventLog.Append("job.state", nil, nil)
+			return err
+		}
+		return nil
+	})
+	if err != nil || count != 301 {
+		t.Errorf("expected 301 records, got %d (%v)", count, err)
+	}
+}
+
+func TestEventBusLogPatterns(t *testing.T) {
+	eventLog, _ := newTestEventLog(t)
+	bus := newEventFactory()
+	if err := bus.SetLog(eventLog, "job.*"); err != nil {
+		t.Fatalf("set log error: %v", err)
+	}
+	if err := bus.SetLog(eventLog, "job.["); err == nil {
+		t.Error("expected an error for an invalid pattern")
+	}
+
+	state := bus.CreateEvent("job.state")
+	progress := bus.CreateEvent("pipeline.progress")
+
+	var seqs []uint64
+	var mu sync.Mutex
+	bus.SetDelivery(state, DeliveryOptions{Mode: DeliverSync})
+	bus.On(state, func(data *EventData, args ...string) {
+		mu.Lock()
+		seqs = append(seqs, data.Seq)
+		mu.Unlock()
+	})
+
+	data := &EventData{Message: "queued"}
+	bus.Emit(state, data, "job-1", "queued")
+	bus.Emit(progress, &EventData{Message: "50"}, "job-1")
+	bus.Emit(state, nil, "job-1", "done")
+	bus.Wait()
+
+	if data.Seq != 0 {
+		t.Error("the data of the caller should not be modified")
+	}
+	if len(seqs) != 2 || seqs[0] != 1 || seqs[1] != 2 {
+		t.Errorf("expected the sequence numbers in the handler data, got %v", seqs)
+	}
+
+	var replayed []string
+	next, err := bus.Replay(2, "job.*", func(event *Event, data *EventData, args ...string) {
+		replayed = append(replayed, event.Name+":"+args[1])
+	})
+	if err != nil || next != 3 || len(replayed) != 1 || replayed[0] != "job.state:done" {
+		t.Errorf("expected the replay from the offset, got %v next %d err %v", replayed, next, err)
+	}
+}
+
+func TestEventBusRetainLog(t *testing.T) {
+	eventLog, _ := newTestEventLog(t)
+	bus := newEventFactory()
+	bus.SetLog(eventLog)
+	for range 5 {
+		eventLog.Append("job.state", nil, nil)
+	}
+
+	if err := bus.RetainLog(10, 6); err != nil {
+		t.Fatalf("retain error: %v", err)
+	}
+	if records := readRecords(t, eventLog, 0); len(records) != 5 {
+		t.Errorf("expected every record under the retention, got %d", len(records))
+	}
+
+	// The records from the keep offset stay over the retention
+	bus.RetainLog(2, 3)
+	if records := readRecords(t, eventLog, 0); len(records) != 3 || records[0].Seq != 3 {
+		t.Errorf("expected the records from the keep offset, got %+v", records)
+	}
+	bus.RetainLog(2, 6)
+	if records := readRecords(t, eventLog, 0); len(records) != 2 || records[0].Seq != 4 {
+		t.Errorf("expected the last 2 records, got %+v", records)
+	}
+}
+
+func TestEventBusReplayWithoutLog(t *testing.T) {
+	if _, err := newEventFactory().Replay(0, "*", func(*Event, *EventData, ...string) {}); err == nil {
+		t.Error("expected an error without event log")
+	}
+}
+
+func TestOnPatternFromReplayThenLive(t *testing.T) {
+	eventLog, _ := newTestEventLog(t)
+	bus := newEventFactory()
+	bus.SetLog(eventLog)
+	event := bus.CreateEvent("job.state")
+
+	bus.Emit(event, &EventData{Message: "1"}, "job-1")
+	bus.Emit(event, &EventData{Message: "2"}, "job-1")
+	bus.Wait()
+
+	var mu sync.Mutex
+	var received []string
+	sub, err := bus.OnPatternFrom(2, "job.*", func(event *Event, data *EventData, args ...string) {
+		mu.Lock()
+		received = append(received, data.Message)
+		mu.Unlock()
+	})
+	if err != nil {
+		t.Fatalf("subscription error: %v", err)
+	}
+	defer sub.Unsubscribe()
+
+	bus.Emit(event, &EventData{Message: "3"}, "job-1")
+	bus.Wait()
+
+	if len(received) != 2 || received[0] != "2" || received[1] != "3" {
+		t.Errorf("expected the replayed then the live emission, got %v", received)
+	}
+}
+
+func TestTopicReplay(t *testing.T) {
+	eventLog, _ := newTestEventLog(t)
+	bus := newEventFactory()
+	bus.SetLog(eventLog)
+	topic := NewTopic(bus, "job.state", encodeJobState, decodeJobState)
+
+	topic.Publish(context.Background(), JobStateChange{ID: "job-1", State: JobDownloading})
+	topic.Publish(context.Background(), JobStateChange{ID: "job-1", State: JobDone})
+	bus.Wait()
+
+	var states []JobState
+	if _, err := topic.Replay(0, func(ctx context.Context, change JobStateChange) {
+		states = append(states, change.State)
+	}); err != nil {
+		t.Fatalf("replay error: %v", err)
+	}
+	if len(states) != 2 || states[1] != JobDone {
+		t.Errorf("expected the decoded states, got %v", states)
+	}
+}
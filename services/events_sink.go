@@ -0,0 +1,442 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Environment variables of the event bridge, see EventBridgeFromEnv
+const (
+	WebhookURLEnv    = "EVENTS_WEBHOOK_URL"
+	WebhookSecretEnv = "EVENTS_WEBHOOK_SECRET"
+	EventsFilterEnv  = "EVENTS_FILTER"      // Comma separated patterns like "pipeline.done,pipeline.failed"
+	EventsStreamEnv  = "EVENTS_STREAM_ADDR" // Listen address of the NDJSON/SSE stream like "127.0.0.1:8090"
+)
+
+// Headers of the webhook requests
+const (
+	WebhookEventHeader     = "X-Ghostify-Event"
+	WebhookDeliveryHeader  = "X-Ghostify-Delivery"
+	WebhookTimestampHeader = "X-Ghostify-Timestamp"
+	WebhookSignatureHeader = "X-Ghostify-Signature"
+)
+
+var ErrSinkFull = errors.New("event sink queue is full")
+
+// EventSink forward the bus emissions out of the process, see EventFactory.AddSink.
+// Send must not block the emitter.
+type EventSink interface {
+	Send(record EventRecord) error
+}
+
+// Forward the emissions of the events matching one of the patterns to the
+// sink, every event when no pattern is provided
+func (bus *EventFactory) AddSink(sink EventSink, patterns ...string) (*Subscription, error) {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid event pattern %q : %v", pattern, err)
+		}
+	}
+	return bus.OnPattern("*", func(event *Event, data *EventData, args ...string) {
+		if !matchesEvent(patterns, event.Name) {
+			return
+		}
+		// The delivery can run long after the emission
+		record := EventRecord{Event: event.Name, Args: args, Time: time.Now()}
+		if data != nil {
+			record.Message, record.Seq = data.Message, data.Seq
+			if !data.Time.IsZero() {
+				record.Time = data.Time
+			}
+		}
+		if err := sink.Send(record); err != nil {
+			log.Printf("event sink: %s dropped: %v", event.Name, err)
+		}
+	})
+}
+
+func matchesEvent(patterns []string, name string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookSink POST every record as JSON to an URL, one at a time in order.
+// The failed requests are retried with an exponential backoff.
+type WebhookSink struct {
+	URL        string
+	Secret     string // Key of the HMAC-SHA256 signature header, unsigned requests when empty
+	Client     *http.Client
+	MaxRetries int
+	RetryDelay time.Duration // Doubled after every failed attempt
+
+	queue  chan EventRecord
+	ctx    context.Context // Cancelled to abandon the pending deliveries
+	cancel context.CancelFunc
+	stop   chan struct{}
+	done   chan struct{}
+	once   sync.Once
+}
+
+// Create a new webhook sink and start its delivery goroutine, see Close
+func NewWebhookSink(url, secret string) *WebhookSink {
+	s := &WebhookSink{
+		URL:        url,
+		Secret:     secret,
+		Client:     &http.Client{Timeout: 10 * time.Second},
+		MaxRetries: 5,
+		RetryDelay: time.Second,
+		queue:      make(chan EventRecord, 256),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	go s.loop()
+	return s
+}
+
+// Queue the record, ErrSinkFull is returned when the endpoint can't keep up
+func (s *WebhookSink) Send(record EventRecord) error {
+	select {
+	case <-s.stop:
+		return errors.New("webhook sink closed")
+	default:
+	}
+	select {
+	case s.queue <- record:
+		return nil
+	default:
+		return ErrSinkFull
+	}
+}
+
+// Deliver the queued records and stop the sink. When the context is done the
+// pending deliveries are abandoned and Close return once the sink stopped.
+func (s *WebhookSink) Close(ctx context.Context) error {
+	s.once.Do(func() { close(s.stop) })
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		s.cancel()
+		<-s.done
+		return ctx.Err()
+	}
+}
+
+func (s *WebhookSink) loop() {
+	defer close(s.done)
+	defer s.cancel()
+	ctx := s.ctx
+
+	for {
+		select {
+		case record := <-s.queue:
+			s.deliver(ctx, record)
+		case <-s.stop:
+			for {
+				select {
+				case record := <-s.queue:
+					s.deliver(ctx, record)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (s *WebhookSink) deliver(ctx context.Context, record EventRecord) {
+	body, err := json.Marshal(record)
+	if err != nil {
+		log.Printf("webhook sink: %v", err)
+		return
+	}
+
+	delay := s.RetryDelay
+	for attempt := 0; ; attempt++ {
+		retry, err := s.post(ctx, record, body)
+		if err == nil {
+			return
+		}
+		if !retry || attempt >= s.MaxRetries {
+			log.Printf("webhook sink: %s delivery abandoned after %d attempt(s): %v", record.Event, attempt+1, err)
+			return
+		}
+		select {
+		case <-time.After(delay):
+			delay *= 2
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Send the request, the network errors, 429 and 5xx responses are retried
+func (s *WebhookSink) post(ctx context.Context, record EventRecord, body []byte) (bool, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(WebhookEventHeader, record.Event)
+	request.Header.Set(WebhookTimestampHeader, timestamp)
+	if record.Seq != 0 {
+		request.Header.Set(WebhookDeliveryHeader, strconv.FormatUint(record.Seq, 10))
+	}
+	if s.Secret != "" {
+		request.Header.Set(WebhookSignatureHeader, SignWebhook(s.Secret, timestamp, body))
+	}
+
+	response, err := s.Client.Do(request)
+	if err != nil {
+		return true, err
+	}
+	io.Copy(io.Discard, response.Body)
+	response.Body.Close()
+
+	if response.StatusCode >= 200 && response.StatusCode < 300 {
+		return false, nil
+	}
+	retry := response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= 500
+	return retry, fmt.Errorf("webhook responded %s", response.Status)
+}
+
+// Sign the webhook body like "sha256=<hex>". The timestamp is signed with the
+// body so a captured request can't be replayed later with another timestamp.
+func SignWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Check the signature header of a received webhook
+func VerifyWebhook(secret, timestamp string, body []byte, signature string) bool {
+	return hmac.Equal([]byte(SignWebhook(secret, timestamp, body)), []byte(signature))
+}
+
+// StreamSink serve the records to the connected HTTP clients as NDJSON, or as
+// Server-Sent Events when the client accept text/event-stream. The clients can
+// filter the events with ?events=torrent.*,job.* and resume from the event log
+// with ?from=<seq> or the Last-Event-ID header of the SSE reconnections.
+type StreamSink struct {
+	Log        *EventLog // Optional, needed to resume from a sequence number
+	BufferSize int       // Pending records per client, a slower client miss records
+
+	mu      sync.Mutex
+	clients map[chan EventRecord]struct{}
+	closed  chan struct{}
+	once    sync.Once
+}
+
+func NewStreamSink(eventLog *EventLog) *StreamSink {
+	return &StreamSink{
+		Log:        eventLog,
+		BufferSize: 64,
+		clients:    make(map[chan EventRecord]struct{}),
+		closed:     make(chan struct{}),
+	}
+}
+
+// End the connected streams and the next ones, the clients never go idle
+// so an http.Server can't be shut down without it
+func (s *StreamSink) Close() {
+	s.once.Do(func() { close(s.closed) })
+}
+
+// Broadcast the record to the connected clients
+func (s *StreamSink) Send(record EventRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for client := range s.clients {
+		select {
+		case client <- record:
+		default:
+		}
+	}
+	return nil
+}
+
+func (s *StreamSink) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	var patterns []string
+	if events := r.URL.Query().Get("events"); events != "" {
+		patterns = strings.Split(events, ",")
+	}
+	var from uint64
+	if value := r.URL.Query().Get("from"); value != "" {
+		seq, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid from sequence number", http.StatusBadRequest)
+			return
+		}
+		from = seq
+	}
+	if lastID := r.Header.Get("Last-Event-ID"); lastID != "" {
+		if seq, err := strconv.ParseUint(lastID, 10, 64); err == nil {
+			from = seq + 1
+		}
+	}
+
+	sse := strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+	if sse {
+		w.Header().Set("Content-Type", "text/event-stream")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	// Registered before the replay so no record is missed in between
+	client := make(chan EventRecord, max(1, s.BufferSize))
+	s.mu.Lock()
+	s.clients[client] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.clients, client)
+		s.mu.Unlock()
+	}()
+
+	write := func(record EventRecord) error {
+		if !matchesEvent(patterns, record.Event) {
+			return nil
+		}
+		return writeStreamRecord(w, record, sse)
+	}
+	next := from
+	if from > 0 && s.Log != nil {
+		if err := s.Log.Read(from, func(record EventRecord) error {
+			next = record.Seq + 1
+			return write(record)
+		}); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.closed:
+			return
+		case record := <-client:
+			// Already replayed
+			if record.Seq != 0 && record.Seq < next {
+				continue
+			}
+			if err := write(record); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+func writeStreamRecord(w io.Writer, record EventRecord, sse bool) error {
+	encoded, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if !sse {
+		_, err = fmt.Fprintf(w, "%s\n", encoded)
+		return err
+	}
+	if record.Seq != 0 {
+		if _, err := fmt.Fprintf(w, "id: %d\n", record.Seq); err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", record.Event, encoded)
+	return err
+}
+
+// Start the sinks configured by the environment: a webhook when EVENTS_WEBHOOK_URL
+// is set and the NDJSON/SSE stream on /events when EVENTS_STREAM_ADDR is set.
+// The returned function stop them, it is nil when no sink is configured.
+func EventBridgeFromEnv(bus *EventFactory, eventLog *EventLog) (func(context.Context) error, error) {
+	var patterns []string
+	for _, pattern := range strings.Split(os.Getenv(EventsFilterEnv), ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			patterns = append(patterns, pattern)
+		}
+	}
+
+	var stops []func(context.Context) error
+	stop := func(ctx context.Context) error {
+		var errs []error
+		for _, fn := range stops {
+			errs = append(errs, fn(ctx))
+		}
+		return errors.Join(errs...)
+	}
+
+	if url := os.Getenv(WebhookURLEnv); url != "" {
+		webhook := NewWebhookSink(url, os.Getenv(WebhookSecretEnv))
+		sub, err := bus.AddSink(webhook, patterns...)
+		if err != nil {
+			webhook.Close(context.Background())
+			return nil, err
+		}
+		stops = append(stops, func(ctx context.Context) error {
+			sub.Unsubscribe()
+			return webhook.Close(ctx)
+		})
+	}
+
+	if addr := os.Getenv(EventsStreamEnv); addr != "" {
+		stream := NewStreamSink(eventLog)
+		sub, err := bus.AddSink(stream, patterns...)
+		if err != nil {
+			stop(context.Background())
+			return nil, err
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/events", stream)
+		server := &http.Server{Addr: addr, Handler: mux}
+		server.RegisterOnShutdown(stream.Close)
+		go func() {
+			if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Printf("event stream: %v", err)
+			}
+		}()
+		stops = append(stops, func(ctx context.Context) error {
+			sub.Unsubscribe()
+			return server.Shutdown(ctx)
+		})
+	}
+
+	if len(stops) == 0 {
+		return nil, nil
+	}
+	return stop, nil
+}
@@ -0,0 +1,337 @@
+package services
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookRequest is a request received by the fake webhook endpoint
+type webhookRequest struct {
+	event     string
+	timestamp string
+	signature string
+	body      []byte
+}
+
+// Start a webhook endpoint answering the provided status codes in order, then 204
+func newTestWebhook(t *testing.T, statuses ...int) (*httptest.Server, func() []webhookRequest) {
+	var (
+		mu       sync.Mutex
+		requests []webhookRequest
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		requests = append(requests, webhookRequest{
+			event:     r.Header.Get(WebhookEventHeader),
+			timestamp: r.Header.Get(WebhookTimestampHeader),
+			signature: r.Header.Get(WebhookSignatureHeader),
+			body:      body,
+		})
+		status := http.StatusNoContent
+		if len(requests) <= len(statuses) {
+			status = statuses[len(requests)-1]
+		}
+		mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	return server, func() []webhookRequest {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]webhookRequest(nil), requests...)
+	}
+}
+
+func TestWebhookSinkSignedDelivery(t *testing.T) {
+	server, requests := newTestWebhook(t)
+	bus := newEventFactory()
+	sink := NewWebhookSink(server.URL, "secret")
+	if _, err := bus.AddSink(sink, "pipeline.done", "pipeline.failed"); err != nil {
+		t.Fatalf("sink error: %v", err)
+	}
+
+	bus.Emit(bus.CreateEvent("pipeline.done"), &EventData{Message: "2 file(s) processed"}, "job-1", "done")
+	bus.Emit(bus.CreateEvent("pipeline.progress"), &EventData{Message: "50"}, "job-1")
+	bus.Wait()
+	if err := sink.Close(context.Background()); err != nil {
+		t.Fatalf("close error: %v", err)
+	}
+
+	sent := requests()
+	if len(sent) != 1 || sent[0].event != "pipeline.done" {
+		t.Fatalf("expected only the filtered event, got %+v", sent)
+	}
+	if !VerifyWebhook("secret", sent[0].timestamp, sent[0].body, sent[0].signature) {
+		t.Errorf("invalid signature %s", sent[0].signature)
+	}
+	if VerifyWebhook("other", sent[0].timestamp, sent[0].body, sent[0].signature) {
+		t.Error("the signature should depend on the secret")
+	}
+
+	var record EventRecord
+	if err := json.Unmarshal(sent[0].body, &record); err != nil {
+		t.Fatalf("invalid body: %v", err)
+	}
+	if record.Event != "pipeline.done" || record.Message != "2 file(s) processed" || record.Args[0] != "job-1" {
+		t.Errorf("unexpected record %+v", record)
+	}
+}
+
+// chanSink forward the records to a channel
+type chanSink chan EventRecord
+
+func (s chanSink) Send(record EventRecord) error {
+	s <- record
+	return nil
+}
+
+func TestAddSinkEmissionTime(t *testing.T) {
+	eventLog, _ := newTestEventLog(t)
+	bus := newEventFactory()
+	bus.SetLog(eventLog)
+	sink := make(chanSink, 2)
+	bus.AddSink(sink)
+
+	before := time.Now()
+	bus.Emit(bus.CreateEvent("job.state"), nil, "job-1")
+	bus.Emit(bus.CreateEvent("pipeline.progress"), &EventData{Message: "50"}, "job-1")
+	bus.Wait()
+
+	// The logged record and the sink share the emission time
+	logged := readRecords(t, eventLog, 0)
+	for range logged {
+		record := <-sink
+		expected := logged[record.Seq-1]
+		if !record.Time.Equal(expected.Time) || record.Time.Before(before) {
+			t.Errorf("record %d time %s, expected the emission time %s", record.Seq, record.Time, expected.Time)
+		}
+	}
+}
+
+func TestWebhookSinkRetries(t *testing.T) {
+	server, requests := newTestWebhook(t, http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	sink := NewWebhookSink(server.URL, "")
+	sink.RetryDelay = time.Millisecond
+
+	sink.Send(EventRecord{Event: "job.state"})
+	sink.Close(context.Background())
+
+	sent := requests()
+	if len(sent) != 3 {
+		t.Fatalf("expected 2 retries before the success, got %d requests", len(sent))
+	}
+	if sent[0].signature != "" {
+		t.Error("expected unsigned requests without secret")
+	}
+}
+
+func TestWebhookSinkClientErrorNotRetried(t *testing.T) {
+	server, requests := newTestWebhook(t, http.StatusBadRequest)
+	sink := NewWebhookSink(server.URL, "secret")
+	sink.RetryDelay = time.Millisecond
+
+	sink.Send(EventRecord{Event: "job.state"})
+	sink.Close(context.Background())
+
+	if sent := requests(); len(sent) != 1 {
+		t.Errorf("expected no retry of a client error, got %d requests", len(sent))
+	}
+	if err := sink.Send(EventRecord{}); err == nil {
+		t.Error("expected an error after the close")
+	}
+}
+
+func TestWebhookSinkCloseAbandonRetries(t *testing.T) {
+	server, requests := newTestWebhook(t, http.StatusServiceUnavailable)
+	sink := NewWebhookSink(server.URL, "")
+	sink.RetryDelay = time.Hour
+
+	sink.Send(EventRecord{Event: "job.state"})
+	sink.Send(EventRecord{Event: "job.state"})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := sink.Close(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected the context error, got %v", err)
+	}
+
+	// The sink is stopped when Close return
+	select {
+	case <-sink.done:
+	default:
+		t.Error("expected the delivery goroutine to be stopped")
+	}
+	if sent := len(requests()); sent != 1 {
+		t.Errorf("expected the second record to be abandoned, got %d requests", sent)
+	}
+}
+
+// Scan the stream lines in the background
+func streamLines(response *http.Response) <-chan string {
+	lines := make(chan string, 16)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(response.Body)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+	return lines
+}
+
+// Wait for the next lines of the stream
+func readLines(t *testing.T, lines <-chan string, count int) []string {
+	var read []string
+	timeout := time.After(2 * time.Second)
+	for len(read) < count {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				t.Fatalf("stream closed after %v", read)
+			}
+			read = append(read, line)
+		case <-timeout:
+			t.Fatalf("timeout after %v", read)
+		}
+	}
+	return read
+}
+
+func TestStreamSinkNDJSON(t *testing.T) {
+	eventLog, err := OpenEventLog(filepath.Join(t.TempDir(), "events.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer eventLog.Close()
+
+	bus := newEventFactory()
+	bus.SetLog(eventLog)
+	stream := NewStreamSink(eventLog)
+	bus.AddSink(stream)
+	server := httptest.NewServer(stream)
+	defer server.Close()
+
+	done := bus.CreateEvent("pipeline.done")
+	bus.Emit(done, &EventData{Message: "before"}, "job-1")
+	bus.Wait()
+
+	response, err := http.Get(server.URL + "?from=1&events=pipeline.*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if response.Header.Get("Content-Type") != "application/x-ndjson" {
+		t.Errorf("unexpected content type %s", response.Header.Get("Content-Type"))
+	}
+
+	// Wait for the replay so the live emissions follow it
+	received := streamLines(response)
+	lines := readLines(t, received, 1)
+	bus.Emit(bus.CreateEvent("job.state"), &EventData{Message: "filtered"}, "job-1")
+	bus.Emit(done, &EventData{Message: "live"}, "job-2")
+	bus.Wait()
+	lines = append(lines, readLines(t, received, 1)...)
+
+	var records []EventRecord
+	for _, line := range lines {
+		var record EventRecord
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("invalid line %q: %v", line, err)
+		}
+		records = append(records, record)
+	}
+	if records[0].Message != "before" || records[0].Seq != 1 || records[1].Message != "live" || records[1].Seq != 3 {
+		t.Errorf("expected the replayed then the live record, got %+v", records)
+	}
+}
+
+func TestStreamSinkSSE(t *testing.T) {
+	stream := NewStreamSink(nil)
+	server := httptest.NewServer(stream)
+	defer server.Close()
+
+	request, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	request.Header.Set("Accept", "text/event-stream")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	// The headers are flushed once the client is registered
+	stream.Send(EventRecord{Seq: 7, Event: "torrent.progress", Message: "50%"})
+	lines := readLines(t, streamLines(response), 3)
+
+	if lines[0] != "id: 7" || lines[1] != "event: torrent.progress" || !strings.HasPrefix(lines[2], "data: {") {
+		t.Errorf("unexpected SSE message %q", lines)
+	}
+}
+
+func TestStreamSinkClosedOnShutdown(t *testing.T) {
+	stream := NewStreamSink(nil)
+	server := httptest.NewUnstartedServer(stream)
+	server.Config.RegisterOnShutdown(stream.Close)
+	server.Start()
+	defer server.Close()
+
+	response, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	lines := streamLines(response)
+
+	// The connected client doesn't keep the server from shutting down
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := server.Config.Shutdown(ctx); err != nil {
+		t.Fatalf("shutdown error: %v", err)
+	}
+	if _, ok := <-lines; ok {
+		t.Error("expected the stream to be ended")
+	}
+}
+
+func TestStreamSinkInvalidOffset(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	NewStreamSink(nil).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/events?from=abc", nil))
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("expected a bad request, got %d", recorder.Code)
+	}
+}
+
+func TestEventBridgeFromEnv(t *testing.T) {
+	bus := newEventFactory()
+	if stop, err := EventBridgeFromEnv(bus, nil); stop != nil || err != nil {
+		t.Fatalf("expected no bridge without configuration, got %v", err)
+	}
+
+	server, requests := newTestWebhook(t)
+	t.Setenv(WebhookURLEnv, server.URL)
+	t.Setenv(WebhookSecretEnv, "secret")
+	t.Setenv(EventsFilterEnv, "pipeline.failed, job.*")
+	stop, err := EventBridgeFromEnv(bus, nil)
+	if err != nil || stop == nil {
+		t.Fatalf("expected a webhook bridge, got %v", err)
+	}
+
+	bus.Emit(bus.CreateEvent("pipeline.failed"), &EventData{Message: "transcode failed"}, "job-1", "transcode")
+	bus.Emit(bus.CreateEvent("pipeline.done"), &EventData{}, "job-2", "done")
+	bus.Wait()
+	if err := stop(context.Background()); err != nil {
+		t.Fatalf("stop error: %v", err)
+	}
+
+	if sent := requests(); len(sent) != 1 || sent[0].event != "pipeline.failed" || sent[0].signature == "" {
+		t.Errorf("expected the signed failure only, got %+v", sent)
+	}
+}
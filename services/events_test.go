@@ -1,6 +1,7 @@
 package services_test
 
 import (
+	"context"
 	"sync"
 	"testing"
 	"time"
@@ -122,3 +123,305 @@ func TestEmit_ShouldBeAsynchronous(t *testing.T) {
 		t.Errorf("Emit took too long, expected async behavior")
 	}
 }
+
+func TestOn_ShouldRegisterSameHandlerTwice(t *testing.T) {
+	bus := services.EventBus
+	event := bus.CreateEvent("twice:event")
+
+	var mu sync.Mutex
+	calls := 0
+	handler := func(data *services.EventData, args ...string) {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+	}
+
+	first := bus.On(event, handler)
+	bus.On(event, handler)
+	bus.Emit(event, &services.EventData{})
+	bus.Wait()
+	if calls != 2 {
+		t.Errorf("Expected 2 calls for 2 subscriptions, got %d", calls)
+	}
+
+	first.Unsubscribe()
+	bus.Emit(event, &services.EventData{})
+	bus.Wait()
+	if calls != 3 {
+		t.Errorf("Expected only the remaining subscription to be called, got %d calls", calls)
+	}
+}
+
+func TestUnsubscribe_ShouldOnlyRemoveItsClosure(t *testing.T) {
+	bus := services.EventBus
+	event := bus.CreateEvent("unsubscribe:event")
+
+	var mu sync.Mutex
+	received := map[string]bool{}
+	subscribe := func(name string) *services.Subscription {
+		return bus.On(event, func(data *services.EventData, args ...string) {
+			mu.Lock()
+			received[name] = true
+			mu.Unlock()
+		})
+	}
+
+	first := subscribe("first")
+	subscribe("second")
+	first.Unsubscribe()
+	first.Unsubscribe()
+
+	bus.Emit(event, &services.EventData{})
+	bus.Wait()
+
+	if received["first"] || !received["second"] {
+		t.Errorf("Expected only the second closure to be called, got %v", received)
+	}
+}
+
+func TestOnce_ShouldBeCalledOnlyOnce(t *testing.T) {
+	bus := services.EventBus
+	event := bus.CreateEvent("once:event")
+
+	var mu sync.Mutex
+	calls := 0
+	bus.Once(event, func(data *services.EventData, args ...string) {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+	})
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			bus.Emit(event, &services.EventData{})
+		}()
+	}
+	wg.Wait()
+	bus.Wait()
+
+	if calls != 1 {
+		t.Errorf("Expected a single call, got %d", calls)
+	}
+}
+
+func TestOnPattern_ShouldMatchEventNames(t *testing.T) {
+	bus := services.EventBus
+	progress := bus.CreateEvent("wildcard.progress")
+	done := bus.CreateEvent("wildcard.done")
+	other := bus.CreateEvent("other.progress")
+
+	var mu sync.Mutex
+	var received []string
+	sub, err := bus.OnPattern("wildcard.*", func(event *services.Event, data *services.EventData, args ...string) {
+		mu.Lock()
+		received = append(received, event.Name+":"+data.Message)
+		mu.Unlock()
+	})
+	if err != nil {
+		t.Fatalf("Unexpected pattern error: %v", err)
+	}
+
+	bus.Emit(progress, &services.EventData{Message: "50"})
+	bus.Emit(other, &services.EventData{Message: "ignored"})
+	bus.Wait()
+	sub.Unsubscribe()
+	bus.Emit(done, &services.EventData{Message: "after unsubscribe"})
+	bus.Wait()
+
+	if len(received) != 1 || received[0] != "wildcard.progress:50" {
+		t.Errorf("Expected only the matching event, got %v", received)
+	}
+
+	if _, err := bus.OnPattern("wildcard.[", nil); err == nil {
+		t.Errorf("Expected an error for an invalid pattern")
+	}
+}
+
+func TestDeliverSync_ShouldCallHandlersBeforeReturning(t *testing.T) {
+	bus := services.EventBus
+	event := bus.CreateEvent("sync:event")
+	bus.SetDelivery(event, services.DeliveryOptions{Mode: services.DeliverSync})
+
+	var received []string
+	bus.On(event, func(data *services.EventData, args ...string) {
+		received = append(received, data.Message)
+	})
+	bus.Emit(event, &services.EventData{Message: "1"})
+	bus.Emit(event, &services.EventData{Message: "2"})
+
+	if len(received) != 2 || received[0] != "1" || received[1] != "2" {
+		t.Errorf("Expected the emissions to be delivered by Emit, got %v", received)
+	}
+}
+
+func TestDeliverOrdered_ShouldKeepEmissionOrder(t *testing.T) {
+	bus := services.EventBus
+	event := bus.CreateEvent("ordered:event")
+	bus.SetDelivery(event, services.DeliveryOptions{Mode: services.DeliverOrdered, QueueSize: 4})
+
+	var mu sync.Mutex
+	var received []int
+	bus.On(event, func(data *services.EventData, args ...string) {
+		time.Sleep(time.Millisecond)
+		mu.Lock()
+		received = append(received, len(args))
+		mu.Unlock()
+	})
+
+	args := []string{}
+	for range 20 {
+		bus.Emit(event, &services.EventData{}, args...)
+		args = append(args, "x")
+	}
+	bus.Wait()
+
+	if len(received) != 20 {
+		t.Fatalf("Expected every emission with backpressure, got %d", len(received))
+	}
+	for i, n := range received {
+		if n != i {
+			t.Fatalf("Expected the emission order, got %v", received)
+		}
+	}
+}
+
+func TestDeliverDropOldest_ShouldBoundPendingEmissions(t *testing.T) {
+	bus := services.EventBus
+	event := bus.CreateEvent("drop:event")
+	bus.SetDelivery(event, services.DeliveryOptions{Mode: services.DeliverDropOldest, QueueSize: 2})
+
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var received []string
+	bus.On(event, func(data *services.EventData, args ...string) {
+		<-release
+		mu.Lock()
+		received = append(received, data.Message)
+		mu.Unlock()
+	})
+
+	// The first emission is running, the next ones wait in the queue of 2
+	bus.Emit(event, &services.EventData{Message: "0"})
+	time.Sleep(10 * time.Millisecond)
+	for _, message := range []string{"1", "2", "3", "4"} {
+		bus.Emit(event, &services.EventData{Message: message})
+	}
+	close(release)
+	bus.Wait()
+
+	if len(received) != 3 || received[0] != "0" || received[1] != "3" || received[2] != "4" {
+		t.Errorf("Expected the running and the 2 newest emissions, got %v", received)
+	}
+}
+
+func TestDeliverCoalesce_ShouldKeepLatestPerKey(t *testing.T) {
+	bus := services.EventBus
+	event := bus.CreateEvent("coalesce:event")
+	bus.SetDelivery(event, services.DeliveryOptions{Mode: services.DeliverCoalesce})
+
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var received []string
+	bus.On(event, func(data *services.EventData, args ...string) {
+		<-release
+		mu.Lock()
+		received = append(received, args[0]+"="+data.Message)
+		mu.Unlock()
+	})
+
+	bus.Emit(event, &services.EventData{Message: "0"}, "job-1")
+	time.Sleep(10 * time.Millisecond)
+	for _, message := range []string{"10", "20", "30"} {
+		bus.Emit(event, &services.EventData{Message: message}, "job-1")
+		bus.Emit(event, &services.EventData{Message: message}, "job-2")
+	}
+	close(release)
+	bus.Wait()
+
+	expected := []string{"job-1=0", "job-1=30", "job-2=30"}
+	if len(received) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, received)
+	}
+	for i := range expected {
+		if received[i] != expected[i] {
+			t.Errorf("Expected %v, got %v", expected, received)
+		}
+	}
+}
+
+func TestDeliverOrdered_ShouldKeepOrderOfPatternHandlers(t *testing.T) {
+	bus := services.EventBus
+	ordered := bus.CreateEvent("mixed.ordered")
+	coalesced := bus.CreateEvent("mixed.coalesced")
+	bus.SetDelivery(ordered, services.DeliveryOptions{Mode: services.DeliverOrdered, QueueSize: 4})
+	bus.SetDelivery(coalesced, services.DeliveryOptions{Mode: services.DeliverCoalesce})
+
+	var mu sync.Mutex
+	var received []int
+	sub, _ := bus.OnPattern("mixed.*", func(event *services.Event, data *services.EventData, args ...string) {
+		time.Sleep(time.Millisecond)
+		if event != ordered {
+			return
+		}
+		mu.Lock()
+		received = append(received, len(args))
+		mu.Unlock()
+	})
+	defer sub.Unsubscribe()
+
+	// The emissions of the other event must not start a second queue of the ordered one
+	args := []string{}
+	for range 20 {
+		bus.Emit(ordered, &services.EventData{}, args...)
+		bus.Emit(coalesced, &services.EventData{}, "job-1")
+		args = append(args, "x")
+	}
+	bus.Wait()
+
+	if len(received) != 20 {
+		t.Fatalf("Expected every ordered emission, got %d", len(received))
+	}
+	for i, n := range received {
+		if n != i {
+			t.Fatalf("Expected the emission order, got %v", received)
+		}
+	}
+}
+
+func TestEmit_ShouldRecoverHandlerPanics(t *testing.T) {
+	bus := services.EventBus
+	event := bus.CreateEvent("panic:event")
+
+	var mu sync.Mutex
+	var reported services.HandlerError
+	sub := services.HandlerErrorTopic.Subscribe(func(ctx context.Context, e services.HandlerError) {
+		mu.Lock()
+		defer mu.Unlock()
+		if e.Event == "panic:event" {
+			reported = e
+		}
+	})
+	defer sub.Unsubscribe()
+
+	called := false
+	bus.On(event, func(data *services.EventData, args ...string) {
+		panic("boom")
+	})
+	bus.On(event, func(data *services.EventData, args ...string) {
+		mu.Lock()
+		called = true
+		mu.Unlock()
+	})
+	bus.Emit(event, &services.EventData{})
+	bus.Wait()
+
+	if !called {
+		t.Errorf("Expected the other handler to be called")
+	}
+	if reported.Panic != "boom" || reported.Stack == "" {
+		t.Errorf("Expected the panic to be reported, got %+v", reported)
+	}
+}
@@ -1,12 +1,15 @@
 package services
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/xfrr/goffmpeg/transcoder"
 )
@@ -17,6 +20,7 @@ type MediaType int
 const (
 	Audio MediaType = iota
 	Video
+	Subtitle // Subtitle file sent alongside a video
 )
 
 // QualityProfile define the media file quality
@@ -29,18 +33,34 @@ type QualityProfile struct {
 	Resolution   string
 	Preset       string
 	CRF          int    // Constant Rate Factor for the quality
-	MaxSize      string // Max file size
+	MaxSize      string // Max output file size like "50M", bigger outputs are split in parts
+	RateControl  RateControl
+	BufSize      string // Decoder buffer of the constrained CRF, twice the bitrate when empty
+	TargetSize   string // Output size aimed by the two-pass mode like "45M"
 }
 
 // Main media transcription struct
 type MediaOptimizer struct {
-	InputPath  string
-	OutputPath string
-	MediaType  MediaType
-	Profile    QualityProfile
-	transcoder *transcoder.Transcoder
+	InputPath      string
+	OutputPath     string
+	MediaType      MediaType
+	Info           *MediaInfo // Probed input, nil when ffprobe can't read it
+	Profile        QualityProfile
+	StallTimeout   time.Duration // Max duration without any ffmpeg progress, 0 to disable
+	ForceTranscode bool          // Encode the input even when it already fit the profile
+	Remuxed        bool          // The last optimization only copied the input streams
+	Parts          []string      // Parts of the output when it exceeded the profile MaxSize
+	Subtitles      SubtitleOptions
+	SubtitleFiles  []string // Subtitles extracted next to the output
+	burnSubtitle   string   // Temporary subtitle file drawn into the video
+	transcoder     *transcoder.Transcoder
 }
 
+// Default max duration without any ffmpeg progress before killing the process
+var TranscodeStallTimeout = 2 * time.Minute
+
+var ErrTranscodeStalled = errors.New("transcoding stalled")
+
 var (
 	// Audio profile
 	AudioMobileLow = QualityProfile{
@@ -67,6 +87,7 @@ var (
 		Resolution:   "480x360",
 		Preset:       "fast",
 		CRF:          20,
+		RateControl:  RateConstrainedCRF,
 	}
 
 	VideoMobileHigh = QualityProfile{
@@ -78,6 +99,7 @@ var (
 		Resolution:   "720x480",
 		Preset:       "medium",
 		CRF:          23,
+		RateControl:  RateConstrainedCRF,
 	}
 
 	VideoMobileUltra = QualityProfile{
@@ -89,26 +111,44 @@ var (
 		Resolution:   "1280x720",
 		Preset:       "medium",
 		CRF:          20,
+		RateControl:  RateConstrainedCRF,
 	}
 )
 
-// Create a new instance of the media transcription service
+// Create a new instance of the media transcription service.
+// The input is probed to detect its media type from its streams.
 func NewMediaOptimizer(inputPath, outputPath string) (*MediaOptimizer, error) {
 	if !fileExists(inputPath) {
 		return nil, errors.New("not found input file")
 	}
 
+	info, mediaType := inspectMedia(inputPath)
+	return newMediaOptimizer(inputPath, outputPath, info, mediaType)
+}
+
+// Create a media optimizer writing into the output directory, the output
+// extension depend on the probed media type
+func newMediaOptimizerInDir(inputPath, outputDir string) (*MediaOptimizer, error) {
+	if !fileExists(inputPath) {
+		return nil, errors.New("not found input file")
+	}
+
+	info, mediaType := inspectMedia(inputPath)
+	return newMediaOptimizer(inputPath, mediaOutputPath(inputPath, outputDir, mediaType), info, mediaType)
+}
+
+func newMediaOptimizer(inputPath, outputPath string, info *MediaInfo, mediaType MediaType) (*MediaOptimizer, error) {
 	if err := os.MkdirAll(filepath.Dir(outputPath), 0755); err != nil {
 		return nil, fmt.Errorf("can't create output dir: %v", err)
 	}
 
-	mediaType := detectMediaType(inputPath)
-
 	return &MediaOptimizer{
-		InputPath:  inputPath,
-		OutputPath: outputPath,
-		MediaType:  mediaType,
-		transcoder: new(transcoder.Transcoder),
+		InputPath:    inputPath,
+		OutputPath:   outputPath,
+		MediaType:    mediaType,
+		Info:         info,
+		StallTimeout: TranscodeStallTimeout,
+		transcoder:   new(transcoder.Transcoder),
 	}, nil
 }
 
@@ -134,74 +174,114 @@ func (m *MediaOptimizer) SetCustomProfile(name, videoCodec, audioCodec, videoBit
 // Automatic optimization for mobile device depending on the provided quality
 // The quality type can be `low` | `high` or `ultra` for video content
 func (m *MediaOptimizer) OptimizeForMobile(quality string) error {
-	switch m.MediaType {
-	case Audio:
-		switch quality {
-		case "low":
-			m.SetProfile(AudioMobileLow)
-		case "high":
-			m.SetProfile(AudioMobileHigh)
-		default:
-			m.SetProfile(AudioMobileHigh)
-		}
-	case Video:
-		switch quality {
-		case "low":
-			m.SetProfile(VideoMobileLow)
-		case "high":
-			m.SetProfile(VideoMobileHigh)
-		case "ultra":
-			m.SetProfile(VideoMobileUltra)
-		default:
-			m.SetProfile(VideoMobileHigh)
-		}
-	}
+	return m.OptimizeForMobileContext(context.Background(), quality)
+}
 
-	return m.Optimize()
+// Same as OptimizeForMobile but ffmpeg is killed when the context is done
+func (m *MediaOptimizer) OptimizeForMobileContext(ctx context.Context, quality string) error {
+	m.setMobileProfile(quality)
+	return m.OptimizeContext(ctx)
 }
 
-// Run the optimization
-func (m *MediaOptimizer) Optimize() error {
-	err := m.transcoder.Initialize(m.InputPath, m.OutputPath)
-	if err != nil {
-		return fmt.Errorf("transcoder initialization error: %v", err)
+// Select the mobile profile matching the input and the requested quality
+func (m *MediaOptimizer) setMobileProfile(quality string) {
+	m.SetProfile(pickProfile(m.Info, m.MediaType, quality))
+}
+
+// Video profiles from the highest to the lowest resolution
+var videoLadder = []QualityProfile{VideoMobileUltra, VideoMobileHigh, VideoMobileLow}
+
+// Select the mobile profile of the quality adapted to the probed input:
+// a video is never upscaled and an audio never encoded above its source bitrate.
+// The quality profile is used as is without probe.
+func pickProfile(info *MediaInfo, mediaType MediaType, quality string) QualityProfile {
+	profile := mobileProfile(mediaType, quality)
+	if info == nil {
+		return profile
 	}
 
-	if m.transcoder.MediaFile() == nil {
-		return fmt.Errorf("failed to initialize transcoder: media file is nil")
+	if mediaType == Video && info.Height > 0 {
+		for i, lower := range videoLadder {
+			if lower.Name == profile.Name && i+1 < len(videoLadder) && profileHeight(profile) > info.Height {
+				profile = videoLadder[i+1]
+			}
+		}
+		// Even the lowest profile is bigger, the source resolution is kept
+		if profileHeight(profile) > info.Height {
+			profile.Resolution = ""
+		}
 	}
 
-	m.configureTranscoder()
+	if audio := info.StreamsOf(AudioStream); len(audio) > 0 {
+		source := audio[0].BitRate
+		if source == 0 && mediaType == Audio {
+			source = info.BitRate
+		}
+		if kbps := int(source / 1000); kbps > 0 && kbps < parseBitrate(profile.AudioBitrate) {
+			profile.AudioBitrate = fmt.Sprintf("%dk", max(kbps, minAudioBitrate))
+		}
+	}
+	return profile
+}
 
-	done := m.transcoder.Run(true)
+// Height of the profile resolution like "1280x720", 0 when unset
+func profileHeight(profile QualityProfile) int {
+	_, height, _ := strings.Cut(profile.Resolution, "x")
+	value, _ := strconv.Atoi(height)
+	return value
+}
 
-	progress := m.transcoder.Output()
-	if progress != nil {
-		go func() {
-			for p := range progress {
-				fmt.Printf("Progression: %.2f%%\n", p.Progress)
-			}
-		}()
+func mobileProfile(mediaType MediaType, quality string) QualityProfile {
+	if mediaType == Video {
+		switch quality {
+		case "low":
+			return VideoMobileLow
+		case "ultra":
+			return VideoMobileUltra
+		default:
+			return VideoMobileHigh
+		}
 	}
 
-	result := <-done
-	if result == nil {
-		fmt.Printf("Optimization finished successfully: %s -> %s\n", m.InputPath, m.OutputPath)
-		return nil
+	switch quality {
+	case "low":
+		return AudioMobileLow
+	default:
+		return AudioMobileHigh
 	}
+}
 
-	if result.Error() != "" {
-		return fmt.Errorf("transcription error: %v", result.Error())
+// Run the optimization
+func (m *MediaOptimizer) Optimize() error {
+	return m.OptimizeContext(context.Background())
+}
+
+// Run the optimization until the context is done
+func (m *MediaOptimizer) OptimizeContext(ctx context.Context) error {
+	err := m.OptimizeWithCallbackContext(ctx, func(progress float64) {
+		fmt.Printf("Progression: %.2f%%\n", progress)
+	})
+	if err != nil {
+		return err
 	}
 
-	fmt.Printf("Optimization finished: %s -> %s\n", m.InputPath, m.OutputPath)
+	fmt.Printf("Optimization finished successfully: %s -> %s\n", m.InputPath, m.OutputPath)
 	return nil
-
 }
 
 // Running the optimization process with a callback func to take the progress
 func (m *MediaOptimizer) OptimizeWithCallback(progressCallback func(float64)) error {
-	err := m.transcoder.Initialize(m.InputPath, m.OutputPath)
+	return m.OptimizeWithCallbackContext(context.Background(), progressCallback)
+}
+
+// Same as OptimizeWithCallback but ffmpeg is killed when the context is done
+func (m *MediaOptimizer) OptimizeWithCallbackContext(ctx context.Context, progressCallback func(float64)) error {
+	maxSize, err := ParseSize(m.Profile.MaxSize)
+	if err != nil {
+		return err
+	}
+
+	err = m.transcoder.Initialize(m.InputPath, m.OutputPath)
 	if err != nil {
 		return fmt.Errorf("transcoder initialization error: %v", err)
 	}
@@ -210,31 +290,114 @@ func (m *MediaOptimizer) OptimizeWithCallback(progressCallback func(float64)) er
 		return fmt.Errorf("failed to initialize transcoder: media file is nil")
 	}
 
-	m.configureTranscoder()
+	m.SubtitleFiles = nil
+	subtitle, hasSubtitle := m.pickSubtitle()
+	if hasSubtitle && m.Subtitles.Mode == SubtitlesBurn {
+		if m.burnSubtitle, err = m.prepareBurn(ctx, subtitle); err != nil {
+			return err
+		}
+		defer func() {
+			os.Remove(m.burnSubtitle)
+			m.burnSubtitle = ""
+		}()
+	}
+
+	run := func(ctx context.Context, progressCallback func(float64)) error {
+		return m.run(ctx, m.OutputPath, progressCallback)
+	}
+	m.Remuxed = m.canRemux(maxSize)
+	if m.Remuxed {
+		m.configureRemux()
+	} else {
+		if err := m.configureTranscoder(); err != nil {
+			return err
+		}
+		m.applyMaxSize(m.transcoder.MediaFile(), maxSize)
+		if m.MediaType == Video && m.Profile.rateControl() == RateTwoPass {
+			run = m.runTwoPass
+		}
+	}
+	if err := run(ctx, progressCallback); err != nil {
+		return err
+	}
+	if err := m.enforceMaxSize(ctx, maxSize); err != nil {
+		return err
+	}
+
+	if hasSubtitle && m.Subtitles.Mode == SubtitlesExtract {
+		m.extractSubtitle(ctx, subtitle)
+	}
+	return nil
+}
 
+// Start ffmpeg and wait for its exit.
+// The process is killed and its partial output file removed when the context is done
+// or when no progress is reported during the StallTimeout, an empty output is left to the caller.
+func (m *MediaOptimizer) run(ctx context.Context, output string, progressCallback func(float64)) error {
 	done := m.transcoder.Run(true)
 
-	progress := m.transcoder.Output()
-	if progress != nil {
-		go func() {
-			for p := range progress {
-				if progressCallback != nil {
-					progressCallback(p.Progress)
-				}
+	// ffmpeg block when its stderr is not consumed
+	activity := make(chan struct{}, 1)
+	go func() {
+		for p := range m.transcoder.Output() {
+			select {
+			case activity <- struct{}{}:
+			default:
 			}
-		}()
+			if progressCallback != nil {
+				progressCallback(p.Progress)
+			}
+		}
+	}()
+
+	var (
+		timer *time.Timer
+		stall <-chan time.Time
+	)
+	if m.StallTimeout > 0 {
+		timer = time.NewTimer(m.StallTimeout)
+		defer timer.Stop()
+		stall = timer.C
+	}
+
+	for {
+		select {
+		case result := <-done:
+			return transcodeResult(result)
+		case <-activity:
+			if timer != nil {
+				timer.Reset(m.StallTimeout)
+			}
+		case <-stall:
+			m.kill(done, output)
+			return fmt.Errorf("%w after %s without progress", ErrTranscodeStalled, m.StallTimeout)
+		case <-ctx.Done():
+			m.kill(done, output)
+			return ctx.Err()
+		}
 	}
+}
 
-	result := <-done
-	if result.Error() != "" {
+func transcodeResult(result error) error {
+	if result != nil && result.Error() != "" {
 		return fmt.Errorf("transcription error: %v", result.Error())
 	}
-
 	return nil
 }
 
+// Kill the ffmpeg process, wait for its exit and remove the partial output
+func (m *MediaOptimizer) kill(done <-chan error, output string) {
+	if cmd := m.transcoder.Process(); cmd != nil && cmd.Process != nil {
+		cmd.Process.Kill()
+	}
+	<-done
+	if output != "" {
+		os.Remove(output)
+	}
+}
+
 // Configuring the transcoder based on the profile configuration
-func (m *MediaOptimizer) configureTranscoder() {
+func (m *MediaOptimizer) configureTranscoder() error {
 	mediaFile := m.transcoder.MediaFile()
 
 	// Based preset
@@ -247,14 +410,12 @@ func (m *MediaOptimizer) configureTranscoder() {
 		if m.Profile.VideoCodec != "" {
 			mediaFile.SetVideoCodec(m.Profile.VideoCodec)
 		}
-		if m.Profile.VideoBitrate != "" {
-			mediaFile.SetVideoBitRate(m.Profile.VideoBitrate)
-		}
 		if m.Profile.Resolution != "" {
 			mediaFile.SetResolution(m.Profile.Resolution)
 		}
-		if m.Profile.CRF != 0 {
-			mediaFile.SetCRF(uint32(m.Profile.CRF))
+		// Drawn before the scaling so the text is scaled with the video
+		if m.burnSubtitle != "" {
+			mediaFile.SetVideoFilter("subtitles=" + escapeFilterValue(m.burnSubtitle))
 		}
 	}
 
@@ -266,9 +427,17 @@ func (m *MediaOptimizer) configureTranscoder() {
 		mediaFile.SetAudioBitRate(m.Profile.AudioBitrate)
 	}
 
+	// After the audio config, a target size lower the audio bitrate too
+	if m.MediaType == Video {
+		if err := m.configureRateControl(mediaFile); err != nil {
+			return err
+		}
+	}
+
 	// Specific optimization for mobile
 	mediaFile.SetMovFlags("+faststart") // For streaming
 	mediaFile.SetPixFmt("yuv420p")      // Max compatibility
+	return nil
 }
 
 // Get the optimized file size
@@ -300,36 +469,21 @@ func (m *MediaOptimizer) GetCompressionRatio() (float64, error) {
 	return float64(outputSize) / float64(inputInfo.Size()), nil
 }
 
-// Optimizing multiple inputs files
-func BatchOptimize(inputPaths []string, outputDir string, quality string) error {
-	for _, inputPath := range inputPaths {
-		filename := filepath.Base(inputPath)
-		ext := filepath.Ext(filename)
-		nameWithoutExt := strings.TrimSuffix(filename, ext)
-
-		var outputPath string
-		if detectMediaType(inputPath) == Video {
-			outputPath = filepath.Join(outputDir, nameWithoutExt+"_optimized.mp4")
-		} else {
-			outputPath = filepath.Join(outputDir, nameWithoutExt+"_optimized.aac")
-		}
-
-		optimizer, err := NewMediaOptimizer(inputPath, outputPath)
-		if err != nil {
-			fmt.Printf("Optimizer creation error for %s: %v\n", inputPath, err)
-			continue
-		}
+// Build the output path of an optimized file inside the output directory,
+// the media type is guessed from the extension
+func optimizedOutputPath(inputPath, outputDir string) string {
+	return mediaOutputPath(inputPath, outputDir, detectMediaType(inputPath))
+}
 
-		err = optimizer.OptimizeForMobile(quality)
-		if err != nil {
-			fmt.Printf("Optimization error %s: %v\n", inputPath, err)
-			continue
-		}
+func mediaOutputPath(inputPath, outputDir string, mediaType MediaType) string {
+	filename := filepath.Base(inputPath)
+	nameWithoutExt := strings.TrimSuffix(filename, filepath.Ext(filename))
 
-		fmt.Printf("Optimized: %s\n", inputPath)
+	if mediaType == Video {
+		return filepath.Join(outputDir, nameWithoutExt+"_optimized.mp4")
 	}
-
-	return nil
+	// Telegram only play the mp3 and m4a files as audio
+	return filepath.Join(outputDir, nameWithoutExt+"_optimized.m4a")
 }
 
 func fileExists(path string) bool {
@@ -337,19 +491,37 @@ func fileExists(path string) bool {
 	return !os.IsNotExist(err)
 }
 
+var (
+	videoExts = []string{".mp4", ".avi", ".mov", ".mkv", ".webm", ".3gp", ".flv", ".wmv", ".m4v", ".ts"}
+	audioExts = []string{".mp3", ".aac", ".m4a", ".flac", ".wav", ".ogg", ".opus", ".wma"}
+)
+
 func detectMediaType(path string) MediaType {
 	ext := strings.ToLower(filepath.Ext(path))
-	videoExts := []string{".mp4", ".avi", ".mov", ".mkv", ".webm", ".3gp", ".flv", ".wmv"}
 
 	for _, vExt := range videoExts {
 		if ext == vExt {
 			return Video
 		}
 	}
+	if isSubtitleFile(path) {
+		return Subtitle
+	}
 
 	return Audio
 }
 
+// Check if the file extension is a known audio or video one
+func isMediaFile(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	for _, known := range append(videoExts, audioExts...) {
+		if ext == known {
+			return true
+		}
+	}
+	return false
+}
+
 func OptimizeVideoForMobile(inputPath, outputPath, quality string) error {
 	optimizer, err := NewMediaOptimizer(inputPath, outputPath)
 	if err != nil {
@@ -0,0 +1,189 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Topic published for every finished file of a batch
+var BatchFileTopic *Topic[BatchResult]
+
+// Untyped event of BatchFileTopic with the input path, the output path and
+// "done", "failed" or "cancelled" as arguments
+var BatchFileEvent *Event
+
+// Default number of files optimized in parallel by a batch.
+// ffmpeg already use several threads, so half of the CPUs are enough.
+var BatchWorkers = max(1, runtime.NumCPU()/2)
+
+// BatchResult is the outcome of the optimization of one file of a batch
+type BatchResult struct {
+	Input      string
+	Output     string
+	Outputs    []string // Output files, several parts when the output exceeded the max size
+	InputSize  int64
+	OutputSize int64   // Total size of the outputs
+	Ratio      float64 // Output size over input size
+	Duration   time.Duration
+	Remuxed    bool
+	Err        error
+}
+
+func (r BatchResult) String() string {
+	if r.Err != nil {
+		return fmt.Sprintf("%s: %v", r.Input, r.Err)
+	}
+	return fmt.Sprintf("%s -> %s (%.0f%% of the input size in %s)", r.Input, r.Output, r.Ratio*100, r.Duration.Round(time.Second))
+}
+
+// BatchError report the failed files of a batch.
+// It unwraps to every file error so errors.Is see the context cancellation.
+type BatchError struct {
+	Results []BatchResult // Every result of the batch, in input order
+}
+
+func (e *BatchError) Failed() []BatchResult {
+	var failed []BatchResult
+	for _, result := range e.Results {
+		if result.Err != nil {
+			failed = append(failed, result)
+		}
+	}
+	return failed
+}
+
+func (e *BatchError) Error() string {
+	failed := e.Failed()
+	lines := make([]string, len(failed))
+	for i, result := range failed {
+		lines[i] = result.String()
+	}
+	return fmt.Sprintf("%d of %d file(s) failed: %s", len(failed), len(e.Results), strings.Join(lines, "; "))
+}
+
+func (e *BatchError) Unwrap() []error {
+	var errs []error
+	for _, result := range e.Failed() {
+		errs = append(errs, result.Err)
+	}
+	return errs
+}
+
+// Optimizing multiple inputs files
+func BatchOptimize(inputPaths []string, outputDir string, quality string) error {
+	return BatchOptimizeContext(context.Background(), inputPaths, outputDir, quality)
+}
+
+// Same as BatchOptimize but the remaining files are skipped when the context is done
+func BatchOptimizeContext(ctx context.Context, inputPaths []string, outputDir string, quality string) error {
+	_, err := BatchOptimizeResults(ctx, inputPaths, outputDir, quality, BatchWorkers)
+	return err
+}
+
+// Optimize the files with a pool of workers and return the result of every
+// file in input order. A *BatchError is returned when a file failed or was
+// skipped because the context is done.
+func BatchOptimizeResults(ctx context.Context, inputPaths []string, outputDir string, quality string, workers int) ([]BatchResult, error) {
+	return runBatch(ctx, inputPaths, workers, func(ctx context.Context, inputPath string) BatchResult {
+		return optimizeBatchFile(ctx, inputPath, outputDir, quality)
+	})
+}
+
+func runBatch(ctx context.Context, inputPaths []string, workers int, optimize func(context.Context, string) BatchResult) ([]BatchResult, error) {
+	results := make([]BatchResult, len(inputPaths))
+	indexes := make(chan int)
+
+	var wg sync.WaitGroup
+	for range max(1, min(workers, len(inputPaths))) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				result := BatchResult{Input: inputPaths[i], Err: ctx.Err()}
+				if result.Err == nil {
+					result = optimize(ctx, inputPaths[i])
+				}
+				results[i] = result
+				BatchFileTopic.Publish(ctx, result)
+			}
+		}()
+	}
+
+	for i := range inputPaths {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	for _, result := range results {
+		if result.Err != nil {
+			return results, &BatchError{Results: results}
+		}
+	}
+	return results, nil
+}
+
+func optimizeBatchFile(ctx context.Context, inputPath, outputDir, quality string) (result BatchResult) {
+	start := time.Now()
+	result.Input = inputPath
+	defer func() { result.Duration = time.Since(start) }()
+
+	optimizer, err := newMediaOptimizerInDir(inputPath, outputDir)
+	if err != nil {
+		result.Err = fmt.Errorf("optimizer creation error: %v", err)
+		return result
+	}
+	result.Output = optimizer.OutputPath
+
+	// The progress of concurrent files can't be printed
+	optimizer.setMobileProfile(quality)
+	if err := optimizer.OptimizeWithCallbackContext(ctx, nil); err != nil {
+		result.Err = err
+		return result
+	}
+
+	result.Outputs, result.Remuxed = optimizer.Outputs(), optimizer.Remuxed
+	if stat, err := os.Stat(inputPath); err == nil {
+		result.InputSize = stat.Size()
+	}
+	for _, output := range result.Outputs {
+		if stat, err := os.Stat(output); err == nil {
+			result.OutputSize += stat.Size()
+		}
+	}
+	if result.InputSize > 0 {
+		result.Ratio = float64(result.OutputSize) / float64(result.InputSize)
+	}
+	return result
+}
+
+func encodeBatchResult(result BatchResult) (*EventData, []string) {
+	status := "done"
+	if result.Err != nil {
+		status = "failed"
+		if errors.Is(result.Err, context.Canceled) {
+			status = "cancelled"
+		}
+	}
+	return &EventData{Message: result.String()}, []string{result.Input, result.Output, status}
+}
+
+func decodeBatchResult(data *EventData, args []string) (BatchResult, error) {
+	if len(args) != 3 {
+		return BatchResult{}, fmt.Errorf("expected 3 batch file arguments, got %d", len(args))
+	}
+	result := BatchResult{Input: args[0], Output: args[1]}
+	switch args[2] {
+	case "failed":
+		result.Err = errors.New(data.Message)
+	case "cancelled":
+		result.Err = context.Canceled
+	}
+	return result, nil
+}
@@ -0,0 +1,118 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRunBatchConcurrency(t *testing.T) {
+	inputs := []string{"a.mp4", "b.mp4", "c.mp4", "d.mp4", "e.mp4"}
+	var running, peak atomic.Int32
+
+	results, err := runBatch(context.Background(), inputs, 2, func(ctx context.Context, input string) BatchResult {
+		current := running.Add(1)
+		defer running.Add(-1)
+		for {
+			old := peak.Load()
+			if current <= old || peak.CompareAndSwap(old, current) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		return BatchResult{Input: input, Output: input + ".out"}
+	})
+	if err != nil {
+		t.Fatalf("batch error: %v", err)
+	}
+	if peak.Load() != 2 {
+		t.Errorf("expected 2 files processed at once, got %d", peak.Load())
+	}
+	for i, result := range results {
+		if result.Input != inputs[i] || result.Output != inputs[i]+".out" {
+			t.Errorf("expected the results in input order, got %+v at %d", result, i)
+		}
+	}
+}
+
+func TestRunBatchAggregateError(t *testing.T) {
+	inputs := []string{"a.mp4", "broken.mp4", "c.mp4"}
+	results, err := runBatch(context.Background(), inputs, 3, func(ctx context.Context, input string) BatchResult {
+		if input == "broken.mp4" {
+			return BatchResult{Input: input, Err: errors.New("invalid data")}
+		}
+		return BatchResult{Input: input}
+	})
+
+	var batchErr *BatchError
+	if !errors.As(err, &batchErr) {
+		t.Fatalf("expected a batch error, got %v", err)
+	}
+	if failed := batchErr.Failed(); len(failed) != 1 || failed[0].Input != "broken.mp4" {
+		t.Errorf("unexpected failed files: %+v", failed)
+	}
+	if !strings.Contains(err.Error(), "1 of 3 file(s) failed") {
+		t.Errorf("unexpected error message: %v", err)
+	}
+	if len(results) != 3 || results[0].Err != nil || results[2].Err != nil {
+		t.Errorf("expected the other files to succeed, got %+v", results)
+	}
+}
+
+func TestRunBatchCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	inputs := []string{"a.mp4", "b.mp4", "c.mp4"}
+	var calls atomic.Int32
+
+	_, err := runBatch(ctx, inputs, 1, func(ctx context.Context, input string) BatchResult {
+		calls.Add(1)
+		cancel()
+		return BatchResult{Input: input}
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the cancellation in the batch error, got %v", err)
+	}
+	if calls.Load() != 1 {
+		t.Errorf("expected the remaining files skipped, got %d calls", calls.Load())
+	}
+}
+
+func TestRunBatchEmitsEvents(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		statuses = make(map[string]string)
+	)
+	EventBus.On(BatchFileEvent, func(data *EventData, args ...string) {
+		mu.Lock()
+		defer mu.Unlock()
+		if len(args) == 3 && strings.HasPrefix(args[0], "event_") {
+			statuses[args[0]] = args[2]
+		}
+	})
+
+	runBatch(context.Background(), []string{"event_ok.mp4", "event_ko.mp4"}, 2, func(ctx context.Context, input string) BatchResult {
+		if input == "event_ko.mp4" {
+			return BatchResult{Input: input, Err: fmt.Errorf("boom")}
+		}
+		return BatchResult{Input: input}
+	})
+	EventBus.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if statuses["event_ok.mp4"] != "done" || statuses["event_ko.mp4"] != "failed" {
+		t.Errorf("unexpected events: %v", statuses)
+	}
+}
+
+func TestBatchOptimizeMissingFile(t *testing.T) {
+	results, err := BatchOptimizeResults(context.Background(), []string{"/path/not_existed.mp4"}, t.TempDir(), "high", 2)
+	if err == nil || len(results) != 1 || results[0].Err == nil {
+		t.Errorf("expected the missing file reported, got %v %+v", err, results)
+	}
+}
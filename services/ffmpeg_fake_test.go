@@ -0,0 +1,269 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Fake ffmpeg writing FAKE_FFMPEG_SIZE bytes to its output, the last absolute
+// path which is not an input, or FAKE_FFMPEG_PARTS files of FAKE_FFMPEG_PART_SIZE
+// bytes for the segment outputs. The parts of a part are small, and the second
+// part can't be cut again. With FAKE_FFMPEG_HANG it report one progress line then
+// hang after writing its partial output. Every command line is appended to FAKE_FFMPEG_LOG.
+const fakeFFmpeg = `#!/bin/sh
+printf '%s\n' "$*" >> "$FAKE_FFMPEG_LOG"
+case "$1" in -version) echo "ffmpeg version fake"; exit 0 ;; esac
+for arg in "$@"; do
+	case "$arg" in /*) if [ "$prev" = "-i" ]; then in="$arg"; else out="$arg"; fi ;; esac
+	prev="$arg"
+done
+case "$out" in /dev/null) exit 0 ;; esac
+mkdir -p "$(dirname "$out")"
+case "$out" in
+*%03d*)
+	parts=${FAKE_FFMPEG_PARTS:-2} size=${FAKE_FFMPEG_PART_SIZE:-10}
+	case "$in" in
+	*_part002.*) parts=1 size=10 ;;
+	*_part*) parts=2 size=10 ;;
+	esac
+	i=1
+	while [ "$i" -le "$parts" ]; do
+		head -c "$size" /dev/zero > "$(printf "$out" "$i")"
+		i=$((i + 1))
+	done
+	exit 0 ;;
+esac
+head -c "${FAKE_FFMPEG_SIZE:-100}" /dev/zero > "$out"
+if [ -n "$FAKE_FFMPEG_HANG" ]; then
+	echo "frame=1 time=00:00:01.00" >&2
+	exec sleep 30
+fi
+`
+
+// Fake ffprobe describing a 10s 1080p h264/aac video
+const fakeFFprobe = `#!/bin/sh
+case "$*" in *-version*) echo "ffprobe version fake"; exit 0 ;; esac
+cat <<'EOF'
+{
+	"streams": [
+		{"index": 0, "codec_type": "video", "codec_name": "h264", "width": 1920, "height": 1080, "pix_fmt": "yuv420p", "bit_rate": "4000000", "duration": "10.0"},
+		{"index": 1, "codec_type": "audio", "codec_name": "aac", "channels": 2, "bit_rate": "192000", "duration": "10.0"}
+	],
+	"format": {"filename": "input.mp4", "format_name": "mov,mp4,m4a,3gp,3g2,mj2", "duration": "10.000000", "size": "4", "bit_rate": "4192000"}
+}
+EOF
+`
+
+// Put the fake ffmpeg and ffprobe first in the PATH and return the ffmpeg command log
+func useFakeFFmpeg(t *testing.T) string {
+	dir := t.TempDir()
+	for name, script := range map[string]string{"ffmpeg": fakeFFmpeg, "ffprobe": fakeFFprobe} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	commands := filepath.Join(dir, "ffmpeg.log")
+	t.Setenv("FAKE_FFMPEG_LOG", commands)
+	return commands
+}
+
+func newFakeOptimizer(t *testing.T) *MediaOptimizer {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "input.mp4")
+	if err := os.WriteFile(input, []byte("fake"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewMediaOptimizer(input, filepath.Join(dir, "out", "input_optimized.mp4"))
+	if err != nil {
+		t.Fatalf("optimizer creation error: %v", err)
+	}
+	if m.MediaType != Video {
+		t.Fatalf("expected the fake probe to describe a video, got %v", m.MediaType)
+	}
+	m.SetProfile(VideoMobileLow)
+	return m
+}
+
+func readCommands(t *testing.T, commands string) []string {
+	data, err := os.ReadFile(commands)
+	if err != nil {
+		t.Fatalf("ffmpeg log reading error: %v", err)
+	}
+	return strings.Split(strings.TrimSpace(string(data)), "\n")
+}
+
+func TestOptimizeKilledOnCancel(t *testing.T) {
+	useFakeFFmpeg(t)
+	t.Setenv("FAKE_FFMPEG_HANG", "1")
+	m := newFakeOptimizer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := m.OptimizeContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the context error, got %v", err)
+	}
+	if fileExists(m.OutputPath) {
+		t.Error("expected the partial output to be removed")
+	}
+}
+
+func TestOptimizeKilledOnStall(t *testing.T) {
+	useFakeFFmpeg(t)
+	t.Setenv("FAKE_FFMPEG_HANG", "1")
+	m := newFakeOptimizer(t)
+	m.StallTimeout = 100 * time.Millisecond
+
+	if err := m.OptimizeContext(context.Background()); !errors.Is(err, ErrTranscodeStalled) {
+		t.Fatalf("expected ErrTranscodeStalled, got %v", err)
+	}
+	if fileExists(m.OutputPath) {
+		t.Error("expected the partial output to be removed")
+	}
+}
+
+func TestPackageKilledKeepsOutput(t *testing.T) {
+	useFakeFFmpeg(t)
+	t.Setenv("FAKE_FFMPEG_HANG", "1")
+	m := newFakeOptimizer(t)
+	if err := os.WriteFile(m.OutputPath, []byte("optimized"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	packageDir := filepath.Join(t.TempDir(), "hls")
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if _, err := m.PackageContext(ctx, packageDir, DefaultLadder, nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the context error, got %v", err)
+	}
+	if _, err := os.Stat(packageDir); !os.IsNotExist(err) {
+		t.Error("expected the packaging dir to be removed")
+	}
+	if !fileExists(m.OutputPath) {
+		t.Error("expected the optimized output to be kept")
+	}
+}
+
+func TestPackageHLS(t *testing.T) {
+	commands := useFakeFFmpeg(t)
+	m := newFakeOptimizer(t)
+
+	packageDir := filepath.Join(t.TempDir(), "hls")
+	playlist, err := m.PackageContext(context.Background(), packageDir, DefaultLadder, nil)
+	if err != nil {
+		t.Fatalf("packaging error: %v", err)
+	}
+	if playlist != filepath.Join(packageDir, HLSMasterPlaylist) {
+		t.Errorf("unexpected master playlist %s", playlist)
+	}
+	command := readCommands(t, commands)[0]
+	if !strings.Contains(command, "-master_pl_name "+HLSMasterPlaylist) || !strings.Contains(command, "split=3") {
+		t.Errorf("expected a 3 rungs HLS command, got %s", command)
+	}
+}
+
+func TestOptimizeSplitsOversizedOutput(t *testing.T) {
+	useFakeFFmpeg(t)
+	t.Setenv("FAKE_FFMPEG_SIZE", "5000")
+	t.Setenv("FAKE_FFMPEG_PARTS", "3")
+	m := newFakeOptimizer(t)
+	m.Profile.MaxSize = "1K"
+
+	if err := m.OptimizeContext(context.Background()); err != nil {
+		t.Fatalf("optimization error: %v", err)
+	}
+	if len(m.Parts) != 3 || len(m.Outputs()) != 3 {
+		t.Fatalf("expected 3 parts, got %v", m.Parts)
+	}
+	for _, part := range m.Parts {
+		if !fileExists(part) {
+			t.Errorf("missing part %s", part)
+		}
+	}
+	if fileExists(m.OutputPath) {
+		t.Error("expected the oversized output to be replaced by its parts")
+	}
+}
+
+func TestOptimizeTwoPass(t *testing.T) {
+	commands := useFakeFFmpeg(t)
+	m := newFakeOptimizer(t)
+	m.Profile.RateControl = RateTwoPass
+	m.Profile.TargetSize = "1M"
+
+	if err := m.OptimizeContext(context.Background()); err != nil {
+		t.Fatalf("optimization error: %v", err)
+	}
+	lines := readCommands(t, commands)
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 passes, got %q", lines)
+	}
+	if !strings.Contains(lines[0], "-pass 1") || !strings.Contains(lines[0], " "+os.DevNull) {
+		t.Errorf("unexpected first pass %s", lines[0])
+	}
+	if !strings.Contains(lines[1], "-pass 2") || !strings.Contains(lines[1], " "+m.OutputPath) {
+		t.Errorf("unexpected second pass %s", lines[1])
+	}
+
+	// The passlog directory is removed after the encoding
+	fields := strings.Fields(lines[1])
+	for i, field := range fields[:len(fields)-1] {
+		if field == "-passlogfile" {
+			if _, err := os.Stat(filepath.Dir(fields[i+1])); !os.IsNotExist(err) {
+				t.Errorf("expected the passlog dir %s to be removed", filepath.Dir(fields[i+1]))
+			}
+		}
+	}
+	if !fileExists(m.OutputPath) {
+		t.Error("expected the second pass output")
+	}
+}
+
+func TestSplitMediaRefitsOversizedParts(t *testing.T) {
+	commands := useFakeFFmpeg(t)
+	t.Setenv("FAKE_FFMPEG_PARTS", "3")
+	t.Setenv("FAKE_FFMPEG_PART_SIZE", "2000000")
+	dir := t.TempDir()
+	input := filepath.Join(dir, "movie.mp4")
+	if err := os.WriteFile(input, make([]byte, 5000), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every part is oversized: the first and last ones are cut again in 2,
+	// the second one has no closer keyframe and is re-encoded
+	maxSize := int64(1 << 20)
+	parts, err := SplitMediaContext(context.Background(), input, maxSize)
+	if err != nil {
+		t.Fatalf("split error: %v", err)
+	}
+	if len(parts) != 5 {
+		t.Fatalf("expected 5 parts, got %v", parts)
+	}
+	for i, part := range parts {
+		if expected := filepath.Join(dir, fmt.Sprintf("movie_part%03d.mp4", i+1)); part != expected {
+			t.Errorf("part %d is %s, expected %s", i, part, expected)
+		}
+		if stat, err := os.Stat(part); err != nil || stat.Size() > maxSize {
+			t.Errorf("expected part %s under the max size", part)
+		}
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 6 {
+		t.Errorf("expected only the input and its parts, got %d files", len(files))
+	}
+
+	reencoded := 0
+	for _, command := range readCommands(t, commands) {
+		if strings.Contains(command, "-b:v") {
+			reencoded++
+		}
+	}
+	if reencoded != 1 {
+		t.Errorf("expected the second part to be re-encoded once, got %d", reencoded)
+	}
+}
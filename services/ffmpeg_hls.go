@@ -0,0 +1,213 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PackagingFormat of an adaptive streaming output
+type PackagingFormat string
+
+const (
+	PackageHLS  PackagingFormat = "hls"
+	PackageDASH PackagingFormat = "dash"
+)
+
+// Container of the HLS segments
+const (
+	SegmentFMP4 = "fmp4"
+	SegmentTS   = "mpegts"
+)
+
+// Names of the entry point of the packaged outputs
+const (
+	HLSMasterPlaylist = "master.m3u8"
+	DASHManifest      = "manifest.mpd"
+)
+
+// StreamingLadder describe the renditions of an adaptive stream
+type StreamingLadder struct {
+	Rungs           []QualityProfile // Video profiles from the lowest to the highest resolution
+	Format          PackagingFormat
+	SegmentType     string        // SegmentFMP4 or SegmentTS, HLS only
+	SegmentDuration time.Duration // Every rendition get a keyframe at each segment boundary
+}
+
+// Mobile profiles packaged as a HLS stream of fMP4 segments
+var DefaultLadder = StreamingLadder{
+	Rungs:           []QualityProfile{VideoMobileLow, VideoMobileHigh, VideoMobileUltra},
+	Format:          PackageHLS,
+	SegmentType:     SegmentFMP4,
+	SegmentDuration: 6 * time.Second,
+}
+
+// Package the video as an adaptive stream in the output directory and return
+// the path of the master playlist or of the DASH manifest
+func (m *MediaOptimizer) Package(outputDir string, ladder StreamingLadder) (string, error) {
+	return m.PackageContext(context.Background(), outputDir, ladder, nil)
+}
+
+// Same as Package but ffmpeg is killed when the context is done.
+// The output directory must be new or empty, it is removed on failure.
+func (m *MediaOptimizer) PackageContext(ctx context.Context, outputDir string, ladder StreamingLadder, progressCallback func(float64)) (string, error) {
+	if m.MediaType != Video {
+		return "", errors.New("only the videos can be packaged as adaptive streams")
+	}
+	rungs := ladderRungs(ladder, m.Info)
+	if len(rungs) == 0 {
+		return "", errors.New("the streaming ladder has no rung")
+	}
+
+	if entries, err := os.ReadDir(outputDir); err == nil && len(entries) > 0 {
+		return "", fmt.Errorf("the packaging directory %s is not empty", outputDir)
+	}
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return "", fmt.Errorf("can't create the packaging dir: %v", err)
+	}
+
+	args, output := ladderArgs(ladder, rungs, outputDir, m.Info == nil || m.Info.HasAudio())
+	if err := m.transcoder.Initialize(m.InputPath, output); err != nil {
+		os.RemoveAll(outputDir)
+		return "", fmt.Errorf("transcoder initialization error: %v", err)
+	}
+	m.transcoder.MediaFile().SetRawOutputArgs(args)
+
+	// The packaging dir is removed instead of the partial output file
+	if err := m.run(ctx, "", progressCallback); err != nil {
+		os.RemoveAll(outputDir)
+		return "", err
+	}
+
+	if ladder.Format == PackageDASH {
+		return output, nil
+	}
+	return filepath.Join(outputDir, HLSMasterPlaylist), nil
+}
+
+// Keep the rungs not upscaling the input, at least the lowest one is kept
+func ladderRungs(ladder StreamingLadder, info *MediaInfo) []QualityProfile {
+	var rungs []QualityProfile
+	for _, rung := range ladder.Rungs {
+		if info == nil || info.Height == 0 || profileHeight(rung) <= info.Height || len(rungs) == 0 {
+			rungs = append(rungs, rung)
+		}
+	}
+	return rungs
+}
+
+// Build the ffmpeg output arguments encoding every rung from one decoding of
+// the input, and the output path given to ffmpeg
+func ladderArgs(ladder StreamingLadder, rungs []QualityProfile, outputDir string, hasAudio bool) ([]string, string) {
+	segment := ladder.SegmentDuration
+	if segment <= 0 {
+		segment = DefaultLadder.SegmentDuration
+	}
+	seconds := strconv.FormatFloat(segment.Seconds(), 'f', -1, 64)
+
+	// One decoding split and scaled for every rung, the width keep the aspect ratio
+	filters := []string{fmt.Sprintf("[0:v]split=%d", len(rungs))}
+	for i := range rungs {
+		filters[0] += fmt.Sprintf("[v%d]", i)
+	}
+	for i, rung := range rungs {
+		scale := "null"
+		if height := profileHeight(rung); height > 0 {
+			scale = fmt.Sprintf("scale=-2:%d", height)
+		}
+		filters = append(filters, fmt.Sprintf("[v%d]%s[v%dout]", i, scale, i))
+	}
+	args := []string{"-filter_complex", strings.Join(filters, ";")}
+
+	for i, rung := range rungs {
+		index := strconv.Itoa(i)
+		args = append(args, "-map", fmt.Sprintf("[v%dout]", i), "-c:v:"+index, orDefault(rung.VideoCodec, "libx264"))
+		if rate := rung.videoRate(); rate > 0 {
+			args = append(args,
+				"-b:v:"+index, fmt.Sprintf("%dk", rate),
+				"-maxrate:v:"+index, fmt.Sprintf("%dk", rate),
+				"-bufsize:v:"+index, fmt.Sprintf("%dk", rate*2),
+			)
+		}
+		if rung.Preset != "" {
+			args = append(args, "-preset:v:"+index, rung.Preset)
+		}
+	}
+
+	// DASH share one audio adaptation set, HLS pair an audio with every rendition
+	audioRungs := rungs
+	if ladder.Format == PackageDASH {
+		audioRungs = rungs[len(rungs)-1:]
+	}
+	if hasAudio {
+		for i, rung := range audioRungs {
+			index := strconv.Itoa(i)
+			args = append(args, "-map", "0:a:0", "-c:a:"+index, orDefault(rung.AudioCodec, "aac"))
+			if rung.AudioBitrate != "" {
+				args = append(args, "-b:a:"+index, rung.AudioBitrate)
+			}
+		}
+	}
+
+	// Aligned keyframes at every segment boundary let the players switch between renditions
+	args = append(args,
+		"-pix_fmt", "yuv420p",
+		"-force_key_frames", "expr:gte(t,n_forced*"+seconds+")",
+		"-sc_threshold", "0",
+	)
+
+	if ladder.Format == PackageDASH {
+		adaptationSets := "id=0,streams=v"
+		if hasAudio {
+			adaptationSets += " id=1,streams=a"
+		}
+		args = append(args,
+			"-f", "dash",
+			"-seg_duration", seconds,
+			"-use_template", "1",
+			"-use_timeline", "1",
+			"-adaptation_sets", adaptationSets,
+			"-init_seg_name", "init-$RepresentationID$.m4s",
+			"-media_seg_name", "chunk-$RepresentationID$-$Number%05d$.m4s",
+		)
+		return args, filepath.Join(outputDir, DASHManifest)
+	}
+
+	segmentType, segmentExt := SegmentFMP4, ".m4s"
+	if ladder.SegmentType == SegmentTS {
+		segmentType, segmentExt = SegmentTS, ".ts"
+	}
+	streamMap := make([]string, len(rungs))
+	for i := range rungs {
+		streamMap[i] = fmt.Sprintf("v:%d", i)
+		if hasAudio {
+			streamMap[i] += fmt.Sprintf(",a:%d", i)
+		}
+	}
+	args = append(args,
+		"-f", "hls",
+		"-hls_time", seconds,
+		"-hls_playlist_type", "vod",
+		"-hls_flags", "independent_segments",
+		"-hls_segment_type", segmentType,
+		"-hls_segment_filename", filepath.Join(outputDir, "stream_%v", "segment_%05d"+segmentExt),
+		"-master_pl_name", HLSMasterPlaylist,
+		"-var_stream_map", strings.Join(streamMap, " "),
+	)
+	if segmentType == SegmentFMP4 {
+		args = append(args, "-hls_fmp4_init_filename", "init.mp4")
+	}
+	return args, filepath.Join(outputDir, "stream_%v", "playlist.m3u8")
+}
+
+func orDefault(value, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+	return value
+}
@@ -0,0 +1,103 @@
+package services
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLadderRungs(t *testing.T) {
+	if rungs := ladderRungs(DefaultLadder, nil); len(rungs) != 3 {
+		t.Errorf("expected every rung without probe, got %d", len(rungs))
+	}
+
+	sd := &MediaInfo{Height: 480}
+	rungs := ladderRungs(DefaultLadder, sd)
+	if len(rungs) != 2 || rungs[1].Name != VideoMobileHigh.Name {
+		t.Errorf("expected the 720p rung dropped for a 480p input, got %v", rungs)
+	}
+
+	tiny := &MediaInfo{Height: 144}
+	if rungs := ladderRungs(DefaultLadder, tiny); len(rungs) != 1 || rungs[0].Name != VideoMobileLow.Name {
+		t.Errorf("expected the lowest rung kept, got %v", rungs)
+	}
+}
+
+func TestLadderArgsHLS(t *testing.T) {
+	args, output := ladderArgs(DefaultLadder, DefaultLadder.Rungs, "/srv/movie", true)
+	command := strings.Join(args, " ")
+
+	expected := []string{
+		"[0:v]split=3[v0][v1][v2];[v0]scale=-2:360[v0out];[v1]scale=-2:480[v1out];[v2]scale=-2:720[v2out]",
+		"-map [v2out] -c:v:2 libx264 -b:v:2 2000k -maxrate:v:2 2000k -bufsize:v:2 4000k",
+		"-map 0:a:0 -c:a:0 aac -b:a:0 64k",
+		"-force_key_frames expr:gte(t,n_forced*6) -sc_threshold 0",
+		"-f hls -hls_time 6 -hls_playlist_type vod",
+		"-hls_segment_type fmp4",
+		"-hls_segment_filename /srv/movie/stream_%v/segment_%05d.m4s",
+		"-master_pl_name master.m3u8",
+		"-var_stream_map v:0,a:0 v:1,a:1 v:2,a:2",
+		"-hls_fmp4_init_filename init.mp4",
+	}
+	for _, arg := range expected {
+		if !strings.Contains(command, arg) {
+			t.Errorf("expected %q in %q", arg, command)
+		}
+	}
+	if output != "/srv/movie/stream_%v/playlist.m3u8" {
+		t.Errorf("unexpected output %s", output)
+	}
+}
+
+func TestLadderArgsTSWithoutAudio(t *testing.T) {
+	ladder := DefaultLadder
+	ladder.SegmentType = SegmentTS
+	args, _ := ladderArgs(ladder, ladder.Rungs[:2], "/srv/movie", false)
+	command := strings.Join(args, " ")
+
+	if !strings.Contains(command, "-hls_segment_type mpegts") || !strings.Contains(command, "segment_%05d.ts") {
+		t.Errorf("expected TS segments in %q", command)
+	}
+	if !strings.Contains(command, "-var_stream_map v:0 v:1") || strings.Contains(command, "0:a:0") {
+		t.Errorf("expected no audio mapping in %q", command)
+	}
+	if strings.Contains(command, "init.mp4") {
+		t.Errorf("expected no fMP4 init segment in %q", command)
+	}
+}
+
+func TestLadderArgsDASH(t *testing.T) {
+	ladder := DefaultLadder
+	ladder.Format = PackageDASH
+	args, output := ladderArgs(ladder, ladder.Rungs, "/srv/movie", true)
+	command := strings.Join(args, " ")
+
+	if !strings.Contains(command, "-f dash -seg_duration 6") || !strings.Contains(command, "-adaptation_sets id=0,streams=v id=1,streams=a") {
+		t.Errorf("expected the DASH options in %q", command)
+	}
+	// A single audio shared by the video representations
+	if strings.Count(command, "-map 0:a:0") != 1 || !strings.Contains(command, "-b:a:0 128k") {
+		t.Errorf("expected one audio representation in %q", command)
+	}
+	if output != filepath.Join("/srv/movie", DASHManifest) {
+		t.Errorf("unexpected output %s", output)
+	}
+}
+
+func TestPackageErrors(t *testing.T) {
+	audio := &MediaOptimizer{MediaType: Audio}
+	if _, err := audio.Package(t.TempDir(), DefaultLadder); err == nil {
+		t.Error("expected an error for an audio input")
+	}
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "previous.m3u8"), []byte("#EXTM3U"), 0644)
+	video := &MediaOptimizer{MediaType: Video}
+	if _, err := video.Package(dir, DefaultLadder); err == nil {
+		t.Error("expected an error for a non empty directory")
+	}
+	if _, err := video.Package(t.TempDir(), StreamingLadder{}); err == nil {
+		t.Error("expected an error for an empty ladder")
+	}
+}
@@ -1,6 +1,8 @@
 package services
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
@@ -58,7 +60,7 @@ func TestIntegration_OptimizeProfiles(t *testing.T) {
 	audioQualities := []string{"low", "high"}
 	for _, q := range audioQualities {
 		t.Run(fmt.Sprintf("Audio-%s", q), func(t *testing.T) {
-			output := filepath.Join(tempDir, fmt.Sprintf("audio_%s.aac", q))
+			output := filepath.Join(tempDir, fmt.Sprintf("audio_%s.m4a", q))
 			optimizer, err := NewMediaOptimizer(audioInput, output)
 			if err != nil {
 				t.Fatalf("Failed to init optimizer: %v", err)
@@ -106,3 +108,165 @@ func getMediaInfo(path string) (string, error) {
 	out, err := cmd.CombinedOutput()
 	return string(out), err
 }
+
+func TestIntegration_OptimizeContextCancelled(t *testing.T) {
+	requireFFmpeg(t)
+
+	output := filepath.Join(t.TempDir(), "cancelled.mp4")
+	optimizer, err := NewMediaOptimizer(filepath.Join("testdata", "sample.mp4"), output)
+	if err != nil {
+		t.Fatalf("optimizer creation error: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := optimizer.OptimizeForMobileContext(ctx, "high"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the context error, got %v", err)
+	}
+	if fileExists(output) {
+		t.Error("expected the partial output to be removed")
+	}
+}
+
+func TestIntegration_SplitMedia(t *testing.T) {
+	requireFFmpeg(t)
+
+	input := filepath.Join("testdata", "sample.mp4")
+	stat, err := os.Stat(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "sample.mp4")
+	data, _ := os.ReadFile(input)
+	os.WriteFile(path, data, 0644)
+
+	maxSize := stat.Size()/2 + stat.Size()/10
+	parts, err := SplitMedia(path, maxSize)
+	if err != nil {
+		t.Skipf("sample can't be split under %d bytes: %v", maxSize, err)
+	}
+	if len(parts) < 2 {
+		t.Fatalf("expected several parts, got %v", parts)
+	}
+	for _, part := range parts {
+		info, err := os.Stat(part)
+		if err != nil || info.Size() > maxSize {
+			t.Errorf("part %s exceeds %d bytes", part, maxSize)
+		}
+	}
+}
+
+func TestIntegration_TwoPass(t *testing.T) {
+	requireFFmpeg(t)
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+
+	output := filepath.Join(t.TempDir(), "two_pass.mp4")
+	optimizer, err := NewMediaOptimizer(filepath.Join("testdata", "sample.mp4"), output)
+	if err != nil {
+		t.Fatalf("optimizer creation error: %v", err)
+	}
+	profile := VideoMobileLow
+	profile.RateControl = RateTwoPass
+	optimizer.SetProfile(profile)
+
+	var last float64
+	if err := optimizer.OptimizeWithCallback(func(progress float64) { last = progress }); err != nil {
+		t.Fatalf("two-pass error: %v", err)
+	}
+	if !fileExists(output) {
+		t.Fatal("expected the output file")
+	}
+	if last > 100 {
+		t.Errorf("expected the progress of both passes under 100%%, got %.2f", last)
+	}
+	if passlogs, _ := filepath.Glob(filepath.Join(tmp, "ghostify-passlog-*")); len(passlogs) != 0 {
+		t.Errorf("expected the passlogs removed, got %v", passlogs)
+	}
+}
+
+func TestIntegration_Remux(t *testing.T) {
+	requireFFmpeg(t)
+
+	output := filepath.Join(t.TempDir(), "remuxed.mp4")
+	optimizer, err := NewMediaOptimizer(filepath.Join("testdata", "sample.mp4"), output)
+	if err != nil {
+		t.Fatalf("optimizer creation error: %v", err)
+	}
+	// Any h264/aac input fit an uncapped profile
+	optimizer.SetProfile(QualityProfile{Name: "copy", VideoCodec: "libx264", AudioCodec: "aac", CRF: 23})
+
+	if err := optimizer.OptimizeWithCallback(nil); err != nil {
+		t.Fatalf("remux error: %v", err)
+	}
+	info, err := ProbeMedia(output)
+	if err != nil {
+		t.Fatalf("probe error: %v", err)
+	}
+	if optimizer.Info != nil && optimizer.Info.HasAudio() && !optimizer.Remuxed {
+		t.Errorf("expected the h264/aac sample to be remuxed")
+	}
+	if !info.HasVideo() {
+		t.Error("expected a video output")
+	}
+}
+
+func TestIntegration_PackageHLS(t *testing.T) {
+	requireFFmpeg(t)
+
+	optimizer, err := NewMediaOptimizer(filepath.Join("testdata", "sample.mp4"), filepath.Join(t.TempDir(), "unused.mp4"))
+	if err != nil {
+		t.Fatalf("optimizer creation error: %v", err)
+	}
+	master, err := optimizer.Package(filepath.Join(t.TempDir(), "hls"), DefaultLadder)
+	if err != nil {
+		t.Fatalf("packaging error: %v", err)
+	}
+	data, err := os.ReadFile(master)
+	if err != nil {
+		t.Fatalf("master playlist error: %v", err)
+	}
+	if !strings.Contains(string(data), "#EXT-X-STREAM-INF") {
+		t.Errorf("expected the renditions in the master playlist:\n%s", data)
+	}
+}
+
+func TestIntegration_BurnSubtitle(t *testing.T) {
+	requireFFmpeg(t)
+
+	dir := t.TempDir()
+	input := filepath.Join(dir, "sample.mp4")
+	data, err := os.ReadFile(filepath.Join("testdata", "sample.mp4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(input, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	subtitle := "1\n00:00:00,000 --> 00:00:05,000\nGhostify\n"
+	if err := os.WriteFile(filepath.Join(dir, "sample.en.srt"), []byte(subtitle), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	optimizer, err := NewMediaOptimizer(input, filepath.Join(dir, "sample_optimized.mp4"))
+	if err != nil {
+		t.Fatalf("optimizer creation error: %v", err)
+	}
+	optimizer.setMobileProfile("low")
+	optimizer.Subtitles = SubtitleOptions{Mode: SubtitlesBurn, Languages: []string{"en"}}
+	if err := optimizer.OptimizeWithCallback(nil); err != nil {
+		t.Fatalf("burn error: %v", err)
+	}
+	if optimizer.Remuxed {
+		t.Error("a burned subtitle require an encoding")
+	}
+
+	optimizer.Subtitles.Mode = SubtitlesExtract
+	optimizer.Subtitles.Format = "vtt"
+	if err := optimizer.OptimizeWithCallback(nil); err != nil {
+		t.Fatalf("extract error: %v", err)
+	}
+	if len(optimizer.SubtitleFiles) != 1 || filepath.Base(optimizer.SubtitleFiles[0]) != "sample_optimized.eng.vtt" {
+		t.Errorf("expected the extracted WebVTT file, got %v", optimizer.SubtitleFiles)
+	}
+}
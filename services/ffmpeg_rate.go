@@ -0,0 +1,149 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/xfrr/goffmpeg/media"
+)
+
+// RateControl select how the video encoder spend the bits
+type RateControl string
+
+const (
+	// Constant quality from QualityProfile.CRF, the size depend on the content
+	RateCRF RateControl = "crf"
+	// Constant quality capped at VideoBitrate with a BufSize buffer
+	RateConstrainedCRF RateControl = "constrained_crf"
+	// Single pass average bitrate of VideoBitrate
+	RateABR RateControl = "abr"
+	// Two passes average bitrate of VideoBitrate, or reaching TargetSize when set.
+	// Streamed inputs can't be read twice and are encoded in a single pass.
+	RateTwoPass RateControl = "two_pass"
+)
+
+// Get the rate control of the profile.
+// Without explicit mode the CRF is capped by the bitrate when both are set.
+func (p QualityProfile) rateControl() RateControl {
+	if p.RateControl != "" {
+		return p.RateControl
+	}
+	switch {
+	case p.CRF != 0 && p.VideoBitrate != "":
+		return RateConstrainedCRF
+	case p.CRF != 0:
+		return RateCRF
+	default:
+		return RateABR
+	}
+}
+
+// Get the video bitrate the encoder aim or is capped at (kbit/s), 0 for uncapped CRF
+func (p QualityProfile) videoRate() int {
+	if p.rateControl() == RateCRF {
+		return 0
+	}
+	return parseBitrate(p.VideoBitrate)
+}
+
+// Set the video codec options of the profile rate control mode
+func (m *MediaOptimizer) configureRateControl(mediaFile *media.File) error {
+	switch mode := m.Profile.rateControl(); mode {
+	case RateCRF:
+		mediaFile.SetCRF(uint32(m.Profile.CRF))
+	case RateConstrainedCRF:
+		mediaFile.SetCRF(uint32(m.Profile.CRF))
+		m.capVideoRate(mediaFile, m.Profile.videoRate())
+	case RateABR, RateTwoPass:
+		bitrate := m.Profile.videoRate()
+		if mode == RateTwoPass && m.Profile.TargetSize != "" {
+			targetSize, err := ParseSize(m.Profile.TargetSize)
+			if err != nil {
+				return err
+			}
+			// Every bit left by the audio is spent on the video
+			audioBitrate := parseBitrate(m.Profile.AudioBitrate)
+			video, audio, ok := fitBitrates(targetSize, m.duration(mediaFile), Video, 0, audioBitrate)
+			if ok && m.duration(mediaFile) > 0 {
+				bitrate = video
+				if audio != audioBitrate {
+					mediaFile.SetAudioBitRate(fmt.Sprintf("%dk", audio))
+				}
+			}
+		}
+		if bitrate == 0 {
+			return fmt.Errorf("the %s rate control need a video bitrate", mode)
+		}
+		mediaFile.SetVideoBitRate(fmt.Sprintf("%dk", bitrate))
+	default:
+		return fmt.Errorf("unknown rate control %q", mode)
+	}
+	return nil
+}
+
+// Cap the video bitrate with a decoder buffer of BufSize, twice the rate by default
+func (m *MediaOptimizer) capVideoRate(mediaFile *media.File, rate int) {
+	if rate <= 0 {
+		return
+	}
+	bufSize := parseBitrate(m.Profile.BufSize)
+	if bufSize == 0 {
+		bufSize = rate * 2
+	}
+	mediaFile.SetVideoMaxBitrate(rate)
+	mediaFile.SetBufferSize(bufSize)
+}
+
+// Input duration probed by the transcoder initialization, 0 for streams
+func (m *MediaOptimizer) duration(mediaFile *media.File) time.Duration {
+	return parseSeconds(mediaFile.Metadata().Format.Duration)
+}
+
+// Run the first pass analysing the input into a temporary passlog, then
+// the encoding pass. The passlog files are removed in every case.
+func (m *MediaOptimizer) runTwoPass(ctx context.Context, progressCallback func(float64)) error {
+	passlogDir, err := os.MkdirTemp("", "ghostify-passlog-*")
+	if err != nil {
+		return fmt.Errorf("passlog creation error: %v", err)
+	}
+	defer os.RemoveAll(passlogDir)
+	passlog := filepath.Join(passlogDir, "ffmpeg2pass")
+
+	mediaFile := m.transcoder.MediaFile()
+	rawOutputArgs := mediaFile.RawOutputArgs()
+	withArgs := func(args ...string) []string {
+		return append(append([]string{}, rawOutputArgs...), args...)
+	}
+	defer func() {
+		mediaFile.SetRawOutputArgs(rawOutputArgs)
+		mediaFile.SetOutputPath(m.OutputPath)
+		mediaFile.SetSkipAudio(false)
+	}()
+
+	// The first pass only write the passlog, its output is discarded
+	mediaFile.SetRawOutputArgs(withArgs("-pass", "1", "-passlogfile", passlog, "-f", "null"))
+	mediaFile.SetOutputPath(os.DevNull)
+	mediaFile.SetSkipAudio(true)
+	err = m.run(ctx, m.OutputPath, passProgress(progressCallback, 0))
+	if err != nil {
+		return fmt.Errorf("first pass error: %w", err)
+	}
+
+	mediaFile.SetRawOutputArgs(withArgs("-pass", "2", "-passlogfile", passlog))
+	mediaFile.SetOutputPath(m.OutputPath)
+	mediaFile.SetSkipAudio(false)
+	return m.run(ctx, m.OutputPath, passProgress(progressCallback, 1))
+}
+
+// Report the progress of one of the two passes as a share of the whole encoding
+func passProgress(progressCallback func(float64), pass int) func(float64) {
+	if progressCallback == nil {
+		return nil
+	}
+	return func(progress float64) {
+		progressCallback((float64(pass)*100 + progress) / 2)
+	}
+}
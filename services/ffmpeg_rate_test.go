@@ -0,0 +1,135 @@
+package services
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/xfrr/goffmpeg/media"
+)
+
+// Build a media file with the probed duration of the input
+func newTestMediaFile(duration string) *media.File {
+	mediaFile := new(media.File)
+	mediaFile.SetMetadata(media.Metadata{Format: media.Format{Duration: duration}})
+	return mediaFile
+}
+
+func TestRateControlInference(t *testing.T) {
+	tests := []struct {
+		profile  QualityProfile
+		expected RateControl
+	}{
+		{QualityProfile{CRF: 23, VideoBitrate: "1000k"}, RateConstrainedCRF},
+		{QualityProfile{CRF: 23}, RateCRF},
+		{QualityProfile{VideoBitrate: "1000k"}, RateABR},
+		{QualityProfile{CRF: 23, VideoBitrate: "1000k", RateControl: RateTwoPass}, RateTwoPass},
+	}
+	for _, tt := range tests {
+		if mode := tt.profile.rateControl(); mode != tt.expected {
+			t.Errorf("rate control of %+v = %s, expected %s", tt.profile, mode, tt.expected)
+		}
+	}
+}
+
+func TestConfigureRateControl(t *testing.T) {
+	tests := []struct {
+		name      string
+		profile   QualityProfile
+		expected  []string
+		forbidden []string
+	}{
+		{
+			name:      "crf",
+			profile:   QualityProfile{RateControl: RateCRF, CRF: 23, VideoBitrate: "1000k"},
+			expected:  []string{"-crf 23"},
+			forbidden: []string{"-b:v", "-maxrate"},
+		},
+		{
+			name:     "constrained crf",
+			profile:  QualityProfile{RateControl: RateConstrainedCRF, CRF: 23, VideoBitrate: "1000k"},
+			expected: []string{"-crf 23", "-maxrate 1000k", "-bufsize 2000k"},
+		},
+		{
+			name:     "constrained crf with buffer",
+			profile:  QualityProfile{RateControl: RateConstrainedCRF, CRF: 23, VideoBitrate: "1000k", BufSize: "1500k"},
+			expected: []string{"-maxrate 1000k", "-bufsize 1500k"},
+		},
+		{
+			name:      "abr",
+			profile:   QualityProfile{RateControl: RateABR, CRF: 23, VideoBitrate: "1000k"},
+			expected:  []string{"-b:v 1000k"},
+			forbidden: []string{"-crf"},
+		},
+		{
+			name:      "two pass target size",
+			profile:   QualityProfile{RateControl: RateTwoPass, AudioBitrate: "128k", TargetSize: "10M"},
+			expected:  []string{"-b:v 465k", "-b:a 66k"},
+			forbidden: []string{"-crf"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &MediaOptimizer{MediaType: Video, Profile: tt.profile}
+			mediaFile := newTestMediaFile("150.0")
+			if err := m.configureRateControl(mediaFile); err != nil {
+				t.Fatalf("configuration error: %v", err)
+			}
+			command := strings.Join(mediaFile.ToStrCommand(), " ")
+			for _, arg := range tt.expected {
+				if !strings.Contains(command, arg) {
+					t.Errorf("expected %q in %q", arg, command)
+				}
+			}
+			for _, arg := range tt.forbidden {
+				if strings.Contains(command, arg) {
+					t.Errorf("unexpected %q in %q", arg, command)
+				}
+			}
+		})
+	}
+}
+
+func TestConfigureRateControlErrors(t *testing.T) {
+	profiles := []QualityProfile{
+		{RateControl: RateABR},
+		{RateControl: "vbr", VideoBitrate: "1000k"},
+		{RateControl: RateTwoPass, TargetSize: "lots"},
+	}
+	for _, profile := range profiles {
+		m := &MediaOptimizer{MediaType: Video, Profile: profile}
+		if err := m.configureRateControl(newTestMediaFile("60")); err == nil {
+			t.Errorf("expected an error for %+v", profile)
+		}
+	}
+}
+
+func TestApplyMaxSizeCapsCRF(t *testing.T) {
+	m := &MediaOptimizer{MediaType: Video, Profile: QualityProfile{RateControl: RateCRF, CRF: 20, AudioBitrate: "128k"}}
+	mediaFile := newTestMediaFile("3600")
+	m.configureRateControl(mediaFile)
+	m.applyMaxSize(mediaFile, 500<<20)
+
+	command := strings.Join(mediaFile.ToStrCommand(), " ")
+	if !strings.Contains(command, "-crf 20") || !strings.Contains(command, "-maxrate") {
+		t.Errorf("expected the CRF capped by a max rate, got %q", command)
+	}
+	if strings.Contains(command, "-b:v") {
+		t.Errorf("expected no average bitrate, got %q", command)
+	}
+}
+
+func TestPassProgress(t *testing.T) {
+	var reported []float64
+	callback := func(progress float64) { reported = append(reported, progress) }
+
+	passProgress(callback, 0)(50)
+	passProgress(callback, 1)(50)
+	passProgress(callback, 1)(100)
+	if len(reported) != 3 || reported[0] != 25 || reported[1] != 75 || reported[2] != 100 {
+		t.Errorf("unexpected progress %v", reported)
+	}
+	if passProgress(nil, 0) != nil {
+		t.Error("expected no callback without callback")
+	}
+}
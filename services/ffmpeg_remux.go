@@ -0,0 +1,100 @@
+package services
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Codec produced by the ffmpeg encoders of the profiles
+var encoderCodecs = map[string]string{
+	"libx264":    "h264",
+	"libx265":    "hevc",
+	"libvpx-vp9": "vp9",
+	"libfdk_aac": "aac",
+	"libmp3lame": "mp3",
+	"libopus":    "opus",
+}
+
+// Get the codec name reported by ffprobe for the output of an encoder
+func encoderCodec(encoder string) string {
+	if codec, ok := encoderCodecs[encoder]; ok {
+		return codec
+	}
+	return encoder
+}
+
+// Check if the probed input already match the profile codecs, resolution and
+// bitrates so its streams can be copied instead of encoded again
+func (m *MediaOptimizer) canRemux(maxSize int64) bool {
+	if m.ForceTranscode || m.Info == nil || m.Profile.TargetSize != "" || m.burnSubtitle != "" {
+		return false
+	}
+	if maxSize > 0 {
+		if stat, err := os.Stat(m.InputPath); err != nil || stat.Size() > maxSize {
+			return false
+		}
+	}
+
+	audio := m.Info.StreamsOf(AudioStream)
+	if len(audio) == 0 || !m.audioFits(audio[0]) {
+		return false
+	}
+	if m.MediaType == Audio {
+		return true
+	}
+
+	video := m.Info.StreamsOf(VideoStream)
+	return len(video) > 0 && m.videoFits(video[0], audio[0])
+}
+
+func (m *MediaOptimizer) audioFits(stream StreamInfo) bool {
+	if m.Profile.AudioCodec != "" && stream.Codec != encoderCodec(m.Profile.AudioCodec) {
+		return false
+	}
+	// An unknown audio bitrate is small enough to not matter
+	maxRate := int64(parseBitrate(m.Profile.AudioBitrate)) * 1000
+	return maxRate == 0 || stream.BitRate == 0 || stream.BitRate <= maxRate
+}
+
+func (m *MediaOptimizer) videoFits(stream, audio StreamInfo) bool {
+	if m.Profile.VideoCodec != "" && stream.Codec != encoderCodec(m.Profile.VideoCodec) {
+		return false
+	}
+	// The mobile players only decode 8 bits 4:2:0
+	if stream.PixFmt != "" && stream.PixFmt != "yuv420p" {
+		return false
+	}
+
+	if width, height, ok := strings.Cut(m.Profile.Resolution, "x"); ok {
+		maxWidth, _ := strconv.Atoi(width)
+		maxHeight, _ := strconv.Atoi(height)
+		if stream.Width > maxWidth || stream.Height > maxHeight {
+			return false
+		}
+	}
+
+	maxRate := int64(m.Profile.videoRate()) * 1000
+	if maxRate == 0 {
+		return true
+	}
+	// The containers like mkv only report the overall bitrate
+	bitrate := stream.BitRate
+	if bitrate == 0 && m.Info.BitRate > 0 {
+		bitrate = m.Info.BitRate - audio.BitRate
+	}
+	return bitrate > 0 && bitrate <= maxRate
+}
+
+// Copy the streams into the output container, the subtitles and data streams are dropped
+func (m *MediaOptimizer) configureRemux() {
+	mediaFile := m.transcoder.MediaFile()
+	mediaFile.SetAudioCodec("copy")
+	mediaFile.SetRawOutputArgs([]string{"-sn", "-dn"})
+	mediaFile.SetMovFlags("+faststart") // For streaming
+	if m.MediaType == Video {
+		mediaFile.SetVideoCodec("copy")
+	} else {
+		mediaFile.SetSkipVideo(true) // Cover art
+	}
+}
@@ -0,0 +1,103 @@
+package services
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/xfrr/goffmpeg/media"
+	"github.com/xfrr/goffmpeg/transcoder"
+)
+
+// Build an optimizer of a small input file described by the probe info
+func newRemuxTestOptimizer(t *testing.T, mediaType MediaType, info *MediaInfo, profile QualityProfile) *MediaOptimizer {
+	input := filepath.Join(t.TempDir(), "input.mkv")
+	if err := os.WriteFile(input, []byte("media"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return &MediaOptimizer{InputPath: input, MediaType: mediaType, Info: info, Profile: profile}
+}
+
+func h264Info(width, height int, videoBitrate int64) *MediaInfo {
+	return &MediaInfo{Streams: []StreamInfo{
+		{Type: VideoStream, Codec: "h264", PixFmt: "yuv420p", Width: width, Height: height, BitRate: videoBitrate},
+		{Type: AudioStream, Codec: "aac", BitRate: 96000},
+		{Type: SubtitleStream, Codec: "subrip"},
+	}}
+}
+
+func TestCanRemux(t *testing.T) {
+	tests := []struct {
+		name      string
+		mediaType MediaType
+		info      *MediaInfo
+		profile   QualityProfile
+		expected  bool
+	}{
+		{"fitting h264/aac", Video, h264Info(720, 480, 900000), VideoMobileHigh, true},
+		{"bitrate too high", Video, h264Info(720, 480, 3000000), VideoMobileHigh, false},
+		{"resolution too high", Video, h264Info(1920, 1080, 900000), VideoMobileHigh, false},
+		{"overall bitrate of mkv", Video, &MediaInfo{BitRate: 1000000, Streams: []StreamInfo{
+			{Type: VideoStream, Codec: "h264", Width: 720, Height: 480},
+			{Type: AudioStream, Codec: "aac", BitRate: 128000},
+		}}, VideoMobileHigh, true},
+		{"unknown video bitrate", Video, &MediaInfo{Streams: []StreamInfo{
+			{Type: VideoStream, Codec: "h264", Width: 720, Height: 480},
+			{Type: AudioStream, Codec: "aac"},
+		}}, VideoMobileHigh, false},
+		{"hevc", Video, &MediaInfo{Streams: []StreamInfo{
+			{Type: VideoStream, Codec: "hevc", Width: 720, Height: 480, BitRate: 500000},
+			{Type: AudioStream, Codec: "aac"},
+		}}, VideoMobileHigh, false},
+		{"10 bits", Video, &MediaInfo{Streams: []StreamInfo{
+			{Type: VideoStream, Codec: "h264", PixFmt: "yuv420p10le", Width: 720, Height: 480, BitRate: 500000},
+			{Type: AudioStream, Codec: "aac"},
+		}}, VideoMobileHigh, false},
+		{"ac3 audio", Video, &MediaInfo{Streams: []StreamInfo{
+			{Type: VideoStream, Codec: "h264", Width: 720, Height: 480, BitRate: 500000},
+			{Type: AudioStream, Codec: "ac3"},
+		}}, VideoMobileHigh, false},
+		{"uncapped crf", Video, h264Info(720, 480, 8000000), QualityProfile{VideoCodec: "libx264", AudioCodec: "aac", CRF: 23}, true},
+		{"aac audio", Audio, &MediaInfo{Streams: []StreamInfo{{Type: AudioStream, Codec: "aac", BitRate: 96000}}}, AudioMobileHigh, true},
+		{"mp3 audio", Audio, &MediaInfo{Streams: []StreamInfo{{Type: AudioStream, Codec: "mp3", BitRate: 96000}}}, AudioMobileHigh, false},
+		{"target size", Video, h264Info(720, 480, 900000), QualityProfile{VideoCodec: "libx264", TargetSize: "10M"}, false},
+		{"not probed", Video, nil, VideoMobileHigh, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newRemuxTestOptimizer(t, tt.mediaType, tt.info, tt.profile)
+			if got := m.canRemux(0); got != tt.expected {
+				t.Errorf("canRemux() = %v, expected %v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestCanRemuxLimits(t *testing.T) {
+	m := newRemuxTestOptimizer(t, Video, h264Info(720, 480, 900000), VideoMobileHigh)
+	if m.canRemux(2) {
+		t.Error("expected an input over the max size to be transcoded")
+	}
+	m.ForceTranscode = true
+	if m.canRemux(0) {
+		t.Error("expected ForceTranscode to disable the remux")
+	}
+}
+
+func TestConfigureRemux(t *testing.T) {
+	m := &MediaOptimizer{MediaType: Video, transcoder: new(transcoder.Transcoder)}
+	m.transcoder.SetMediaFile(new(media.File))
+	m.configureRemux()
+
+	command := strings.Join(m.transcoder.MediaFile().ToStrCommand(), " ")
+	for _, arg := range []string{"-c:v copy", "-c:a copy", "-movflags +faststart", "-sn -dn"} {
+		if !strings.Contains(command, arg) {
+			t.Errorf("expected %q in %q", arg, command)
+		}
+	}
+	if strings.Contains(command, "-pix_fmt") || strings.Contains(command, "-preset") {
+		t.Errorf("expected no encoding option, got %q", command)
+	}
+}
@@ -0,0 +1,334 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xfrr/goffmpeg/media"
+)
+
+// Upload limits of the Telegram bots, usable as QualityProfile.MaxSize
+const (
+	TelegramMaxUploadSize    = "50M"
+	LocalBotAPIMaxUploadSize = "2000M" // With a local Bot API server
+)
+
+// Share of the max size kept for the container overhead and the encoder inaccuracy
+const sizeMargin = 0.95
+
+// Lowest bitrates worth encoding, shorter parts are produced instead (kbit/s)
+const (
+	minVideoBitrate = 150
+	minAudioBitrate = 32
+)
+
+// Parse a size like "50M", "2G", "512K" or a number of bytes.
+// The units are binary, "50M" is 50 MiB (52428800 bytes) like the Telegram
+// limits, and an empty size is 0, meaning no limit.
+func ParseSize(size string) (int64, error) {
+	value := strings.ToUpper(strings.TrimSpace(size))
+	value = strings.TrimSuffix(strings.TrimSuffix(value, "B"), "I")
+	if value == "" {
+		return 0, nil
+	}
+
+	multiplier := int64(1)
+	switch value[len(value)-1] {
+	case 'K':
+		multiplier = 1 << 10
+	case 'M':
+		multiplier = 1 << 20
+	case 'G':
+		multiplier = 1 << 30
+	}
+	if multiplier > 1 {
+		value = value[:len(value)-1]
+	}
+
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil || number < 0 {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+	return int64(number * float64(multiplier)), nil
+}
+
+// Parse a bitrate like "500k" or "2M" in kbit/s, 0 when empty or invalid
+func parseBitrate(bitrate string) int {
+	value := strings.ToLower(strings.TrimSpace(bitrate))
+	multiplier := 0.001
+	switch {
+	case strings.HasSuffix(value, "k"):
+		multiplier, value = 1, strings.TrimSuffix(value, "k")
+	case strings.HasSuffix(value, "m"):
+		multiplier, value = 1000, strings.TrimSuffix(value, "m")
+	}
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0
+	}
+	return int(number * multiplier)
+}
+
+// Compute the video and audio bitrates (kbit/s) keeping a media of the duration under maxSize.
+// The profile bitrates are kept when they already fit, ok is false when the
+// media can't fit at a watchable bitrate and must be split instead.
+func fitBitrates(maxSize int64, duration time.Duration, mediaType MediaType, videoBitrate, audioBitrate int) (video, audio int, ok bool) {
+	if maxSize <= 0 || duration <= 0 {
+		return videoBitrate, audioBitrate, true
+	}
+	budget := int(float64(maxSize) * 8 * sizeMargin / duration.Seconds() / 1000)
+
+	if audioBitrate == 0 {
+		audioBitrate = 128
+	}
+	if mediaType == Audio {
+		if budget < minAudioBitrate {
+			return videoBitrate, audioBitrate, false
+		}
+		return 0, min(audioBitrate, budget), true
+	}
+
+	// The video get what the audio leave
+	audio = min(audioBitrate, max(minAudioBitrate, budget/8))
+	video = budget - audio
+	if video < minVideoBitrate {
+		return videoBitrate, audioBitrate, false
+	}
+	if videoBitrate > 0 && videoBitrate <= video {
+		video = videoBitrate
+	}
+	return video, audio, true
+}
+
+// Lower the profile bitrates so the output fit the profile MaxSize.
+// Must be called after configureTranscoder, the input duration is unknown for streams.
+func (m *MediaOptimizer) applyMaxSize(mediaFile *media.File, maxSize int64) {
+	duration := m.duration(mediaFile)
+	videoBitrate, audioBitrate := m.Profile.videoRate(), parseBitrate(m.Profile.AudioBitrate)
+	video, audio, ok := fitBitrates(maxSize, duration, m.MediaType, videoBitrate, audioBitrate)
+	if !ok || duration == 0 {
+		return
+	}
+
+	if audio != audioBitrate {
+		mediaFile.SetAudioBitRate(fmt.Sprintf("%dk", audio))
+	}
+	if m.MediaType != Video || video == videoBitrate {
+		return
+	}
+	switch m.Profile.rateControl() {
+	case RateCRF, RateConstrainedCRF:
+		// The CRF quality is kept while the rate is capped
+		m.capVideoRate(mediaFile, video)
+	default:
+		mediaFile.SetVideoBitRate(fmt.Sprintf("%dk", video))
+	}
+}
+
+// Split the output in parts when it still exceed the profile MaxSize
+func (m *MediaOptimizer) enforceMaxSize(ctx context.Context, maxSize int64) error {
+	m.Parts = nil
+	if maxSize <= 0 {
+		return nil
+	}
+	info, err := os.Stat(m.OutputPath)
+	if err != nil {
+		return err
+	}
+	if info.Size() <= maxSize {
+		return nil
+	}
+
+	parts, err := SplitMediaContext(ctx, m.OutputPath, maxSize)
+	if err != nil {
+		return err
+	}
+	m.Parts = parts
+	return os.Remove(m.OutputPath)
+}
+
+// Get the files produced by the last optimization, the parts when the output was split
+func (m *MediaOptimizer) Outputs() []string {
+	if len(m.Parts) > 0 {
+		return m.Parts
+	}
+	return []string{m.OutputPath}
+}
+
+// Split a media file in parts smaller than maxSize.
+// The streams are copied and cut on keyframes, the source file is kept.
+func SplitMedia(path string, maxSize int64) ([]string, error) {
+	return SplitMediaContext(context.Background(), path, maxSize)
+}
+
+// Same as SplitMedia but ffmpeg is killed when the context is done
+func SplitMediaContext(ctx context.Context, path string, maxSize int64) ([]string, error) {
+	parts, err := segmentMedia(ctx, path, maxSize)
+	if err != nil {
+		return nil, err
+	}
+
+	var fitting []string
+	for i, part := range parts {
+		fitted, err := fitPart(ctx, part, maxSize)
+		if err != nil {
+			removeFiles(fitting)
+			removeFiles(parts[i:])
+			return nil, err
+		}
+		fitting = append(fitting, fitted...)
+	}
+
+	// Number the parts again from the end, a part never move before its first name
+	ext := filepath.Ext(path)
+	prefix := strings.TrimSuffix(path, ext) + "_part"
+	for i := len(fitting) - 1; i >= 0; i-- {
+		name := fmt.Sprintf("%s%03d%s", prefix, i+1, ext)
+		if err := os.Rename(fitting[i], name); err != nil {
+			removeFiles(fitting)
+			return nil, err
+		}
+		fitting[i] = name
+	}
+	return fitting, nil
+}
+
+// Cut the file in parts of about maxSize with the streams copied
+func segmentMedia(ctx context.Context, path string, maxSize int64) ([]string, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := ProbeMediaContext(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	if info.Duration <= 0 {
+		return nil, fmt.Errorf("can't split %s : unknown duration", path)
+	}
+
+	// The cuts happen on the first keyframe after the segment time, so keep some room
+	count := math.Ceil(float64(stat.Size()) / (float64(maxSize) * sizeMargin * sizeMargin))
+	segment := info.Duration.Seconds() / count
+
+	ext := filepath.Ext(path)
+	prefix := strings.TrimSuffix(path, ext) + "_part"
+	args := []string{"-y", "-v", "error", "-i", path,
+		"-map", "0", "-c", "copy",
+		"-f", "segment",
+		"-segment_time", strconv.FormatFloat(segment, 'f', 3, 64),
+		"-segment_start_number", "1",
+		"-reset_timestamps", "1",
+	}
+	if ext == ".mp4" || ext == ".m4a" {
+		args = append(args, "-segment_format_options", "movflags=+faststart")
+	}
+	args = append(args, prefix+"%03d"+ext)
+
+	output, err := exec.CommandContext(ctx, "ffmpeg", args...).CombinedOutput()
+	parts, _ := filepath.Glob(prefix + "[0-9][0-9][0-9]" + ext)
+	sort.Strings(parts)
+	if err != nil {
+		removeFiles(parts)
+		return nil, fmt.Errorf("split error for %s : %v %s", path, err, strings.TrimSpace(string(output)))
+	}
+	return parts, nil
+}
+
+// Get the part, or the parts replacing it when it exceed maxSize.
+// A long GOP or a high bitrate scene is cut again with shorter segments, and
+// re-encoded at a lower bitrate when its keyframes are too far apart.
+func fitPart(ctx context.Context, part string, maxSize int64) ([]string, error) {
+	stat, err := os.Stat(part)
+	if err != nil {
+		return nil, err
+	}
+	if stat.Size() <= maxSize {
+		return []string{part}, nil
+	}
+
+	parts, err := segmentMedia(ctx, part, maxSize)
+	if err != nil {
+		os.Remove(part)
+		return nil, err
+	}
+	if len(parts) <= 1 {
+		removeFiles(parts)
+		if err := reencodePart(ctx, part, maxSize); err != nil {
+			os.Remove(part)
+			return nil, err
+		}
+		return []string{part}, nil
+	}
+
+	os.Remove(part)
+	var fitting []string
+	for i, sub := range parts {
+		fitted, err := fitPart(ctx, sub, maxSize)
+		if err != nil {
+			removeFiles(fitting)
+			removeFiles(parts[i:])
+			return nil, err
+		}
+		fitting = append(fitting, fitted...)
+	}
+	return fitting, nil
+}
+
+// Encode the part again in place at the bitrates fitting maxSize
+func reencodePart(ctx context.Context, part string, maxSize int64) error {
+	info, err := ProbeMediaContext(ctx, part)
+	if err != nil {
+		return err
+	}
+	mediaType := info.MediaType()
+	video, audio, ok := fitBitrates(maxSize, info.Duration, mediaType, 0, 0)
+	if !ok || info.Duration <= 0 {
+		return fmt.Errorf("can't fit %s under %d bytes", part, maxSize)
+	}
+
+	ext := filepath.Ext(part)
+	encoded := strings.TrimSuffix(part, ext) + "_fit" + ext
+	args := []string{"-y", "-v", "error", "-i", part,
+		"-map", "0", "-c", "copy",
+		"-c:a", "aac", "-b:a", fmt.Sprintf("%dk", audio),
+	}
+	if mediaType == Video {
+		rate := fmt.Sprintf("%dk", video)
+		args = append(args, "-c:v", "libx264", "-b:v", rate, "-maxrate", rate, "-bufsize", rate, "-pix_fmt", "yuv420p")
+	}
+	args = append(args, "-movflags", "+faststart", encoded)
+
+	output, err := exec.CommandContext(ctx, "ffmpeg", args...).CombinedOutput()
+	if err != nil {
+		os.Remove(encoded)
+		return fmt.Errorf("re-encoding error for %s : %v %s", part, err, strings.TrimSpace(string(output)))
+	}
+	if stat, err := os.Stat(encoded); err != nil || stat.Size() > maxSize {
+		os.Remove(encoded)
+		return fmt.Errorf("can't fit %s under %d bytes", part, maxSize)
+	}
+	return os.Rename(encoded, part)
+}
+
+// Caption of the part index (starting at 0) of a split output
+func PartCaption(caption string, index, count int) string {
+	if count <= 1 {
+		return caption
+	}
+	return fmt.Sprintf("%s (part %d/%d)", caption, index+1, count)
+}
+
+func removeFiles(paths []string) {
+	for _, path := range paths {
+		os.Remove(path)
+	}
+}
@@ -0,0 +1,102 @@
+package services
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		size     string
+		expected int64
+		invalid  bool
+	}{
+		{"", 0, false},
+		{"1024", 1024, false},
+		{"512K", 512 << 10, false},
+		{"50M", 50 << 20, false},
+		{"50MB", 50 << 20, false},
+		{"2GiB", 2 << 30, false},
+		{"1.5g", 3 << 29, false},
+		{"fifty", 0, true},
+		{"-1M", 0, true},
+	}
+
+	for _, tt := range tests {
+		size, err := ParseSize(tt.size)
+		if (err != nil) != tt.invalid {
+			t.Errorf("ParseSize(%q) error = %v, expected invalid %v", tt.size, err, tt.invalid)
+			continue
+		}
+		if size != tt.expected {
+			t.Errorf("ParseSize(%q) = %d, expected %d", tt.size, size, tt.expected)
+		}
+	}
+}
+
+func TestParseBitrate(t *testing.T) {
+	tests := map[string]int{"500k": 500, "2M": 2000, "128000": 128, "": 0, "fast": 0}
+	for bitrate, expected := range tests {
+		if got := parseBitrate(bitrate); got != expected {
+			t.Errorf("parseBitrate(%q) = %d, expected %d", bitrate, got, expected)
+		}
+	}
+}
+
+func TestFitBitrates(t *testing.T) {
+	maxSize := int64(50 << 20)
+
+	// A short video keep the profile bitrates
+	video, audio, ok := fitBitrates(maxSize, time.Minute, Video, 1000, 128)
+	if !ok || video != 1000 || audio != 128 {
+		t.Errorf("expected the profile bitrates, got %d/%d %v", video, audio, ok)
+	}
+
+	// A movie get a lower video bitrate fitting the size
+	video, audio, ok = fitBitrates(maxSize, 20*time.Minute, Video, 1000, 128)
+	if !ok || video >= 1000 {
+		t.Fatalf("expected a lower video bitrate, got %d/%d %v", video, audio, ok)
+	}
+	if size := int64(video+audio) * 1000 / 8 * int64((20 * time.Minute).Seconds()); size > maxSize {
+		t.Errorf("expected an output under %d bytes, got %d", maxSize, size)
+	}
+
+	// A too long video must be split
+	if _, _, ok := fitBitrates(maxSize, 3*time.Hour, Video, 1000, 128); ok {
+		t.Error("expected a split for a 3 hours video")
+	}
+
+	// A long audio get a lower audio bitrate
+	_, audio, ok = fitBitrates(maxSize, time.Hour, Audio, 0, 128)
+	if !ok || audio >= 128 || audio < minAudioBitrate {
+		t.Errorf("expected a lower audio bitrate, got %d %v", audio, ok)
+	}
+
+	// No limit or unknown duration
+	if video, audio, ok := fitBitrates(0, time.Hour, Video, 1000, 128); !ok || video != 1000 || audio != 128 {
+		t.Errorf("expected the profile bitrates without limit, got %d/%d %v", video, audio, ok)
+	}
+	if video, _, ok := fitBitrates(maxSize, 0, Video, 1000, 128); !ok || video != 1000 {
+		t.Errorf("expected the profile bitrates without duration, got %d %v", video, ok)
+	}
+}
+
+func TestPartCaption(t *testing.T) {
+	if caption := PartCaption("movie.mp4", 1, 3); caption != "movie.mp4 (part 2/3)" {
+		t.Errorf("unexpected caption %q", caption)
+	}
+	if caption := PartCaption("movie.mp4", 0, 1); caption != "movie.mp4" {
+		t.Errorf("expected the caption unchanged for a single part, got %q", caption)
+	}
+}
+
+func TestOptimizerOutputs(t *testing.T) {
+	m := &MediaOptimizer{OutputPath: "movie_optimized.mp4"}
+	if outputs := m.Outputs(); len(outputs) != 1 || outputs[0] != m.OutputPath {
+		t.Errorf("expected the output path, got %v", outputs)
+	}
+	m.Parts = []string{"a", "b"}
+	if outputs := m.Outputs(); len(outputs) != 2 {
+		t.Errorf("expected the parts, got %v", outputs)
+	}
+}
@@ -0,0 +1,98 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/xfrr/goffmpeg/transcoder"
+)
+
+// Create a media optimizer fed by a stream instead of a file on disk.
+// The input name is only used to detect the media type.
+func NewStreamMediaOptimizer(inputName, outputPath string) (*MediaOptimizer, error) {
+	if err := os.MkdirAll(filepath.Dir(outputPath), 0755); err != nil {
+		return nil, fmt.Errorf("can't create output dir: %v", err)
+	}
+
+	return &MediaOptimizer{
+		InputPath:    inputName,
+		OutputPath:   outputPath,
+		MediaType:    detectMediaType(inputName),
+		StallTimeout: TranscodeStallTimeout,
+		transcoder:   new(transcoder.Transcoder),
+	}, nil
+}
+
+// Run the optimization by piping the input stream into ffmpeg stdin.
+// The progress is computed from the bytes read over the expected input size.
+// The input container must be readable sequentially: an mp4 with its index
+// at the end of the file can't be streamed.
+func (m *MediaOptimizer) OptimizeStream(input io.Reader, inputSize int64, progressCallback func(float64)) error {
+	return m.OptimizeStreamContext(context.Background(), input, inputSize, progressCallback)
+}
+
+// Same as OptimizeStream but ffmpeg is killed when the context is done
+func (m *MediaOptimizer) OptimizeStreamContext(ctx context.Context, input io.Reader, inputSize int64, progressCallback func(float64)) error {
+	maxSize, err := ParseSize(m.Profile.MaxSize)
+	if err != nil {
+		return err
+	}
+	if err := m.transcoder.InitializeEmptyTranscoder(); err != nil {
+		return fmt.Errorf("transcoder initialization error: %v", err)
+	}
+
+	pipe, err := m.transcoder.CreateInputPipe()
+	if err != nil {
+		return fmt.Errorf("transcoder input pipe error: %v", err)
+	}
+	if err := m.transcoder.SetOutputPath(m.OutputPath); err != nil {
+		return fmt.Errorf("transcoder output error: %v", err)
+	}
+
+	// The input duration is unknown, an output over the max size is split afterward.
+	// The stream can't be read twice so the two-pass mode run its second pass alone as an ABR.
+	if err := m.configureTranscoder(); err != nil {
+		return err
+	}
+
+	copied := make(chan error, 1)
+	go func() {
+		reader := &progressReader{reader: input, size: inputSize, callback: progressCallback}
+		_, err := io.Copy(pipe, reader)
+		pipe.CloseWithError(err)
+		copied <- err
+	}()
+
+	// The progress is reported by the input reader, ffmpeg output only feed the stall detector
+	result := m.run(ctx, m.OutputPath, nil)
+	// Unblock the copy when ffmpeg exited before reading the whole input
+	m.transcoder.MediaFile().InputPipeReader().Close()
+	copyErr := <-copied
+	if result != nil {
+		return result
+	}
+	if copyErr != nil && copyErr != io.ErrClosedPipe {
+		return fmt.Errorf("input stream error: %v", copyErr)
+	}
+	return m.enforceMaxSize(ctx, maxSize)
+}
+
+// progressReader report the percentage of the expected size already read
+type progressReader struct {
+	reader   io.Reader
+	size     int64
+	read     int64
+	callback func(float64)
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if n > 0 && r.callback != nil && r.size > 0 {
+		r.read += int64(n)
+		r.callback(float64(r.read) * 100 / float64(r.size))
+	}
+	return n, err
+}
@@ -65,7 +65,7 @@ func TestNewMediaOptimizer(t *testing.T) {
 		{
 			name:        "Valid audio file",
 			inputPath:   testAudioPath,
-			outputPath:  filepath.Join(tempDir, "output.aac"),
+			outputPath:  filepath.Join(tempDir, "output.m4a"),
 			shouldError: false,
 		},
 		{
@@ -110,6 +110,7 @@ func TestDetectMediaType(t *testing.T) {
 		{"test.wav", Audio},
 		{"test.flac", Audio},
 		{"test.aac", Audio},
+		{"test.m4a", Audio},
 		{"test.unknown", Audio},
 	}
 
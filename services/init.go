@@ -1,4 +1,29 @@
 package services
 
 func init() {
+	HandlerErrorTopic = NewTopic(EventBus, "events.error", encodeHandlerError, decodeHandlerError)
+	HandlerErrorEvent = HandlerErrorTopic.Event()
+
+	PipelineStageTopic = NewTopic(EventBus, "pipeline.stage", encodePipelineStage, decodePipelineStage)
+	PipelineProgressTopic = NewTopic(EventBus, "pipeline.progress", encodePipelineProgress, decodePipelineProgress)
+	PipelineDoneTopic = NewTopic(EventBus, "pipeline.done", encodePipelineResult, decodePipelineResult)
+	PipelineFailedTopic = NewTopic(EventBus, "pipeline.failed", encodePipelineFailure, decodePipelineFailure)
+	// The state changes must arrive in order, only the latest progress of a pipeline matters
+	PipelineStageTopic.SetDelivery(DeliveryOptions{Mode: DeliverOrdered})
+	PipelineProgressTopic.SetDelivery(DeliveryOptions{Mode: DeliverCoalesce})
+	PipelineStageEvent = PipelineStageTopic.Event()
+	PipelineProgressEvent = PipelineProgressTopic.Event()
+	PipelineDoneEvent = PipelineDoneTopic.Event()
+	PipelineFailedEvent = PipelineFailedTopic.Event()
+
+	BatchFileTopic = NewTopic(EventBus, "batch.file", encodeBatchResult, decodeBatchResult)
+	BatchFileEvent = BatchFileTopic.Event()
+
+	JobStateTopic = NewTopic(EventBus, "job.state", encodeJobState, decodeJobState)
+	JobStateTopic.SetDelivery(DeliveryOptions{Mode: DeliverOrdered})
+	JobStateEvent = JobStateTopic.Event()
+
+	TorrentProgressTopic = NewTopic(EventBus, "torrent.progress", encodeTorrentProgress, decodeTorrentProgress)
+	TorrentProgressTopic.SetDelivery(DeliveryOptions{Mode: DeliverCoalesce})
+	TorrentProgressEvent = TorrentProgressTopic.Event()
 }
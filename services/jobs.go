@@ -0,0 +1,549 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// JobState represent the lifecycle step of a queued job
+type JobState string
+
+const (
+	JobQueued      JobState = "queued"
+	JobDownloading JobState = "downloading"
+	JobTranscoding JobState = "transcoding"
+	JobUploading   JobState = "uploading"
+	JobDone        JobState = "done"
+	JobFailed      JobState = "failed"
+	JobCancelled   JobState = "cancelled"
+	JobPaused      JobState = "paused"
+)
+
+// Topic published on every job state change
+var JobStateTopic *Topic[JobStateChange]
+
+// Untyped event of JobStateTopic with the job ID and the new state as arguments
+var JobStateEvent *Event
+
+// JobStateChange is published when a job enter a new state
+type JobStateChange struct {
+	ID    string
+	State JobState
+}
+
+func encodeJobState(c JobStateChange) (*EventData, []string) {
+	return &EventData{Message: string(c.State)}, []string{c.ID, string(c.State)}
+}
+
+func decodeJobState(data *EventData, args []string) (JobStateChange, error) {
+	if len(args) != 2 {
+		return JobStateChange{}, fmt.Errorf("expected 2 job state arguments, got %d", len(args))
+	}
+	return JobStateChange{ID: args[0], State: JobState(args[1])}, nil
+}
+
+var ErrJobNotFound = errors.New("job not found")
+
+var jobsBucket = []byte("jobs")
+
+// Job is a persisted unit of work processed by the JobQueue
+type Job struct {
+	ID        string    `json:"id"`
+	Source    string    `json:"source"`
+	ChatID    int64     `json:"chat_id"`
+	Quality   string    `json:"quality,omitempty"`
+	Streaming bool      `json:"streaming,omitempty"` // Transcode the files while they are downloading
+	State     JobState  `json:"state"`
+	Attempts  int       `json:"attempts"`
+	LastError string    `json:"last_error,omitempty"`
+	NextRunAt time.Time `json:"next_run_at"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Check if the job reached a final state
+func (j *Job) Finished() bool {
+	return j.State == JobDone || j.State == JobFailed || j.State == JobCancelled
+}
+
+// JobStore persist the jobs inside an embedded bbolt database
+type JobStore struct {
+	db *bolt.DB
+}
+
+// Open or create the job database at the provided path
+func OpenJobStore(path string) (*JobStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("can't create job store dir: %v", err)
+	}
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("error during the job store opening : %v", err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(jobsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error during the job store initialization : %v", err)
+	}
+
+	return &JobStore{db: db}, nil
+}
+
+// Insert or update the job
+func (s *JobStore) Save(job *Job) error {
+	encoded, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(jobsBucket).Put([]byte(job.ID), encoded)
+	})
+}
+
+// Get the job registered under the provided ID
+func (s *JobStore) Get(id string) (*Job, error) {
+	job := &Job{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		encoded := tx.Bucket(jobsBucket).Get([]byte(id))
+		if encoded == nil {
+			return ErrJobNotFound
+		}
+		return json.Unmarshal(encoded, job)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// List every stored job ordered by creation date
+func (s *JobStore) List() ([]*Job, error) {
+	var jobs []*Job
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(jobsBucket).ForEach(func(_, encoded []byte) error {
+			job := &Job{}
+			if err := json.Unmarshal(encoded, job); err != nil {
+				return err
+			}
+			jobs = append(jobs, job)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].CreatedAt.Before(jobs[j].CreatedAt)
+	})
+	return jobs, nil
+}
+
+// Remove the job from the store
+func (s *JobStore) Delete(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(jobsBucket).Delete([]byte(id))
+	})
+}
+
+func (s *JobStore) Close() error {
+	return s.db.Close()
+}
+
+// JobRunner execute a job and report the intermediate states through setState
+// The context is cancelled when the job is cancelled or the queue stopped.
+type JobRunner func(ctx context.Context, job *Job, setState func(JobState)) error
+
+// JobQueue dispatch the stored jobs to a pool of workers.
+// Failed jobs are retried with an exponential backoff and the jobs
+// interrupted by a restart are resumed by Start.
+type JobQueue struct {
+	Store        *JobStore
+	Runner       JobRunner
+	Workers      int
+	MaxAttempts  int
+	BaseBackoff  time.Duration
+	MaxBackoff   time.Duration
+	PollInterval time.Duration
+
+	mu         sync.Mutex
+	running    map[string]context.CancelFunc
+	interrupts map[string]JobState // State requested for an interrupted running job
+	ctx        context.Context
+	cancelAll  context.CancelFunc
+	sem        chan struct{}
+	wake       chan struct{}
+	stop       chan struct{}
+	wg         sync.WaitGroup
+	workers    sync.WaitGroup
+}
+
+// Create a new job queue with the default retry policy
+func NewJobQueue(store *JobStore, runner JobRunner) *JobQueue {
+	return &JobQueue{
+		Store:        store,
+		Runner:       runner,
+		Workers:      2,
+		MaxAttempts:  3,
+		BaseBackoff:  30 * time.Second,
+		MaxBackoff:   10 * time.Minute,
+		PollInterval: time.Second,
+		running:      make(map[string]context.CancelFunc),
+		interrupts:   make(map[string]JobState),
+		wake:         make(chan struct{}, 1),
+	}
+}
+
+// Persist a new job and wake up the dispatcher
+func (q *JobQueue) Enqueue(source string, chatID int64, quality string) (*Job, error) {
+	return q.enqueue(&Job{Source: source, ChatID: chatID, Quality: quality})
+}
+
+// Same as Enqueue but the media files of the job are transcoded while they are downloading
+func (q *JobQueue) EnqueueStreaming(source string, chatID int64, quality string) (*Job, error) {
+	return q.enqueue(&Job{Source: source, ChatID: chatID, Quality: quality, Streaming: true})
+}
+
+func (q *JobQueue) enqueue(job *Job) (*Job, error) {
+	now := time.Now()
+	job.ID = newID()
+	job.State = JobQueued
+	job.NextRunAt, job.CreatedAt, job.UpdatedAt = now, now, now
+	if err := q.Store.Save(job); err != nil {
+		return nil, fmt.Errorf("error during the job saving : %v", err)
+	}
+	JobStateTopic.Publish(context.Background(), JobStateChange{ID: job.ID, State: job.State})
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return job, nil
+}
+
+// Get a job by ID
+func (q *JobQueue) Job(id string) (*Job, error) {
+	return q.Store.Get(id)
+}
+
+// List every job known by the queue
+func (q *JobQueue) Jobs() ([]*Job, error) {
+	return q.Store.List()
+}
+
+// Resume the interrupted jobs and start the dispatching loop
+func (q *JobQueue) Start() error {
+	if err := q.resume(); err != nil {
+		return err
+	}
+
+	q.sem = make(chan struct{}, max(q.Workers, 1))
+	q.stop = make(chan struct{})
+	q.ctx, q.cancelAll = context.WithCancel(context.Background())
+	q.wg.Add(1)
+	go q.loop()
+	return nil
+}
+
+// Stop dispatching new jobs and cancel the in-flight ones.
+// The cancelled jobs keep their state and will be resumed by the next Start.
+// Stop does nothing when the queue is not started.
+func (q *JobQueue) Stop() {
+	if q.stop == nil {
+		return
+	}
+	close(q.stop)
+	q.wg.Wait()
+	q.cancelAll()
+	q.workers.Wait()
+	q.stop = nil
+}
+
+// Cancel a job. A running job is interrupted and a queued job never started.
+func (q *JobQueue) Cancel(id string) error {
+	return q.interrupt(id, JobCancelled)
+}
+
+// Pause a job until Resume is called. A running job is interrupted and its
+// attempt is not counted, the downloaded pieces are kept on disk.
+func (q *JobQueue) Pause(id string) error {
+	return q.interrupt(id, JobPaused)
+}
+
+// Put a paused job back in the queue
+func (q *JobQueue) Resume(id string) error {
+	q.mu.Lock()
+	job, err := q.Store.Get(id)
+	if err != nil {
+		q.mu.Unlock()
+		return err
+	}
+	if job.State != JobPaused {
+		q.mu.Unlock()
+		return fmt.Errorf("job %s is %s, not paused", id, job.State)
+	}
+	job.NextRunAt = time.Now()
+	change, err := q.saveState(job, JobQueued)
+	q.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	publishJobState(change)
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Move a job to the cancelled or paused state, interrupting it when running
+func (q *JobQueue) interrupt(id string, state JobState) error {
+	q.mu.Lock()
+	if cancel, ok := q.running[id]; ok {
+		q.interrupts[id] = state
+		cancel()
+		q.mu.Unlock()
+		return nil
+	}
+
+	job, err := q.Store.Get(id)
+	if err != nil {
+		q.mu.Unlock()
+		return err
+	}
+	if job.Finished() || job.State == state {
+		q.mu.Unlock()
+		return fmt.Errorf("job %s already %s", id, job.State)
+	}
+	if state == JobCancelled {
+		job.LastError = "cancelled"
+	}
+	change, err := q.saveState(job, state)
+	q.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	publishJobState(change)
+	return nil
+}
+
+// Put back in the queue every job left in an intermediate state by a previous run
+func (q *JobQueue) resume() error {
+	jobs, err := q.Store.List()
+	if err != nil {
+		return fmt.Errorf("error during the jobs loading : %v", err)
+	}
+
+	for _, job := range jobs {
+		if job.Finished() || job.State == JobQueued || job.State == JobPaused {
+			continue
+		}
+		job.NextRunAt = time.Now()
+		if err := q.setState(job, JobQueued); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (q *JobQueue) loop() {
+	defer q.wg.Done()
+
+	ticker := time.NewTicker(q.PollInterval)
+	defer ticker.Stop()
+
+	q.dispatch()
+	for {
+		select {
+		case <-q.stop:
+			return
+		case <-ticker.C:
+			q.dispatch()
+		case <-q.wake:
+			q.dispatch()
+		}
+	}
+}
+
+// Start every due job while a worker slot is available
+func (q *JobQueue) dispatch() {
+	jobs, err := q.Store.List()
+	if err != nil {
+		log.Printf("job queue: error during the jobs loading: %v", err)
+		return
+	}
+
+	now := time.Now()
+	for _, job := range jobs {
+		if job.State != JobQueued || job.NextRunAt.After(now) {
+			continue
+		}
+
+		q.mu.Lock()
+		if _, ok := q.running[job.ID]; ok {
+			q.mu.Unlock()
+			continue
+		}
+		// The job may have been cancelled or run again since the listing
+		current, err := q.Store.Get(job.ID)
+		if err != nil || current.State != JobQueued || current.NextRunAt.After(now) {
+			q.mu.Unlock()
+			continue
+		}
+		job = current
+		select {
+		case q.sem <- struct{}{}:
+		default:
+			q.mu.Unlock()
+			return
+		}
+		ctx, cancel := context.WithCancel(q.ctx)
+		q.running[job.ID] = cancel
+		q.workers.Add(1)
+		q.mu.Unlock()
+
+		go q.process(ctx, job)
+	}
+}
+
+func (q *JobQueue) process(ctx context.Context, job *Job) {
+	defer q.workers.Done()
+	defer func() { <-q.sem }()
+
+	job.Attempts++
+	job.LastError = ""
+	err := q.Runner(ctx, job, func(state JobState) {
+		if err := q.setState(job, state); err != nil {
+			log.Printf("job queue: error during the job %s update: %v", job.ID, err)
+		}
+	})
+
+	// Published once unlocked, the ordered subscribers may block
+	if change, ok := q.finish(job, err); ok {
+		publishJobState(change)
+	}
+}
+
+// Save the state following the run of the job.
+// The job stay running until its new state is saved, a stale queued state must not be dispatched again.
+func (q *JobQueue) finish(job *Job, err error) (JobStateChange, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	defer delete(q.running, job.ID)
+	q.running[job.ID]()
+	interrupt, interrupted := q.interrupts[job.ID]
+	delete(q.interrupts, job.ID)
+
+	state := JobDone
+	switch {
+	case err == nil:
+	case interrupted && interrupt == JobCancelled:
+		state = JobCancelled
+		job.LastError = "cancelled"
+	case interrupted && interrupt == JobPaused:
+		state = JobPaused
+		job.Attempts--
+	case q.ctx.Err() != nil:
+		// Interrupted by Stop, the attempt doesn't count and the job is resumed on the next Start
+		job.Attempts--
+		if err := q.Store.Save(job); err != nil {
+			log.Printf("job queue: error during the job %s update: %v", job.ID, err)
+		}
+		return JobStateChange{}, false
+	default:
+		job.LastError = err.Error()
+		if job.Attempts >= q.MaxAttempts {
+			state = JobFailed
+		} else {
+			state = JobQueued
+			job.NextRunAt = time.Now().Add(q.backoff(job.Attempts))
+		}
+	}
+
+	change, err := q.saveState(job, state)
+	if err != nil {
+		log.Printf("job queue: error during the job %s update: %v", job.ID, err)
+		return JobStateChange{}, false
+	}
+	return change, true
+}
+
+// Compute the delay before the next attempt
+func (q *JobQueue) backoff(attempts int) time.Duration {
+	delay := q.BaseBackoff
+	for i := 1; i < attempts; i++ {
+		delay *= 2
+		if q.MaxBackoff > 0 && delay >= q.MaxBackoff {
+			return q.MaxBackoff
+		}
+	}
+	return delay
+}
+
+func (q *JobQueue) setState(job *Job, state JobState) error {
+	change, err := q.saveState(job, state)
+	if err != nil {
+		return err
+	}
+	publishJobState(change)
+	return nil
+}
+
+// Persist the new state of the job without publishing it, the callers holding q.mu
+// publish the returned change once unlocked
+func (q *JobQueue) saveState(job *Job, state JobState) (JobStateChange, error) {
+	job.State = state
+	job.UpdatedAt = time.Now()
+	if err := q.Store.Save(job); err != nil {
+		return JobStateChange{}, err
+	}
+	return JobStateChange{ID: job.ID, State: state}, nil
+}
+
+func publishJobState(change JobStateChange) {
+	JobStateTopic.Publish(context.Background(), change)
+}
+
+var pipelineJobStates = map[PipelineStage]JobState{
+	StageDownload:  JobDownloading,
+	StageTranscode: JobTranscoding,
+	StageUpload:    JobUploading,
+}
+
+// Build a job runner executing a full pipeline for each job.
+// Every job get its own download and output directories.
+func PipelineJobRunner(downloadDir, outputDir string, uploader MediaUploader) JobRunner {
+	return func(ctx context.Context, job *Job, setState func(JobState)) error {
+		p := NewPipeline(job.Source, filepath.Join(downloadDir, job.ID), filepath.Join(outputDir, job.ID), job.ChatID, uploader)
+		p.ID = job.ID
+		p.MaxSize = os.Getenv(MaxUploadSizeEnv)
+		p.Subtitles = SubtitleOptionsFromEnv()
+		p.Streaming = job.Streaming
+		p.OwnDirs = true
+		if job.Quality != "" {
+			p.Quality = job.Quality
+		}
+		p.OnStage = func(stage PipelineStage) {
+			if state, ok := pipelineJobStates[stage]; ok {
+				setState(state)
+			}
+		}
+		return p.RunContext(ctx)
+	}
+}
@@ -0,0 +1,297 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func openTestJobStore(t *testing.T) (*JobStore, string) {
+	path := filepath.Join(t.TempDir(), "jobs.db")
+	store, err := OpenJobStore(path)
+	if err != nil {
+		t.Fatalf("job store opening error: %v", err)
+	}
+	return store, path
+}
+
+func newTestJobQueue(store *JobStore, runner JobRunner) *JobQueue {
+	q := NewJobQueue(store, runner)
+	q.BaseBackoff = 10 * time.Millisecond
+	q.PollInterval = 5 * time.Millisecond
+	return q
+}
+
+func waitForJobState(t *testing.T, q *JobQueue, id string, state JobState) *Job {
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		job, err := q.Job(id)
+		if err == nil && job.State == state {
+			return job
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	job, _ := q.Job(id)
+	t.Fatalf("job %s never reached the %s state, last state: %+v", id, state, job)
+	return nil
+}
+
+func TestJobStorePersistence(t *testing.T) {
+	store, path := openTestJobStore(t)
+	q := NewJobQueue(store, nil)
+
+	job, err := q.Enqueue("magnet:?xt=urn:btih:abc", 42, "low")
+	if err != nil {
+		t.Fatalf("enqueue error: %v", err)
+	}
+	store.Close()
+
+	reopened, err := OpenJobStore(path)
+	if err != nil {
+		t.Fatalf("job store reopening error: %v", err)
+	}
+	defer reopened.Close()
+
+	saved, err := reopened.Get(job.ID)
+	if err != nil {
+		t.Fatalf("get error: %v", err)
+	}
+	if saved.Source != job.Source || saved.ChatID != 42 || saved.State != JobQueued {
+		t.Errorf("unexpected persisted job: %+v", saved)
+	}
+
+	if _, err := reopened.Get("unknown"); !errors.Is(err, ErrJobNotFound) {
+		t.Errorf("expected ErrJobNotFound, got %v", err)
+	}
+}
+
+func TestJobQueueRunsJobToDone(t *testing.T) {
+	store, _ := openTestJobStore(t)
+	defer store.Close()
+
+	var states []JobState
+	q := newTestJobQueue(store, func(ctx context.Context, job *Job, setState func(JobState)) error {
+		setState(JobDownloading)
+		setState(JobTranscoding)
+		setState(JobUploading)
+		states = append(states, JobDownloading, JobTranscoding, JobUploading)
+		return nil
+	})
+	if err := q.Start(); err != nil {
+		t.Fatalf("start error: %v", err)
+	}
+	defer q.Stop()
+
+	job, err := q.Enqueue("file.torrent", 1, "")
+	if err != nil {
+		t.Fatalf("enqueue error: %v", err)
+	}
+
+	done := waitForJobState(t, q, job.ID, JobDone)
+	if done.Attempts != 1 {
+		t.Errorf("expected 1 attempt, got %d", done.Attempts)
+	}
+	if len(states) != 3 {
+		t.Errorf("expected 3 intermediate states, got %v", states)
+	}
+}
+
+func TestJobQueueRetriesThenFails(t *testing.T) {
+	store, _ := openTestJobStore(t)
+	defer store.Close()
+
+	var calls atomic.Int32
+	q := newTestJobQueue(store, func(ctx context.Context, job *Job, setState func(JobState)) error {
+		calls.Add(1)
+		return errors.New("tracker unreachable")
+	})
+	q.MaxAttempts = 3
+	if err := q.Start(); err != nil {
+		t.Fatalf("start error: %v", err)
+	}
+	defer q.Stop()
+
+	job, _ := q.Enqueue("file.torrent", 1, "")
+
+	failed := waitForJobState(t, q, job.ID, JobFailed)
+	if failed.Attempts != 3 || calls.Load() != 3 {
+		t.Errorf("expected 3 attempts, got %d (runner called %d times)", failed.Attempts, calls.Load())
+	}
+	if failed.LastError != "tracker unreachable" {
+		t.Errorf("unexpected last error: %s", failed.LastError)
+	}
+}
+
+func TestJobQueueResumesInterruptedJobs(t *testing.T) {
+	store, _ := openTestJobStore(t)
+	defer store.Close()
+
+	interrupted := &Job{
+		ID:        "interrupted",
+		Source:    "file.torrent",
+		State:     JobTranscoding,
+		Attempts:  1,
+		CreatedAt: time.Now(),
+	}
+	if err := store.Save(interrupted); err != nil {
+		t.Fatalf("save error: %v", err)
+	}
+
+	q := newTestJobQueue(store, func(ctx context.Context, job *Job, setState func(JobState)) error {
+		return nil
+	})
+	if err := q.Start(); err != nil {
+		t.Fatalf("start error: %v", err)
+	}
+	defer q.Stop()
+
+	done := waitForJobState(t, q, "interrupted", JobDone)
+	if done.Attempts != 2 {
+		t.Errorf("expected the resumed job to count 2 attempts, got %d", done.Attempts)
+	}
+}
+
+func TestJobQueueBackoff(t *testing.T) {
+	q := NewJobQueue(nil, nil)
+	q.BaseBackoff = time.Second
+	q.MaxBackoff = 5 * time.Second
+
+	tests := []struct {
+		attempts int
+		expected time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 5 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := q.backoff(tt.attempts); got != tt.expected {
+			t.Errorf("backoff(%d) = %v, expected %v", tt.attempts, got, tt.expected)
+		}
+	}
+}
+
+func TestJobQueueCancel(t *testing.T) {
+	store, _ := openTestJobStore(t)
+	defer store.Close()
+
+	started := make(chan string, 1)
+	q := newTestJobQueue(store, func(ctx context.Context, job *Job, setState func(JobState)) error {
+		setState(JobDownloading)
+		started <- job.ID
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	q.Workers = 1
+	if err := q.Start(); err != nil {
+		t.Fatalf("start error: %v", err)
+	}
+	defer q.Stop()
+
+	running, _ := q.Enqueue("first.torrent", 1, "")
+	<-started
+	queued, _ := q.Enqueue("second.torrent", 1, "")
+
+	if err := q.Cancel(queued.ID); err != nil {
+		t.Fatalf("queued job cancel error: %v", err)
+	}
+	if err := q.Cancel(running.ID); err != nil {
+		t.Fatalf("running job cancel error: %v", err)
+	}
+
+	waitForJobState(t, q, running.ID, JobCancelled)
+	cancelled := waitForJobState(t, q, queued.ID, JobCancelled)
+	if cancelled.Attempts != 0 {
+		t.Errorf("the cancelled queued job should never run, got %d attempts", cancelled.Attempts)
+	}
+	if err := q.Cancel(queued.ID); err == nil {
+		t.Error("expected an error when cancelling a finished job")
+	}
+}
+
+func TestJobQueueStopInterruptsRunningJobs(t *testing.T) {
+	store, _ := openTestJobStore(t)
+	defer store.Close()
+
+	started := make(chan struct{}, 1)
+	q := newTestJobQueue(store, func(ctx context.Context, job *Job, setState func(JobState)) error {
+		setState(JobTranscoding)
+		started <- struct{}{}
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if err := q.Start(); err != nil {
+		t.Fatalf("start error: %v", err)
+	}
+
+	job, _ := q.Enqueue("file.torrent", 1, "")
+	<-started
+	q.Stop()
+
+	interrupted, err := q.Job(job.ID)
+	if err != nil {
+		t.Fatalf("get error: %v", err)
+	}
+	if interrupted.State != JobTranscoding || interrupted.Attempts != 0 {
+		t.Errorf("expected the interrupted job to be resumable, got %+v", interrupted)
+	}
+}
+
+func TestJobQueueStopWithoutStart(t *testing.T) {
+	store, _ := openTestJobStore(t)
+	defer store.Close()
+
+	q := newTestJobQueue(store, nil)
+	q.Stop()
+	if err := q.Start(); err != nil {
+		t.Fatalf("start error: %v", err)
+	}
+	q.Stop()
+	q.Stop()
+}
+
+func TestJobQueuePauseAndResume(t *testing.T) {
+	store, _ := openTestJobStore(t)
+	defer store.Close()
+
+	var calls atomic.Int32
+	started := make(chan struct{}, 2)
+	q := newTestJobQueue(store, func(ctx context.Context, job *Job, setState func(JobState)) error {
+		if calls.Add(1) == 2 {
+			return nil
+		}
+		setState(JobDownloading)
+		started <- struct{}{}
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if err := q.Start(); err != nil {
+		t.Fatalf("start error: %v", err)
+	}
+	defer q.Stop()
+
+	job, _ := q.Enqueue("file.torrent", 1, "")
+	<-started
+	if err := q.Pause(job.ID); err != nil {
+		t.Fatalf("pause error: %v", err)
+	}
+	paused := waitForJobState(t, q, job.ID, JobPaused)
+	if paused.Attempts != 0 {
+		t.Errorf("expected the paused attempt to be ignored, got %d attempts", paused.Attempts)
+	}
+	if err := q.Pause(job.ID); err == nil {
+		t.Error("expected an error when pausing a paused job")
+	}
+
+	if err := q.Resume(job.ID); err != nil {
+		t.Fatalf("resume error: %v", err)
+	}
+	done := waitForJobState(t, q, job.ID, JobDone)
+	if done.Attempts != 1 {
+		t.Errorf("expected 1 counted attempt, got %d", done.Attempts)
+	}
+}
@@ -0,0 +1,402 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/DoniLite/GhostifyBot/utils"
+)
+
+// PipelineStage identify the step a pipeline is currently running
+type PipelineStage string
+
+const (
+	StageDownload  PipelineStage = "download"
+	StageSelect    PipelineStage = "select"
+	StageTranscode PipelineStage = "transcode"
+	StageUpload    PipelineStage = "upload"
+	StageDone      PipelineStage = "done"
+)
+
+// Topics published during a pipeline run
+var (
+	PipelineStageTopic    *Topic[PipelineStageChange]
+	PipelineProgressTopic *Topic[PipelineProgress]
+	PipelineDoneTopic     *Topic[PipelineResult]
+	PipelineFailedTopic   *Topic[PipelineFailure]
+)
+
+// Untyped events of the pipeline topics.
+// Every emission carry the pipeline ID and the stage as first arguments.
+var (
+	PipelineStageEvent    *Event
+	PipelineProgressEvent *Event
+	PipelineDoneEvent     *Event
+	PipelineFailedEvent   *Event
+)
+
+// Pipeline chain the torrent download, the media optimization and the upload to a chat
+type Pipeline struct {
+	ID          string
+	Source      string // Magnet link, .torrent URL or .torrent file path
+	DownloadDir string
+	OutputDir   string
+	Quality     string
+	MaxSize     string          // Max size of the uploaded files, TelegramMaxUploadSize when empty
+	Selection   *FileSelection  // Files to download, every file when nil
+	Streaming   bool            // Transcode the files while they are downloading
+	Subtitles   SubtitleOptions // Not applied to the streamed files
+	ChatID      int64
+	Uploader    MediaUploader       // The upload stage is skipped when nil
+	OwnDirs     bool                // DownloadDir and OutputDir belong to this run and are removed once uploaded
+	OnStage     func(PipelineStage) // Optional hook called on every stage change
+	Stage       PipelineStage
+	MediaFiles  []string
+	Outputs     []string
+
+	manager     *TorrentManager
+	infoHash    string
+	streamFiles []TorrentFile
+	stageStart  time.Time
+	captions    []string // Upload caption of every output
+}
+
+// Create a new pipeline for the provided source
+func NewPipeline(source, downloadDir, outputDir string, chatID int64, uploader MediaUploader) *Pipeline {
+	selection := MediaFilesSelection
+	return &Pipeline{
+		ID:          newID(),
+		Source:      source,
+		DownloadDir: downloadDir,
+		OutputDir:   outputDir,
+		Quality:     "high",
+		Selection:   &selection,
+		ChatID:      chatID,
+		Uploader:    uploader,
+	}
+}
+
+// Run every stage of the pipeline in order.
+// A failure stop the pipeline and is persisted as a report.
+func (p *Pipeline) Run() error {
+	return p.RunContext(context.Background())
+}
+
+// Run every stage of the pipeline until the context is done.
+// On cancellation the torrent is dropped and the running ffmpeg process killed.
+func (p *Pipeline) RunContext(ctx context.Context) error {
+	defer p.releaseTorrent()
+
+	steps := []struct {
+		stage PipelineStage
+		run   func(context.Context) error
+	}{
+		{StageDownload, p.download},
+		{StageSelect, p.selectMedia},
+		{StageTranscode, p.transcode},
+		{StageUpload, p.upload},
+	}
+
+	for _, step := range steps {
+		p.setStage(ctx, step.stage)
+		if err := ctx.Err(); err != nil {
+			return p.fail(ctx, err)
+		}
+		if err := step.run(ctx); err != nil {
+			return p.fail(ctx, err)
+		}
+	}
+
+	// The uploaded files would fill the disk of a long running bot
+	if p.Uploader != nil {
+		p.cleanup()
+	}
+
+	p.setStage(ctx, StageDone)
+	PipelineDoneTopic.Publish(ctx, PipelineResult{ID: p.ID, Outputs: p.Outputs})
+	return nil
+}
+
+func (p *Pipeline) setStage(ctx context.Context, stage PipelineStage) {
+	p.Stage = stage
+	p.stageStart = time.Now()
+	if p.OnStage != nil {
+		p.OnStage(stage)
+	}
+	PipelineStageTopic.Publish(ctx, PipelineStageChange{ID: p.ID, Stage: stage})
+}
+
+// Publish the stage progress with an ETA estimated from the stage duration
+func (p *Pipeline) emitProgress(ctx context.Context, percent float64) {
+	p.publishProgress(ctx, PipelineProgress{
+		Percent: percent,
+		ETA:     estimateETA(time.Since(p.stageStart), percent),
+	})
+}
+
+func (p *Pipeline) publishProgress(ctx context.Context, progress PipelineProgress) {
+	progress.ID, progress.Stage = p.ID, p.Stage
+	PipelineProgressTopic.Publish(ctx, progress)
+}
+
+// Report the failure and wrap the error with the pipeline context.
+// Cancellations are not reported.
+func (p *Pipeline) fail(ctx context.Context, err error) error {
+	err = fmt.Errorf("pipeline %s failed at the %s stage : %v", p.ID, p.Stage, err)
+
+	if ctx.Err() == nil {
+		report := utils.CreateNewReport()
+		report.Err = err.Error()
+		report.Priority = utils.HIGH
+		report.Metadata = fmt.Sprintf("pipeline=%s stage=%s source=%s", p.ID, p.Stage, p.Source)
+		if persistErr := report.PersistReport(); persistErr != nil {
+			log.Printf("failed to persist the pipeline report: %v", persistErr)
+		}
+	}
+
+	PipelineFailedTopic.Publish(ctx, PipelineFailure{ID: p.ID, Stage: p.Stage, Err: err})
+	return err
+}
+
+func (p *Pipeline) download(ctx context.Context) error {
+	if p.Streaming {
+		return p.openStream(ctx)
+	}
+
+	onProgress := func(progress TorrentProgress) {
+		p.publishProgress(ctx, PipelineProgress{
+			Percent: progress.Percent(),
+			Rate:    progress.DownloadRate,
+			ETA:     progress.ETA,
+		})
+	}
+
+	if IsMagnet(p.Source) {
+		return downloadTorrent(ctx, func(manager *TorrentManager) (string, error) {
+			return manager.AddMagnet(p.Source, p.DownloadDir)
+		}, p.Selection, onProgress)
+	}
+
+	torrentPath, err := p.torrentPath(ctx)
+	if err != nil {
+		return err
+	}
+	return downloadTorrent(ctx, func(manager *TorrentManager) (string, error) {
+		return manager.AddTorrentFile(torrentPath, p.DownloadDir)
+	}, p.Selection, onProgress)
+}
+
+// Get the local .torrent file of the source, fetching it first for URLs
+func (p *Pipeline) torrentPath(ctx context.Context) (string, error) {
+	if isTorrentURL(p.Source) {
+		return DownloadTorrentFileContext(ctx, p.Source, p.DownloadDir)
+	}
+	return p.Source, nil
+}
+
+// Add the torrent and keep it open so its files can be streamed by the transcode stage
+func (p *Pipeline) openStream(ctx context.Context) error {
+	manager, err := DefaultTorrentManager()
+	if err != nil {
+		return err
+	}
+
+	var infoHash string
+	if IsMagnet(p.Source) {
+		infoHash, err = manager.AddMagnet(p.Source, p.DownloadDir)
+	} else {
+		var torrentPath string
+		if torrentPath, err = p.torrentPath(ctx); err == nil {
+			infoHash, err = manager.AddTorrentFile(torrentPath, p.DownloadDir)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	p.manager, p.infoHash = manager, infoHash
+
+	if err := manager.WaitMetadataContext(ctx, infoHash); err != nil {
+		return err
+	}
+
+	selection := FileSelection{}
+	if p.Selection != nil {
+		selection = *p.Selection
+	}
+	// Streaming only make sense for media files
+	selection.MediaTypes = []MediaType{Video, Audio}
+	p.streamFiles, err = manager.Select(infoHash, selection)
+	return err
+}
+
+func (p *Pipeline) releaseTorrent() {
+	if p.manager != nil {
+		p.manager.Remove(p.infoHash)
+		p.manager = nil
+	}
+}
+
+func (p *Pipeline) selectMedia(ctx context.Context) error {
+	if p.Streaming {
+		if len(p.streamFiles) == 0 {
+			return fmt.Errorf("no media file found in the torrent")
+		}
+		p.MediaFiles = make([]string, len(p.streamFiles))
+		for i, file := range p.streamFiles {
+			p.MediaFiles[i] = file.Path
+		}
+		return nil
+	}
+
+	files, err := collectMediaFiles(p.DownloadDir)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("no media file found in %s", p.DownloadDir)
+	}
+	p.MediaFiles = files
+	return nil
+}
+
+func (p *Pipeline) transcode(ctx context.Context) error {
+	if p.Streaming {
+		return p.transcodeStream(ctx)
+	}
+
+	p.Outputs, p.captions = make([]string, 0, len(p.MediaFiles)), nil
+	for i, input := range p.MediaFiles {
+		optimizer, err := newMediaOptimizerInDir(input, p.OutputDir)
+		if err != nil {
+			return fmt.Errorf("optimizer creation error for %s : %v", input, err)
+		}
+		optimizer.SetProfile(p.profile(optimizer.Info, optimizer.MediaType))
+		optimizer.Subtitles = p.Subtitles
+
+		done := float64(i)
+		total := float64(len(p.MediaFiles))
+		err = optimizer.OptimizeWithCallbackContext(ctx, func(progress float64) {
+			p.emitProgress(ctx, (done*100+progress)/total)
+		})
+		if err != nil {
+			return fmt.Errorf("optimization error for %s : %v", input, err)
+		}
+		p.addOutputs(optimizer.OutputPath, optimizer.Outputs())
+		for _, subtitle := range optimizer.SubtitleFiles {
+			p.Outputs = append(p.Outputs, subtitle)
+			p.captions = append(p.captions, subtitleCaption(optimizer.OutputPath, subtitle))
+		}
+	}
+	return nil
+}
+
+// Transcode every selected torrent file while it is downloading
+func (p *Pipeline) transcodeStream(ctx context.Context) error {
+	p.Outputs, p.captions = make([]string, 0, len(p.streamFiles)), nil
+	for i, file := range p.streamFiles {
+		output := optimizedOutputPath(file.Path, p.OutputDir)
+
+		done := float64(i)
+		total := float64(len(p.streamFiles))
+		parts, err := p.manager.StreamTranscodeContext(ctx, p.infoHash, file.Index, output, p.profile(nil, file.MediaType), func(progress float64) {
+			p.emitProgress(ctx, (done*100+progress)/total)
+		})
+		if err != nil {
+			return fmt.Errorf("streaming optimization error for %s : %v", file.Path, err)
+		}
+		p.addOutputs(output, parts)
+	}
+	return nil
+}
+
+// Get the mobile profile of the pipeline quality with the upload max size.
+// The info of the probed input is nil for the streamed files.
+func (p *Pipeline) profile(info *MediaInfo, mediaType MediaType) QualityProfile {
+	profile := pickProfile(info, mediaType, p.Quality)
+	profile.MaxSize = orDefault(p.MaxSize, TelegramMaxUploadSize)
+	return profile
+}
+
+// Record the files of an output, the parts of a split output get sequential captions
+func (p *Pipeline) addOutputs(output string, files []string) {
+	for i, file := range files {
+		p.Outputs = append(p.Outputs, file)
+		p.captions = append(p.captions, PartCaption(filepath.Base(output), i, len(files)))
+	}
+}
+
+func (p *Pipeline) caption(index int) string {
+	if index < len(p.captions) {
+		return p.captions[index]
+	}
+	return filepath.Base(p.Outputs[index])
+}
+
+func (p *Pipeline) upload(ctx context.Context) error {
+	if p.Uploader == nil {
+		return nil
+	}
+	for i, output := range p.Outputs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := p.Uploader.Upload(p.ChatID, output, detectMediaType(output), p.caption(i)); err != nil {
+			return err
+		}
+		p.emitProgress(ctx, float64(i+1)*100/float64(len(p.Outputs)))
+	}
+	return nil
+}
+
+// Remove the uploaded outputs, and the directories when they belong to the run.
+// The torrent is dropped first so no piece is written in the removed directory.
+func (p *Pipeline) cleanup() {
+	p.releaseTorrent()
+	for _, output := range p.Outputs {
+		if err := os.Remove(output); err != nil && !os.IsNotExist(err) {
+			log.Printf("failed to remove the uploaded output: %v", err)
+		}
+	}
+	if !p.OwnDirs {
+		return
+	}
+	for _, dir := range []string{p.DownloadDir, p.OutputDir} {
+		if err := os.RemoveAll(dir); err != nil {
+			log.Printf("failed to remove the pipeline directory: %v", err)
+		}
+	}
+}
+
+// Walk the directory and return every media file path in lexical order
+func collectMediaFiles(dir string) ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && isMediaFile(path) {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error during the media files lookup : %v", err)
+	}
+	return files, nil
+}
+
+// Generate a random identifier for pipelines and jobs
+func newID() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
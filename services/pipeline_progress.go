@@ -0,0 +1,125 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// PipelineProgress is a progress snapshot of the running pipeline stage
+type PipelineProgress struct {
+	ID      string
+	Stage   PipelineStage
+	Percent float64
+	Rate    float64       // Download rate in bytes per second, 0 outside of the download stage
+	ETA     time.Duration // Estimated remaining time of the stage, 0 when unknown
+}
+
+func (p PipelineProgress) String() string {
+	return fmt.Sprintf("%.2f", p.Percent)
+}
+
+// Encode the snapshot as event arguments.
+// The pipeline ID and the stage stay the first arguments like every pipeline event.
+func (p PipelineProgress) Args() []string {
+	return []string{
+		p.ID,
+		string(p.Stage),
+		strconv.FormatFloat(p.Percent, 'f', 2, 64),
+		strconv.FormatFloat(p.Rate, 'f', 2, 64),
+		strconv.FormatInt(int64(p.ETA), 10),
+	}
+}
+
+// Decode the arguments of a PipelineProgressEvent
+func PipelineProgressFromArgs(args []string) (PipelineProgress, error) {
+	if len(args) != 5 {
+		return PipelineProgress{}, fmt.Errorf("expected 5 pipeline progress arguments, got %d", len(args))
+	}
+
+	var (
+		progress = PipelineProgress{ID: args[0], Stage: PipelineStage(args[1])}
+		eta      int64
+		err      error
+	)
+	if progress.Percent, err = strconv.ParseFloat(args[2], 64); err != nil {
+		return PipelineProgress{}, err
+	}
+	if progress.Rate, err = strconv.ParseFloat(args[3], 64); err != nil {
+		return PipelineProgress{}, err
+	}
+	if eta, err = strconv.ParseInt(args[4], 10, 64); err != nil {
+		return PipelineProgress{}, err
+	}
+	progress.ETA = time.Duration(eta)
+	return progress, nil
+}
+
+// PipelineStageChange is published when a pipeline enter a stage
+type PipelineStageChange struct {
+	ID    string
+	Stage PipelineStage
+}
+
+// PipelineResult is published when every file of a pipeline is processed
+type PipelineResult struct {
+	ID      string
+	Outputs []string // Only known by the typed subscribers
+}
+
+// PipelineFailure is published when a pipeline stage failed or was cancelled
+type PipelineFailure struct {
+	ID    string
+	Stage PipelineStage
+	Err   error
+}
+
+func encodePipelineProgress(p PipelineProgress) (*EventData, []string) {
+	return &EventData{Message: p.String()}, p.Args()
+}
+
+func decodePipelineProgress(data *EventData, args []string) (PipelineProgress, error) {
+	return PipelineProgressFromArgs(args)
+}
+
+func encodePipelineStage(c PipelineStageChange) (*EventData, []string) {
+	return &EventData{Message: string(c.Stage)}, []string{c.ID, string(c.Stage)}
+}
+
+func decodePipelineStage(data *EventData, args []string) (PipelineStageChange, error) {
+	if len(args) != 2 {
+		return PipelineStageChange{}, fmt.Errorf("expected 2 pipeline stage arguments, got %d", len(args))
+	}
+	return PipelineStageChange{ID: args[0], Stage: PipelineStage(args[1])}, nil
+}
+
+func encodePipelineResult(r PipelineResult) (*EventData, []string) {
+	return &EventData{Message: fmt.Sprintf("%d file(s) processed", len(r.Outputs))}, []string{r.ID, string(StageDone)}
+}
+
+func decodePipelineResult(data *EventData, args []string) (PipelineResult, error) {
+	if len(args) != 2 {
+		return PipelineResult{}, fmt.Errorf("expected 2 pipeline done arguments, got %d", len(args))
+	}
+	return PipelineResult{ID: args[0]}, nil
+}
+
+func encodePipelineFailure(f PipelineFailure) (*EventData, []string) {
+	return &EventData{Message: f.Err.Error()}, []string{f.ID, string(f.Stage)}
+}
+
+func decodePipelineFailure(data *EventData, args []string) (PipelineFailure, error) {
+	if len(args) != 2 {
+		return PipelineFailure{}, fmt.Errorf("expected 2 pipeline failure arguments, got %d", len(args))
+	}
+	return PipelineFailure{ID: args[0], Stage: PipelineStage(args[1]), Err: errors.New(data.Message)}, nil
+}
+
+// Estimate the remaining time from the elapsed time and the done percentage
+func estimateETA(elapsed time.Duration, percent float64) time.Duration {
+	if percent <= 0 || percent >= 100 {
+		return 0
+	}
+	return time.Duration(float64(elapsed) * (100 - percent) / percent)
+}
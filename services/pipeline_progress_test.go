@@ -0,0 +1,37 @@
+package services
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPipelineProgressArgs(t *testing.T) {
+	progress := PipelineProgress{
+		ID:      "abc",
+		Stage:   StageDownload,
+		Percent: 42.5,
+		Rate:    1024,
+		ETA:     3 * time.Second,
+	}
+
+	decoded, err := PipelineProgressFromArgs(progress.Args())
+	if err != nil {
+		t.Fatalf("decode error: %v", err)
+	}
+	if decoded != progress {
+		t.Errorf("expected %+v, got %+v", progress, decoded)
+	}
+
+	if _, err := PipelineProgressFromArgs([]string{"abc", "download"}); err == nil {
+		t.Error("expected an error for missing arguments")
+	}
+}
+
+func TestEstimateETA(t *testing.T) {
+	if eta := estimateETA(10*time.Second, 25); eta != 30*time.Second {
+		t.Errorf("expected 30s, got %s", eta)
+	}
+	if eta := estimateETA(10*time.Second, 0); eta != 0 {
+		t.Errorf("expected an unknown ETA without progress, got %s", eta)
+	}
+}
@@ -0,0 +1,182 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type fakeUploader struct {
+	mu       sync.Mutex
+	uploaded []string
+	captions []string
+	err      error
+}
+
+func (f *fakeUploader) Upload(chatID int64, path string, mediaType MediaType, caption string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return f.err
+	}
+	f.uploaded = append(f.uploaded, path)
+	f.captions = append(f.captions, caption)
+	return nil
+}
+
+func TestCollectMediaFiles(t *testing.T) {
+	dir := t.TempDir()
+	files := []string{
+		"show/episode_02.mkv",
+		"show/episode_01.mp4",
+		"show/sample.nfo",
+		"cover.jpg",
+		"theme.mp3",
+	}
+	for _, f := range files {
+		path := filepath.Join(dir, f)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	media, err := collectMediaFiles(dir)
+	if err != nil {
+		t.Fatalf("collectMediaFiles error: %v", err)
+	}
+
+	expected := []string{
+		filepath.Join(dir, "show/episode_01.mp4"),
+		filepath.Join(dir, "show/episode_02.mkv"),
+		filepath.Join(dir, "theme.mp3"),
+	}
+	if len(media) != len(expected) {
+		t.Fatalf("expected %d media files, got %d: %v", len(expected), len(media), media)
+	}
+	for i := range expected {
+		if media[i] != expected[i] {
+			t.Errorf("expected %s at index %d, got %s", expected[i], i, media[i])
+		}
+	}
+}
+
+func TestPipelineSelectMediaWithoutFiles(t *testing.T) {
+	p := NewPipeline("file.torrent", t.TempDir(), t.TempDir(), 0, nil)
+	if err := p.selectMedia(context.Background()); err == nil {
+		t.Error("expected an error when no media file is downloaded")
+	}
+}
+
+func TestPipelineUpload(t *testing.T) {
+	uploader := &fakeUploader{}
+	p := NewPipeline("file.torrent", t.TempDir(), t.TempDir(), 42, uploader)
+	p.Outputs = []string{"a_optimized.mp4", "b_optimized.m4a"}
+
+	if err := p.upload(context.Background()); err != nil {
+		t.Fatalf("upload error: %v", err)
+	}
+	if len(uploader.uploaded) != 2 {
+		t.Errorf("expected 2 uploads, got %d", len(uploader.uploaded))
+	}
+}
+
+func TestPipelineUploadPartCaptions(t *testing.T) {
+	uploader := &fakeUploader{}
+	p := NewPipeline("file.torrent", t.TempDir(), t.TempDir(), 42, uploader)
+	p.addOutputs("movie_optimized.mp4", []string{"movie_optimized_part001.mp4", "movie_optimized_part002.mp4"})
+	p.addOutputs("song_optimized.m4a", []string{"song_optimized.m4a"})
+
+	if err := p.upload(context.Background()); err != nil {
+		t.Fatalf("upload error: %v", err)
+	}
+	expected := []string{"movie_optimized.mp4 (part 1/2)", "movie_optimized.mp4 (part 2/2)", "song_optimized.m4a"}
+	if strings.Join(uploader.captions, "|") != strings.Join(expected, "|") {
+		t.Errorf("expected captions %q, got %q", expected, uploader.captions)
+	}
+}
+
+func TestPipelineCleanup(t *testing.T) {
+	root := t.TempDir()
+	downloadDir := filepath.Join(root, "downloads")
+	p := NewPipeline("file.torrent", downloadDir, filepath.Join(root, "optimized"), 42, &fakeUploader{})
+	os.MkdirAll(p.OutputDir, 0755)
+	os.MkdirAll(downloadDir, 0755)
+	for _, output := range []string{"a_optimized.mp4", "a_optimized.eng.srt"} {
+		p.Outputs = append(p.Outputs, filepath.Join(p.OutputDir, output))
+		os.WriteFile(p.Outputs[len(p.Outputs)-1], []byte("uploaded"), 0644)
+	}
+	os.WriteFile(filepath.Join(p.OutputDir, "other.mp4"), nil, 0644)
+
+	// Only the outputs are removed from the directories of other runs
+	p.cleanup()
+	for _, output := range p.Outputs {
+		if fileExists(output) {
+			t.Errorf("expected %s to be removed", output)
+		}
+	}
+	if !fileExists(filepath.Join(p.OutputDir, "other.mp4")) || !fileExists(downloadDir) {
+		t.Error("expected the shared directories to be kept")
+	}
+
+	p.OwnDirs = true
+	p.cleanup()
+	if fileExists(p.OutputDir) || fileExists(downloadDir) {
+		t.Error("expected the directories of the run to be removed")
+	}
+}
+
+func TestPipelineProfileMaxSize(t *testing.T) {
+	p := NewPipeline("file.torrent", t.TempDir(), t.TempDir(), 42, nil)
+	if profile := p.profile(nil, Video); profile.MaxSize != TelegramMaxUploadSize {
+		t.Errorf("expected the Telegram limit by default, got %q", profile.MaxSize)
+	}
+
+	p.MaxSize = LocalBotAPIMaxUploadSize
+	if profile := p.profile(nil, Audio); profile.MaxSize != LocalBotAPIMaxUploadSize {
+		t.Errorf("expected the pipeline max size, got %q", profile.MaxSize)
+	}
+	// Only the pipeline uploads are limited, the optimizer outputs are not split
+	if VideoMobileHigh.MaxSize != "" || AudioMobileLow.MaxSize != "" {
+		t.Error("expected the built-in profiles without max size")
+	}
+}
+
+func TestPipelineFailEmitsEvent(t *testing.T) {
+	// The failure report is written in ../report from the working directory
+	work := filepath.Join(t.TempDir(), "work")
+	if err := os.MkdirAll(work, 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Chdir(work)
+
+	p := NewPipeline("file.torrent", t.TempDir(), t.TempDir(), 0, nil)
+	p.Stage = StageUpload
+
+	var mu sync.Mutex
+	var received []string
+	sub := EventBus.On(PipelineFailedEvent, func(data *EventData, args ...string) {
+		mu.Lock()
+		defer mu.Unlock()
+		received = args
+	})
+	t.Cleanup(sub.Unsubscribe)
+
+	err := p.fail(context.Background(), errors.New("upload refused"))
+	EventBus.Wait()
+
+	if err == nil || !strings.Contains(err.Error(), "upload") {
+		t.Fatalf("expected a wrapped upload error, got %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received) < 2 || received[0] != p.ID || received[1] != string(StageUpload) {
+		t.Errorf("unexpected failed event arguments: %v", received)
+	}
+}
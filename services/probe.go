@@ -0,0 +1,263 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Stream types reported by ffprobe
+const (
+	VideoStream    = "video"
+	AudioStream    = "audio"
+	SubtitleStream = "subtitle"
+)
+
+// MediaInfo describe a media file as reported by ffprobe
+type MediaInfo struct {
+	Format    string // Container names like "mov,mp4,m4a,3gp,3g2,mj2"
+	Duration  time.Duration
+	BitRate   int64   // Overall bitrate in bit/s
+	Width     int     // Of the first video stream, 0 without video stream
+	Height    int     //
+	FrameRate float64 //
+	Title     string
+	Artist    string
+	Streams   []StreamInfo
+	Chapters  []Chapter
+}
+
+// StreamInfo describe one stream of a media file
+type StreamInfo struct {
+	Index     int
+	Type      string // VideoStream, AudioStream, SubtitleStream, "data"...
+	Codec     string
+	Language  string // ISO 639-2 code like "eng", empty when unknown
+	Title     string
+	Default   bool
+	CoverArt  bool // Embedded picture of an audio file, not a real video stream
+	Width     int
+	Height    int
+	PixFmt    string
+	FrameRate float64
+	BitRate   int64 // In bit/s, 0 when unknown
+	Channels  int
+	Duration  time.Duration
+}
+
+// Chapter of a media file
+type Chapter struct {
+	Start time.Duration
+	End   time.Duration
+	Title string
+}
+
+// Get the streams of a type, the cover arts are not reported as video streams
+func (i *MediaInfo) StreamsOf(streamType string) []StreamInfo {
+	var streams []StreamInfo
+	for _, stream := range i.Streams {
+		if stream.Type == streamType && !(streamType == VideoStream && stream.CoverArt) {
+			streams = append(streams, stream)
+		}
+	}
+	return streams
+}
+
+func (i *MediaInfo) HasVideo() bool {
+	return len(i.StreamsOf(VideoStream)) > 0
+}
+
+func (i *MediaInfo) HasAudio() bool {
+	return len(i.StreamsOf(AudioStream)) > 0
+}
+
+// Get the media type from the streams: a video stream make a video whatever the extension
+func (i *MediaInfo) MediaType() MediaType {
+	if i.HasVideo() {
+		return Video
+	}
+	return Audio
+}
+
+// Get the distinct languages of the streams of a type, in stream order
+func (i *MediaInfo) Languages(streamType string) []string {
+	var languages []string
+	seen := make(map[string]bool)
+	for _, stream := range i.StreamsOf(streamType) {
+		if stream.Language != "" && !seen[stream.Language] {
+			seen[stream.Language] = true
+			languages = append(languages, stream.Language)
+		}
+	}
+	return languages
+}
+
+// Subset of the ffprobe json output
+type ffprobeOutput struct {
+	Streams []struct {
+		Index        int               `json:"index"`
+		CodecType    string            `json:"codec_type"`
+		CodecName    string            `json:"codec_name"`
+		Width        int               `json:"width"`
+		Height       int               `json:"height"`
+		PixFmt       string            `json:"pix_fmt"`
+		AvgFrameRate string            `json:"avg_frame_rate"`
+		FrameRate    string            `json:"r_frame_rate"`
+		BitRate      string            `json:"bit_rate"`
+		Channels     int               `json:"channels"`
+		Duration     string            `json:"duration"`
+		Tags         map[string]string `json:"tags"`
+		Disposition  map[string]int    `json:"disposition"`
+	} `json:"streams"`
+	Format struct {
+		FormatName string            `json:"format_name"`
+		Duration   string            `json:"duration"`
+		BitRate    string            `json:"bit_rate"`
+		Tags       map[string]string `json:"tags"`
+	} `json:"format"`
+	Chapters []struct {
+		StartTime string            `json:"start_time"`
+		EndTime   string            `json:"end_time"`
+		Tags      map[string]string `json:"tags"`
+	} `json:"chapters"`
+}
+
+// Read the media information of a file with ffprobe
+func ProbeMedia(path string) (*MediaInfo, error) {
+	return ProbeMediaContext(context.Background(), path)
+}
+
+// Same as ProbeMedia but ffprobe is killed when the context is done
+func ProbeMediaContext(ctx context.Context, path string) (*MediaInfo, error) {
+	cmd := exec.CommandContext(ctx, "ffprobe", "-v", "quiet", "-print_format", "json", "-show_format", "-show_streams", "-show_chapters", path)
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("ffprobe error for %s : %v", path, err)
+	}
+	return parseProbeOutput(output)
+}
+
+func parseProbeOutput(output []byte) (*MediaInfo, error) {
+	var probe ffprobeOutput
+	if err := json.Unmarshal(output, &probe); err != nil {
+		return nil, fmt.Errorf("invalid ffprobe output : %v", err)
+	}
+
+	info := &MediaInfo{
+		Format:   probe.Format.FormatName,
+		Duration: parseSeconds(probe.Format.Duration),
+		BitRate:  parseInt(probe.Format.BitRate),
+		Title:    tag(probe.Format.Tags, "title"),
+		Artist:   tag(probe.Format.Tags, "artist"),
+	}
+
+	for _, s := range probe.Streams {
+		stream := StreamInfo{
+			Index:     s.Index,
+			Type:      s.CodecType,
+			Codec:     s.CodecName,
+			Language:  tag(s.Tags, "language"),
+			Title:     tag(s.Tags, "title"),
+			Default:   s.Disposition["default"] == 1,
+			CoverArt:  s.Disposition["attached_pic"] == 1,
+			Width:     s.Width,
+			Height:    s.Height,
+			PixFmt:    s.PixFmt,
+			BitRate:   parseInt(s.BitRate),
+			Channels:  s.Channels,
+			Duration:  parseSeconds(s.Duration),
+			FrameRate: parseFrameRate(s.AvgFrameRate),
+		}
+		if stream.Language == "und" {
+			stream.Language = ""
+		}
+		if stream.FrameRate == 0 {
+			stream.FrameRate = parseFrameRate(s.FrameRate)
+		}
+		info.Streams = append(info.Streams, stream)
+
+		if stream.Type == VideoStream && !stream.CoverArt && info.Width == 0 {
+			info.Width, info.Height, info.FrameRate = stream.Width, stream.Height, stream.FrameRate
+		}
+		if info.Duration == 0 {
+			info.Duration = stream.Duration
+		}
+	}
+
+	for _, c := range probe.Chapters {
+		info.Chapters = append(info.Chapters, Chapter{
+			Start: parseSeconds(c.StartTime),
+			End:   parseSeconds(c.EndTime),
+			Title: tag(c.Tags, "title"),
+		})
+	}
+	return info, nil
+}
+
+// Get a tag value, the tag names case depend on the container
+func tag(tags map[string]string, name string) string {
+	for key, value := range tags {
+		if strings.EqualFold(key, name) {
+			return value
+		}
+	}
+	return ""
+}
+
+func parseSeconds(value string) time.Duration {
+	seconds, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
+
+func parseInt(value string) int64 {
+	number, _ := strconv.ParseInt(value, 10, 64)
+	return number
+}
+
+// Parse a frame rate like "30000/1001", "0/0" is unknown
+func parseFrameRate(value string) float64 {
+	num, den, found := strings.Cut(value, "/")
+	if !found {
+		rate, _ := strconv.ParseFloat(value, 64)
+		return rate
+	}
+	n, errN := strconv.ParseFloat(num, 64)
+	d, errD := strconv.ParseFloat(den, 64)
+	if errN != nil || errD != nil || d == 0 {
+		return 0
+	}
+	return n / d
+}
+
+// Probe the file and get its media type from its streams.
+// The extension is used when ffprobe can't read the file.
+func inspectMedia(path string) (*MediaInfo, MediaType) {
+	info, err := ProbeMedia(path)
+	if err != nil || (!info.HasVideo() && !info.HasAudio()) {
+		return nil, detectMediaType(path)
+	}
+	return info, info.MediaType()
+}
+
+// Extract a frame of the video as a JPEG thumbnail fitting the Telegram limits (320px, 200KB)
+func ExtractThumbnail(videoPath, outputPath string, at time.Duration) error {
+	cmd := exec.Command("ffmpeg", "-y", "-v", "quiet",
+		"-ss", strconv.FormatFloat(at.Seconds(), 'f', 3, 64),
+		"-i", videoPath,
+		"-frames:v", "1",
+		"-vf", "scale=320:320:force_original_aspect_ratio=decrease",
+		"-q:v", "5",
+		outputPath,
+	)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("thumbnail extraction error for %s : %v", videoPath, err)
+	}
+	return nil
+}
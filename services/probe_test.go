@@ -0,0 +1,137 @@
+package services
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+const sampleProbeOutput = `{
+	"streams": [
+		{"index": 0, "codec_type": "video", "codec_name": "h264", "width": 1280, "height": 720,
+		 "avg_frame_rate": "30000/1001", "r_frame_rate": "30/1", "bit_rate": "2000000", "duration": "12.48",
+		 "disposition": {"default": 1, "attached_pic": 0}},
+		{"index": 1, "codec_type": "audio", "codec_name": "aac", "channels": 2, "bit_rate": "96000",
+		 "duration": "12.5", "tags": {"language": "eng"}, "disposition": {"default": 1}},
+		{"index": 2, "codec_type": "audio", "codec_name": "aac", "channels": 6, "tags": {"LANGUAGE": "fre", "title": "VF"}},
+		{"index": 3, "codec_type": "subtitle", "codec_name": "subrip", "tags": {"language": "eng"}},
+		{"index": 4, "codec_type": "subtitle", "codec_name": "subrip", "tags": {"language": "und"}}
+	],
+	"chapters": [
+		{"start_time": "0.000000", "end_time": "6.000000", "tags": {"title": "Intro"}},
+		{"start_time": "6.000000", "end_time": "12.500000", "tags": {"title": "Episode"}}
+	],
+	"format": {"format_name": "matroska,webm", "duration": "12.500000", "bit_rate": "2200000",
+	           "tags": {"TITLE": "Pilot", "artist": "Ghost"}}
+}`
+
+func TestParseProbeOutput(t *testing.T) {
+	info, err := parseProbeOutput([]byte(sampleProbeOutput))
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	if info.Format != "matroska,webm" || info.Duration != 12500*time.Millisecond || info.BitRate != 2200000 {
+		t.Errorf("unexpected format info: %s %s %d", info.Format, info.Duration, info.BitRate)
+	}
+	if info.Width != 1280 || info.Height != 720 || info.FrameRate < 29.97 || info.FrameRate > 29.98 {
+		t.Errorf("unexpected video info: %dx%d %.3f fps", info.Width, info.Height, info.FrameRate)
+	}
+	if info.Title != "Pilot" || info.Artist != "Ghost" {
+		t.Errorf("unexpected tags: %q %q", info.Title, info.Artist)
+	}
+	if len(info.Streams) != 5 {
+		t.Fatalf("expected 5 streams, got %d", len(info.Streams))
+	}
+	if audio := info.Streams[2]; audio.Codec != "aac" || audio.Channels != 6 || audio.Language != "fre" || audio.Title != "VF" || audio.Default {
+		t.Errorf("unexpected audio stream: %+v", audio)
+	}
+	if info.Streams[1].BitRate != 96000 || !info.Streams[1].Default {
+		t.Errorf("unexpected audio stream: %+v", info.Streams[1])
+	}
+	if len(info.Chapters) != 2 || info.Chapters[1].Title != "Episode" || info.Chapters[1].Start != 6*time.Second {
+		t.Errorf("unexpected chapters: %+v", info.Chapters)
+	}
+
+	if languages := info.Languages(AudioStream); strings.Join(languages, ",") != "eng,fre" {
+		t.Errorf("unexpected audio languages: %v", languages)
+	}
+	if languages := info.Languages(SubtitleStream); strings.Join(languages, ",") != "eng" {
+		t.Errorf("expected the undefined language ignored, got %v", languages)
+	}
+	if info.MediaType() != Video {
+		t.Error("expected a video")
+	}
+
+	if _, err := parseProbeOutput([]byte("not json")); err == nil {
+		t.Error("expected an error for an invalid output")
+	}
+}
+
+func TestMediaTypeFromStreams(t *testing.T) {
+	// An audio only .mkv and a .mp3 with its cover art are audio files
+	audioOnly := &MediaInfo{Streams: []StreamInfo{{Type: AudioStream}}}
+	coverArt := &MediaInfo{Streams: []StreamInfo{{Type: AudioStream}, {Type: VideoStream, Codec: "mjpeg", CoverArt: true}}}
+	video := &MediaInfo{Streams: []StreamInfo{{Type: VideoStream}}}
+
+	if audioOnly.MediaType() != Audio || coverArt.MediaType() != Audio || video.MediaType() != Video {
+		t.Error("unexpected media type detection")
+	}
+	if coverArt.HasVideo() || !coverArt.HasAudio() {
+		t.Error("expected the cover art ignored")
+	}
+}
+
+func TestParseFrameRate(t *testing.T) {
+	tests := map[string]float64{"25/1": 25, "24000/1001": 24000.0 / 1001, "0/0": 0, "": 0, "50": 50}
+	for value, expected := range tests {
+		if rate := parseFrameRate(value); rate != expected {
+			t.Errorf("parseFrameRate(%q) = %f, expected %f", value, rate, expected)
+		}
+	}
+}
+
+func TestPickProfile(t *testing.T) {
+	// Without probe the quality profile is used
+	if profile := pickProfile(nil, Video, "ultra"); profile.Name != VideoMobileUltra.Name {
+		t.Errorf("expected the ultra profile, got %s", profile.Name)
+	}
+
+	// A 480p source is not upscaled to 720p
+	sd := &MediaInfo{Height: 480, Streams: []StreamInfo{{Type: VideoStream, Height: 480}}}
+	if profile := pickProfile(sd, Video, "ultra"); profile.Name != VideoMobileHigh.Name {
+		t.Errorf("expected the high profile for a 480p source, got %s", profile.Name)
+	}
+
+	// A source smaller than every profile keep its resolution
+	tiny := &MediaInfo{Height: 240, Streams: []StreamInfo{{Type: VideoStream, Height: 240}}}
+	if profile := pickProfile(tiny, Video, "high"); profile.Name != VideoMobileLow.Name || profile.Resolution != "" {
+		t.Errorf("expected the low profile without resolution, got %s %q", profile.Name, profile.Resolution)
+	}
+
+	// A 64k audio is not encoded at 128k
+	podcast := &MediaInfo{BitRate: 64000, Streams: []StreamInfo{{Type: AudioStream}}}
+	if profile := pickProfile(podcast, Audio, "high"); profile.AudioBitrate != "64k" {
+		t.Errorf("expected the source audio bitrate, got %s", profile.AudioBitrate)
+	}
+
+	// The profiles themselves are left untouched
+	if VideoMobileLow.Resolution == "" || AudioMobileHigh.AudioBitrate != "128k" {
+		t.Error("expected the default profiles unchanged")
+	}
+}
+
+func TestMediaOutputPath(t *testing.T) {
+	if path := mediaOutputPath("/in/album.mkv", "/out", Audio); path != "/out/album_optimized.m4a" {
+		t.Errorf("expected an audio output for an audio only mkv, got %s", path)
+	}
+	if path := mediaOutputPath("/in/clip.bin", "/out", Video); path != "/out/clip_optimized.mp4" {
+		t.Errorf("expected a video output, got %s", path)
+	}
+}
+
+func TestProbeMediaMissingFile(t *testing.T) {
+	if _, err := ProbeMedia("missing.mp4"); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
@@ -0,0 +1,320 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Environment variables of the subtitles handling of the pipeline jobs
+const (
+	SubtitleModeEnv      = "SUBTITLE_MODE"      // "burn" or "extract"
+	SubtitleLanguagesEnv = "SUBTITLE_LANGUAGES" // Preferred languages like "fre,eng"
+)
+
+// SubtitleMode select what is done with the picked subtitle track
+type SubtitleMode string
+
+const (
+	SubtitlesOff     SubtitleMode = ""
+	SubtitlesExtract SubtitleMode = "extract" // Converted to a file sent alongside the video
+	SubtitlesBurn    SubtitleMode = "burn"    // Drawn into the video, Telegram has no soft subtitles
+)
+
+// SubtitleOptions select and handle a subtitle track of the input
+type SubtitleOptions struct {
+	Mode      SubtitleMode
+	Languages []string // Preferred languages in order like "fre" or "en", the default track when empty
+	Format    string   // "srt" or "vtt" for the extracted subtitles, srt by default
+}
+
+// SubtitleTrack is a subtitle stream of the input or an external subtitle file
+type SubtitleTrack struct {
+	Path     string // External file, empty for a stream of the input
+	Stream   int    // Index among the subtitle streams of the input
+	Language string // ISO 639-2 code, empty when unknown
+	Codec    string
+	Title    string
+	Default  bool
+}
+
+var subtitleExts = []string{".srt", ".ass", ".ssa", ".vtt"}
+
+// Picture based subtitles can't be converted to text nor burned with the subtitles filter
+var bitmapSubtitleCodecs = []string{"hdmv_pgs_subtitle", "dvd_subtitle", "dvb_subtitle", "xsub"}
+
+// Folders where the torrents usually put the subtitle files
+var subtitleDirs = []string{"subs", "subtitles", "sub"}
+
+// Read the subtitle options of the pipeline jobs from the environment
+func SubtitleOptionsFromEnv() SubtitleOptions {
+	options := SubtitleOptions{Mode: SubtitleMode(strings.ToLower(os.Getenv(SubtitleModeEnv)))}
+	for _, language := range strings.Split(os.Getenv(SubtitleLanguagesEnv), ",") {
+		if language = strings.TrimSpace(language); language != "" {
+			options.Languages = append(options.Languages, language)
+		}
+	}
+	return options
+}
+
+// Find the text subtitle streams of the input then the external subtitle files
+// next to it: files named like the input or inside a Subs folder
+func FindSubtitles(inputPath string, info *MediaInfo) []SubtitleTrack {
+	var tracks []SubtitleTrack
+	if info != nil {
+		for i, stream := range info.StreamsOf(SubtitleStream) {
+			if containsString(bitmapSubtitleCodecs, stream.Codec) {
+				continue
+			}
+			tracks = append(tracks, SubtitleTrack{
+				Stream:   i,
+				Language: NormalizeLanguage(stream.Language),
+				Codec:    stream.Codec,
+				Title:    stream.Title,
+				Default:  stream.Default,
+			})
+		}
+	}
+	return append(tracks, externalSubtitles(inputPath)...)
+}
+
+func externalSubtitles(inputPath string) []SubtitleTrack {
+	dir := filepath.Dir(inputPath)
+	base := strings.TrimSuffix(filepath.Base(inputPath), filepath.Ext(inputPath))
+
+	var tracks []SubtitleTrack
+	add := func(path string) {
+		tracks = append(tracks, SubtitleTrack{
+			Path:     path,
+			Language: languageFromName(filepath.Base(path), base),
+			Codec:    strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), "."),
+		})
+	}
+
+	entries, _ := os.ReadDir(dir)
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() {
+			if !containsString(subtitleDirs, strings.ToLower(name)) {
+				continue
+			}
+			// Subs/<input name>*.srt, or Subs/<input name>/*.srt for the season packs,
+			// the other files of the folder belong to the other episodes
+			files, _ := os.ReadDir(filepath.Join(dir, name))
+			for _, file := range files {
+				if !file.IsDir() && isSubtitleFile(file.Name()) && hasNamePrefix(file.Name(), base) {
+					add(filepath.Join(dir, name, file.Name()))
+				}
+			}
+			files, _ = os.ReadDir(filepath.Join(dir, name, base))
+			for _, file := range files {
+				if !file.IsDir() && isSubtitleFile(file.Name()) {
+					add(filepath.Join(dir, name, base, file.Name()))
+				}
+			}
+			continue
+		}
+		if isSubtitleFile(name) && hasNamePrefix(name, base) {
+			add(filepath.Join(dir, name))
+		}
+	}
+	return tracks
+}
+
+func hasNamePrefix(name, base string) bool {
+	return strings.HasPrefix(strings.ToLower(name), strings.ToLower(base))
+}
+
+// Pick the first track of the preferred languages in order.
+// Without language the default track is picked.
+func PickSubtitle(tracks []SubtitleTrack, languages []string) (SubtitleTrack, bool) {
+	for _, language := range languages {
+		language = NormalizeLanguage(language)
+		for _, track := range tracks {
+			if track.Language == language {
+				return track, true
+			}
+		}
+	}
+	if len(languages) == 0 {
+		for _, track := range tracks {
+			if track.Default {
+				return track, true
+			}
+		}
+	}
+	return SubtitleTrack{}, false
+}
+
+// Extract or convert the track to the output file, the format follow the output extension
+func ConvertSubtitle(ctx context.Context, inputPath string, track SubtitleTrack, outputPath string) error {
+	args := []string{"-y", "-v", "error"}
+	if track.Path != "" {
+		args = append(args, "-i", track.Path)
+	} else {
+		args = append(args, "-i", inputPath, "-map", "0:s:"+strconv.Itoa(track.Stream))
+	}
+	args = append(args, outputPath)
+
+	if output, err := exec.CommandContext(ctx, "ffmpeg", args...).CombinedOutput(); err != nil {
+		os.Remove(outputPath)
+		return fmt.Errorf("subtitle conversion error for %s : %v %s", outputPath, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// Get the subtitle track selected by the options, if any
+func (m *MediaOptimizer) pickSubtitle() (SubtitleTrack, bool) {
+	if m.Subtitles.Mode == SubtitlesOff || m.MediaType != Video {
+		return SubtitleTrack{}, false
+	}
+	return PickSubtitle(FindSubtitles(m.InputPath, m.Info), m.Subtitles.Languages)
+}
+
+// Convert the track to a temporary file read by the subtitles filter.
+// The ASS styling is kept, the other formats become SRT.
+func (m *MediaOptimizer) prepareBurn(ctx context.Context, track SubtitleTrack) (string, error) {
+	ext := ".srt"
+	if track.Codec == "ass" || track.Codec == "ssa" {
+		ext = ".ass"
+	}
+	tmp, err := os.CreateTemp("", "ghostify-subtitle-*"+ext)
+	if err != nil {
+		return "", err
+	}
+	tmp.Close()
+
+	if err := ConvertSubtitle(ctx, m.InputPath, track, tmp.Name()); err != nil {
+		return "", err
+	}
+	return tmp.Name(), nil
+}
+
+// Write the track next to the output as movie_optimized.<lang>.srt
+func (m *MediaOptimizer) extractSubtitle(ctx context.Context, track SubtitleTrack) {
+	format := strings.TrimPrefix(strings.ToLower(m.Subtitles.Format), ".")
+	if format != "vtt" {
+		format = "srt"
+	}
+	name := strings.TrimSuffix(m.OutputPath, filepath.Ext(m.OutputPath))
+	if track.Language != "" {
+		name += "." + track.Language
+	}
+
+	output := name + "." + format
+	if err := ConvertSubtitle(ctx, m.InputPath, track, output); err != nil {
+		// The video is still worth sending without its subtitles
+		log.Printf("media optimizer: %v", err)
+		return
+	}
+	m.SubtitleFiles = append(m.SubtitleFiles, output)
+}
+
+// Caption of an extracted subtitle like "movie_optimized.mp4 (eng subtitles)"
+func subtitleCaption(output, subtitle string) string {
+	language := strings.TrimPrefix(filepath.Ext(strings.TrimSuffix(subtitle, filepath.Ext(subtitle))), ".")
+	if NormalizeLanguage(language) == "" {
+		return fmt.Sprintf("%s (subtitles)", filepath.Base(output))
+	}
+	return fmt.Sprintf("%s (%s subtitles)", filepath.Base(output), language)
+}
+
+// Escape a filter option value for the filtergraph parser
+func escapeFilterValue(value string) string {
+	// The option value level, then the filtergraph level
+	value = escapeChars(value, `\':`)
+	return escapeChars(value, `\'[],;`)
+}
+
+func escapeChars(value, chars string) string {
+	var escaped strings.Builder
+	for _, r := range value {
+		if strings.ContainsRune(chars, r) {
+			escaped.WriteByte('\\')
+		}
+		escaped.WriteRune(r)
+	}
+	return escaped.String()
+}
+
+func isSubtitleFile(path string) bool {
+	return containsString(subtitleExts, strings.ToLower(filepath.Ext(path)))
+}
+
+// Guess the language of an external subtitle from its name like "Movie.en.srt" or "2_English.srt"
+func languageFromName(name, base string) string {
+	name = strings.TrimSuffix(name, filepath.Ext(name))
+	if strings.HasPrefix(strings.ToLower(name), strings.ToLower(base)) {
+		name = name[len(base):]
+	}
+	tokens := strings.FieldsFunc(name, func(r rune) bool {
+		return r == '.' || r == '_' || r == '-' || r == ' ' || r == '(' || r == ')' || r == '[' || r == ']'
+	})
+	for i := len(tokens) - 1; i >= 0; i-- {
+		if containsString(subtitleMarkers, strings.ToLower(tokens[i])) {
+			continue
+		}
+		if language := NormalizeLanguage(tokens[i]); language != "" {
+			return language
+		}
+	}
+	return ""
+}
+
+// Language codes and names of the usual torrent subtitles
+var languageCodes = map[string][]string{
+	"eng": {"en", "eng", "english"},
+	"fre": {"fr", "fre", "fra", "french", "francais", "vf", "vff"},
+	"spa": {"es", "spa", "spanish", "espanol"},
+	"ger": {"de", "ger", "deu", "german", "deutsch"},
+	"ita": {"it", "ita", "italian"},
+	"por": {"pt", "por", "portuguese", "pt-br", "brazilian"},
+	"rus": {"ru", "rus", "russian"},
+	"ara": {"ar", "ara", "arabic"},
+	"jpn": {"ja", "jpn", "japanese"},
+	"kor": {"ko", "kor", "korean"},
+	"chi": {"zh", "chi", "zho", "chinese"},
+	"dut": {"nl", "dut", "nld", "dutch"},
+}
+
+// The other ISO 639-2 codes kept as they are
+var isoLanguageCodes = []string{
+	"afr", "alb", "sqi", "amh", "arm", "hye", "aze", "baq", "eus", "bel", "ben", "bos", "bul", "bur", "mya",
+	"cat", "cze", "ces", "dan", "est", "fil", "fin", "geo", "kat", "gle", "glg", "gre", "ell", "guj", "heb",
+	"hin", "hrv", "hun", "ice", "isl", "ind", "kan", "kaz", "khm", "kur", "lao", "lat", "lav", "lit", "mac",
+	"mkd", "mal", "mar", "may", "msa", "mon", "nep", "nob", "nno", "nor", "per", "fas", "pol", "pan", "rum",
+	"ron", "slo", "slk", "slv", "som", "srp", "swa", "swe", "tam", "tel", "tgl", "tha", "tur", "ukr", "urd",
+	"uzb", "vie", "wel", "cym", "yid", "zul",
+}
+
+// Tokens of the subtitle file names which are not a language
+var subtitleMarkers = []string{"sdh", "forced", "cc", "hi", "full", "default"}
+
+// Normalize a language code or name to its ISO 639-2/B code.
+// Unknown values give an empty string.
+func NormalizeLanguage(language string) string {
+	language = strings.ToLower(strings.TrimSpace(language))
+	for code, aliases := range languageCodes {
+		if containsString(aliases, language) {
+			return code
+		}
+	}
+	if containsString(isoLanguageCodes, language) {
+		return language
+	}
+	return ""
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
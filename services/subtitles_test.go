@@ -0,0 +1,146 @@
+package services
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNormalizeLanguage(t *testing.T) {
+	tests := map[string]string{
+		"en":      "eng",
+		"English": "eng",
+		"fra":     "fre",
+		"VFF":     "fre",
+		"pt-BR":   "por",
+		"swe":     "swe",
+		"und":     "",
+		"sdh":     "",
+		"forced":  "",
+		"":        "",
+	}
+	for language, expected := range tests {
+		if got := NormalizeLanguage(language); got != expected {
+			t.Errorf("NormalizeLanguage(%q) = %q, expected %q", language, got, expected)
+		}
+	}
+}
+
+func TestLanguageFromName(t *testing.T) {
+	tests := map[string]string{
+		"Movie.2020.en.srt":          "eng",
+		"Movie.2020.srt":             "",
+		"2_English.srt":              "eng",
+		"Movie.2020.fr.ass":          "fre",
+		"[French] Movie.vtt":         "fre",
+		"Movie.2020.English.SDH.srt": "eng",
+		"Movie.2020.fr.forced.srt":   "fre",
+	}
+	for name, expected := range tests {
+		if got := languageFromName(name, "Movie.2020"); got != expected {
+			t.Errorf("languageFromName(%q) = %q, expected %q", name, got, expected)
+		}
+	}
+}
+
+func TestFindSubtitles(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "Movie.2020.mkv")
+	for _, name := range []string{
+		"Movie.2020.mkv",
+		"Movie.2020.en.srt",
+		"Other.fr.srt",
+		"Movie.2020.nfo",
+		filepath.Join("Subs", "Movie.2020.French.srt"),
+		filepath.Join("Subs", "Other.Italian.srt"),
+		filepath.Join("Subs", "Movie.2020", "2_Spanish.ass"),
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("1"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	info := &MediaInfo{Streams: []StreamInfo{
+		{Type: VideoStream, Codec: "h264"},
+		{Type: SubtitleStream, Codec: "hdmv_pgs_subtitle", Language: "eng"},
+		{Type: SubtitleStream, Codec: "subrip", Language: "ger", Default: true},
+	}}
+
+	tracks := FindSubtitles(input, info)
+	languages := map[string]SubtitleTrack{}
+	for _, track := range tracks {
+		languages[track.Language] = track
+	}
+	if len(tracks) != 4 {
+		t.Fatalf("expected 4 tracks, got %+v", tracks)
+	}
+	if embedded := languages["ger"]; embedded.Path != "" || embedded.Stream != 1 || !embedded.Default {
+		t.Errorf("expected the second embedded stream, got %+v", embedded)
+	}
+	if external := languages["eng"]; external.Path != filepath.Join(dir, "Movie.2020.en.srt") || external.Codec != "srt" {
+		t.Errorf("expected the external english file, got %+v", external)
+	}
+	if _, ok := languages["fre"]; !ok {
+		t.Error("expected the french file of the Subs folder")
+	}
+	if spanish := languages["spa"]; spanish.Codec != "ass" {
+		t.Errorf("expected the spanish file of the season pack folder, got %+v", spanish)
+	}
+}
+
+func TestPickSubtitle(t *testing.T) {
+	tracks := []SubtitleTrack{
+		{Stream: 0, Language: "eng"},
+		{Stream: 1, Language: "fre", Default: true},
+		{Path: "movie.es.srt", Language: "spa"},
+	}
+
+	if track, ok := PickSubtitle(tracks, []string{"de", "es", "fr"}); !ok || track.Language != "spa" {
+		t.Errorf("expected the first available language, got %+v", track)
+	}
+	if track, ok := PickSubtitle(tracks, nil); !ok || track.Stream != 1 {
+		t.Errorf("expected the default track, got %+v", track)
+	}
+	if _, ok := PickSubtitle(tracks, []string{"jpn"}); ok {
+		t.Error("expected no track for a missing language")
+	}
+}
+
+func TestEscapeFilterValue(t *testing.T) {
+	value := escapeFilterValue(`/tmp/it's [1]:a.srt`)
+	expected := `/tmp/it\\\'s \[1\]\\:a.srt`
+	if value != expected {
+		t.Errorf("escapeFilterValue = %s, expected %s", value, expected)
+	}
+}
+
+func TestSubtitleCaption(t *testing.T) {
+	if caption := subtitleCaption("out/movie_optimized.mp4", "out/movie_optimized.eng.srt"); caption != "movie_optimized.mp4 (eng subtitles)" {
+		t.Errorf("unexpected caption %q", caption)
+	}
+	if caption := subtitleCaption("out/movie_optimized.mp4", "out/movie_optimized.vtt"); caption != "movie_optimized.mp4 (subtitles)" {
+		t.Errorf("unexpected caption %q", caption)
+	}
+}
+
+func TestSubtitleOptionsFromEnv(t *testing.T) {
+	t.Setenv(SubtitleModeEnv, "Burn")
+	t.Setenv(SubtitleLanguagesEnv, "fre, eng,")
+
+	options := SubtitleOptionsFromEnv()
+	if options.Mode != SubtitlesBurn || len(options.Languages) != 2 || options.Languages[1] != "eng" {
+		t.Errorf("unexpected options %+v", options)
+	}
+}
+
+func TestDetectSubtitleMediaType(t *testing.T) {
+	if detectMediaType("movie.en.SRT") != Subtitle {
+		t.Error("expected a subtitle media type")
+	}
+	if isMediaFile("movie.srt") {
+		t.Error("subtitles are not transcoded media files")
+	}
+}
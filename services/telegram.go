@@ -0,0 +1,176 @@
+package services
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Environment variable of the channel receiving every upload, e.g. "@mychannel" or "-100123"
+const ChannelIDEnv = "TELEGRAM_CHANNEL_ID"
+
+// Environment variable overriding the max size of the uploaded files,
+// e.g. LocalBotAPIMaxUploadSize with a local Bot API server
+const MaxUploadSizeEnv = "TELEGRAM_MAX_UPLOAD_SIZE"
+
+// MediaUploader send a processed media file to a chat
+type MediaUploader interface {
+	Upload(chatID int64, path string, mediaType MediaType, caption string) error
+}
+
+// TelegramUploader upload media files through the Telegram Bot API
+type TelegramUploader struct {
+	Bot *tgbotapi.BotAPI
+	// Channel receiving the uploads instead of the requesting chat when set
+	ChannelID string
+	// Metadata and thumbnail sources, ffprobe and ffmpeg by default
+	Probe     func(path string) (*MediaInfo, error)
+	Thumbnail func(videoPath, outputPath string, at time.Duration) error
+}
+
+// Create a new Telegram uploader based on the provided bot client.
+// The uploads target the TELEGRAM_CHANNEL_ID channel when the variable is set.
+func NewTelegramUploader(bot *tgbotapi.BotAPI) *TelegramUploader {
+	return &TelegramUploader{
+		Bot:       bot,
+		ChannelID: os.Getenv(ChannelIDEnv),
+		Probe:     ProbeMedia,
+		Thumbnail: ExtractThumbnail,
+	}
+}
+
+// Upload the file as a streamable video, an audio or a document for the subtitles
+// and the audio formats Telegram can't play.
+// The duration, resolution, title and performer are read from the file when possible.
+func (u *TelegramUploader) Upload(chatID int64, path string, mediaType MediaType, caption string) error {
+	if u.Bot == nil {
+		return fmt.Errorf("telegram uploader has no bot client")
+	}
+
+	var err error
+	switch mediaType {
+	case Video:
+		err = u.uploadVideo(chatID, path, caption, u.probe(path))
+	case Subtitle:
+		err = u.uploadDocument(chatID, path, caption)
+	default:
+		if isTelegramAudio(path) {
+			err = u.uploadAudio(chatID, path, caption, u.probe(path))
+		} else {
+			err = u.uploadDocument(chatID, path, caption)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("error during the telegram upload of %s : %v", path, err)
+	}
+	return nil
+}
+
+// tgbotapi.VideoConfig has no width and height, the request is built by hand
+func (u *TelegramUploader) uploadVideo(chatID int64, path, caption string, info *MediaInfo) error {
+	params := make(tgbotapi.Params)
+	u.addTarget(params, chatID)
+	params.AddNonZero("duration", int(info.Duration.Seconds()))
+	params.AddNonZero("width", info.Width)
+	params.AddNonZero("height", info.Height)
+	params.AddNonEmpty("caption", caption)
+	params.AddBool("supports_streaming", true)
+
+	files := []tgbotapi.RequestFile{{Name: "video", Data: tgbotapi.FilePath(path)}}
+	// A frame past the intro is more representative than the first one
+	if thumbnail := u.thumbnail(path, info.Duration/10); thumbnail != "" {
+		defer os.Remove(thumbnail)
+		files = append(files, tgbotapi.RequestFile{Name: "thumbnail", Data: tgbotapi.FilePath(thumbnail)})
+	}
+
+	_, err := u.Bot.UploadFiles("sendVideo", params, files)
+	return err
+}
+
+// Telegram only show the audio player for the mp3 and m4a files, the other
+// ones are displayed as documents
+func isTelegramAudio(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".mp3" || ext == ".m4a"
+}
+
+func (u *TelegramUploader) uploadAudio(chatID int64, path, caption string, info *MediaInfo) error {
+	audio := tgbotapi.NewAudio(chatID, tgbotapi.FilePath(path))
+	audio.ChatID, audio.ChannelUsername = u.target(chatID)
+	audio.Caption = caption
+	audio.Duration = int(info.Duration.Seconds())
+	audio.Performer = info.Artist
+	audio.Title = info.Title
+	if audio.Title == "" {
+		audio.Title = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+
+	_, err := u.Bot.Send(audio)
+	return err
+}
+
+func (u *TelegramUploader) uploadDocument(chatID int64, path, caption string) error {
+	document := tgbotapi.NewDocument(chatID, tgbotapi.FilePath(path))
+	document.ChatID, document.ChannelUsername = u.target(chatID)
+	document.Caption = caption
+
+	_, err := u.Bot.Send(document)
+	return err
+}
+
+// Get the chat ID or the channel username receiving the upload
+func (u *TelegramUploader) target(chatID int64) (int64, string) {
+	if u.ChannelID == "" {
+		return chatID, ""
+	}
+	if id, err := strconv.ParseInt(u.ChannelID, 10, 64); err == nil {
+		return id, ""
+	}
+	return 0, u.ChannelID
+}
+
+func (u *TelegramUploader) addTarget(params tgbotapi.Params, chatID int64) {
+	if id, username := u.target(chatID); username != "" {
+		params["chat_id"] = username
+	} else {
+		params.AddNonZero64("chat_id", id)
+	}
+}
+
+// Read the file metadata, an upload without metadata is still playable
+func (u *TelegramUploader) probe(path string) *MediaInfo {
+	if u.Probe == nil {
+		return &MediaInfo{}
+	}
+	info, err := u.Probe(path)
+	if err != nil {
+		log.Printf("telegram uploader: metadata unavailable for %s: %v", path, err)
+		return &MediaInfo{}
+	}
+	return info
+}
+
+// Extract a temporary thumbnail, an empty path is returned on failure
+func (u *TelegramUploader) thumbnail(videoPath string, at time.Duration) string {
+	if u.Thumbnail == nil {
+		return ""
+	}
+	tmp, err := os.CreateTemp("", "ghostify-thumb-*.jpg")
+	if err != nil {
+		return ""
+	}
+	tmp.Close()
+
+	if err := u.Thumbnail(videoPath, tmp.Name(), at); err != nil {
+		log.Printf("telegram uploader: %v", err)
+		os.Remove(tmp.Name())
+		return ""
+	}
+	return tmp.Name()
+}
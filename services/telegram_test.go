@@ -0,0 +1,189 @@
+package services
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// uploadRequest is a multipart request received by the fake Bot API
+type uploadRequest struct {
+	method string
+	params map[string]string
+	files  []string
+}
+
+// Start a fake Bot API recording the upload requests
+func newTestBotAPI(t *testing.T) (*tgbotapi.BotAPI, func() []uploadRequest) {
+	var (
+		mu       sync.Mutex
+		requests []uploadRequest
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+		w.Header().Set("Content-Type", "application/json")
+		if method == "getMe" {
+			w.Write([]byte(`{"ok":true,"result":{"id":1,"is_bot":true,"username":"ghostify"}}`))
+			return
+		}
+
+		request := uploadRequest{method: method, params: map[string]string{}}
+		if err := r.ParseMultipartForm(10 << 20); err == nil {
+			for key, values := range r.MultipartForm.Value {
+				request.params[key] = values[0]
+			}
+			for name := range r.MultipartForm.File {
+				request.files = append(request.files, name)
+			}
+		}
+		mu.Lock()
+		requests = append(requests, request)
+		mu.Unlock()
+		w.Write([]byte(`{"ok":true,"result":{"message_id":1,"date":0,"chat":{"id":1}}}`))
+	}))
+	t.Cleanup(server.Close)
+
+	bot, err := tgbotapi.NewBotAPIWithAPIEndpoint("token", server.URL+"/bot%s/%s")
+	if err != nil {
+		t.Fatalf("bot creation error: %v", err)
+	}
+	return bot, func() []uploadRequest {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]uploadRequest(nil), requests...)
+	}
+}
+
+func writeTestMedia(t *testing.T, name string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte("media"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestTelegramUploaderVideo(t *testing.T) {
+	bot, requests := newTestBotAPI(t)
+	uploader := NewTelegramUploader(bot)
+	uploader.ChannelID = "@ghostify"
+	uploader.Probe = func(path string) (*MediaInfo, error) {
+		return &MediaInfo{Duration: 90 * time.Second, Width: 1280, Height: 720}, nil
+	}
+	var thumbnailAt time.Duration
+	uploader.Thumbnail = func(videoPath, outputPath string, at time.Duration) error {
+		thumbnailAt = at
+		return os.WriteFile(outputPath, []byte("jpeg"), 0644)
+	}
+
+	if err := uploader.Upload(42, writeTestMedia(t, "episode.mp4"), Video, "episode"); err != nil {
+		t.Fatalf("upload error: %v", err)
+	}
+
+	sent := requests()
+	if len(sent) != 1 || sent[0].method != "sendVideo" {
+		t.Fatalf("expected a sendVideo request, got %+v", sent)
+	}
+	expected := map[string]string{
+		"chat_id":            "@ghostify",
+		"duration":           "90",
+		"width":              "1280",
+		"height":             "720",
+		"caption":            "episode",
+		"supports_streaming": "true",
+	}
+	for key, value := range expected {
+		if sent[0].params[key] != value {
+			t.Errorf("param %s = %q, expected %q", key, sent[0].params[key], value)
+		}
+	}
+	if len(sent[0].files) != 2 {
+		t.Errorf("expected the video and its thumbnail, got %v", sent[0].files)
+	}
+	if thumbnailAt != 9*time.Second {
+		t.Errorf("expected the thumbnail at 10%% of the duration, got %s", thumbnailAt)
+	}
+}
+
+func TestTelegramUploaderAudio(t *testing.T) {
+	bot, requests := newTestBotAPI(t)
+	uploader := NewTelegramUploader(bot)
+	uploader.ChannelID = ""
+	uploader.Probe = func(path string) (*MediaInfo, error) {
+		return &MediaInfo{Duration: 200 * time.Second, Artist: "Ghost"}, nil
+	}
+
+	if err := uploader.Upload(42, writeTestMedia(t, "theme_optimized.m4a"), Audio, "theme"); err != nil {
+		t.Fatalf("upload error: %v", err)
+	}
+
+	sent := requests()
+	if len(sent) != 1 || sent[0].method != "sendAudio" {
+		t.Fatalf("expected a sendAudio request, got %+v", sent)
+	}
+	expected := map[string]string{
+		"chat_id":   "42",
+		"duration":  "200",
+		"performer": "Ghost",
+		"title":     "theme_optimized",
+	}
+	for key, value := range expected {
+		if sent[0].params[key] != value {
+			t.Errorf("param %s = %q, expected %q", key, sent[0].params[key], value)
+		}
+	}
+}
+
+func TestTelegramUploaderUnplayableAudio(t *testing.T) {
+	bot, requests := newTestBotAPI(t)
+	uploader := NewTelegramUploader(bot)
+	uploader.ChannelID = ""
+
+	// Telegram show a raw ADTS stream as a document anyway
+	if err := uploader.Upload(42, writeTestMedia(t, "theme.aac"), Audio, "theme"); err != nil {
+		t.Fatalf("upload error: %v", err)
+	}
+	if sent := requests(); len(sent) != 1 || sent[0].method != "sendDocument" {
+		t.Errorf("expected a sendDocument request, got %+v", sent)
+	}
+}
+
+func TestTelegramUploaderSubtitle(t *testing.T) {
+	bot, requests := newTestBotAPI(t)
+	uploader := NewTelegramUploader(bot)
+	uploader.ChannelID = ""
+	uploader.Probe = func(path string) (*MediaInfo, error) {
+		t.Errorf("the subtitles should not be probed")
+		return nil, nil
+	}
+
+	if err := uploader.Upload(42, writeTestMedia(t, "movie_optimized.eng.srt"), Subtitle, "movie (eng subtitles)"); err != nil {
+		t.Fatalf("upload error: %v", err)
+	}
+
+	sent := requests()
+	if len(sent) != 1 || sent[0].method != "sendDocument" {
+		t.Fatalf("expected a sendDocument request, got %+v", sent)
+	}
+	if sent[0].params["caption"] != "movie (eng subtitles)" || len(sent[0].files) != 1 {
+		t.Errorf("unexpected document request %+v", sent[0])
+	}
+}
+
+func TestTelegramUploaderChannelFromEnv(t *testing.T) {
+	t.Setenv(ChannelIDEnv, "-100123")
+	uploader := NewTelegramUploader(nil)
+
+	if id, username := uploader.target(42); id != -100123 || username != "" {
+		t.Errorf("expected the numeric channel, got %d %q", id, username)
+	}
+	if err := uploader.Upload(42, "file.mp4", Video, ""); err == nil {
+		t.Error("expected an error without bot client")
+	}
+}
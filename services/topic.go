@@ -0,0 +1,106 @@
+package services
+
+import (
+	"context"
+	"sync"
+)
+
+// Topic is a typed event: its subscribers receive the published values instead of strings.
+// The topic is bridged to an untyped Event of the bus so the On handlers keep
+// receiving the encoded values, and the values emitted with Emit are decoded
+// for the subscribers.
+type Topic[T any] struct {
+	Name string
+
+	bus         *EventFactory
+	event       *Event
+	encode      func(T) (*EventData, []string)
+	decode      func(*EventData, []string) (T, error)
+	mu          sync.Mutex
+	subscribers []*topicSubscriber[T]
+}
+
+type topicSubscriber[T any] struct {
+	handler func(context.Context, T)
+	queueSlot
+}
+
+// Create a new topic bridged to the event of the same name.
+// The values emitted on the event are not delivered to the subscribers when decode is nil.
+func NewTopic[T any](bus *EventFactory, name string, encode func(T) (*EventData, []string), decode func(*EventData, []string) (T, error)) *Topic[T] {
+	topic := &Topic[T]{
+		Name:   name,
+		bus:    bus,
+		event:  bus.CreateEvent(name),
+		encode: encode,
+		decode: decode,
+	}
+	if decode != nil {
+		bus.Mu.Lock()
+		topic.event.bridge = topic.deliverEmitted
+		bus.Mu.Unlock()
+	}
+	return topic
+}
+
+// Get the untyped event of the topic, for the On and Emit callers
+func (t *Topic[T]) Event() *Event {
+	return t.event
+}
+
+// Set how the next values are delivered to the subscribers and to the On handlers
+func (t *Topic[T]) SetDelivery(options DeliveryOptions) {
+	t.bus.SetDelivery(t.event, options)
+}
+
+// Call the handler with every value published on the topic until the subscription is cancelled
+func (t *Topic[T]) Subscribe(handler func(ctx context.Context, value T)) *Subscription {
+	sub := &topicSubscriber[T]{handler: handler}
+	t.mu.Lock()
+	t.subscribers = append(t.subscribers, sub)
+	t.mu.Unlock()
+
+	return &Subscription{unsubscribe: func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		filtered := make([]*topicSubscriber[T], 0, len(t.subscribers))
+		for _, s := range t.subscribers {
+			if s != sub {
+				filtered = append(filtered, s)
+			}
+		}
+		t.subscribers = filtered
+	}}
+}
+
+// Deliver the value to the subscribers and its encoding to the On handlers
+// with the delivery mode of the topic, see SetDelivery and EventFactory.Wait.
+func (t *Topic[T]) Publish(ctx context.Context, value T) {
+	data, args := t.encode(value)
+	t.deliver(ctx, value, emissionKey(args))
+	t.bus.emitHandlers(t.event, data, args...)
+}
+
+func (t *Topic[T]) deliver(ctx context.Context, value T, key string) {
+	t.mu.Lock()
+	subscribers := t.subscribers
+	t.mu.Unlock()
+
+	t.bus.Mu.Lock()
+	options := t.event.delivery
+	t.bus.Mu.Unlock()
+
+	for _, sub := range subscribers {
+		t.bus.deliver(t.event, options, &sub.queueSlot, key, func() { sub.handler(ctx, value) })
+	}
+}
+
+// Values emitted by the untyped callers, the undecodable ones are dropped
+func (t *Topic[T]) deliverEmitted(data *EventData, args ...string) {
+	if data == nil {
+		data = &EventData{}
+	}
+	if value, err := t.decode(data, args); err == nil {
+		t.deliver(context.Background(), value, emissionKey(args))
+	}
+}
@@ -0,0 +1,152 @@
+package services_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/DoniLite/GhostifyBot/services"
+)
+
+type testPayload struct {
+	ID    string
+	Count int
+}
+
+func newTestTopic(name string) *services.Topic[testPayload] {
+	return services.NewTopic(services.EventBus, name,
+		func(p testPayload) (*services.EventData, []string) {
+			return &services.EventData{Message: fmt.Sprintf("%s=%d", p.ID, p.Count)}, []string{p.ID, strconv.Itoa(p.Count)}
+		},
+		func(data *services.EventData, args []string) (testPayload, error) {
+			if len(args) != 2 {
+				return testPayload{}, errors.New("expected 2 arguments")
+			}
+			count, err := strconv.Atoi(args[1])
+			return testPayload{ID: args[0], Count: count}, err
+		},
+	)
+}
+
+type contextKey struct{}
+
+func TestPublish_ShouldDeliverTypedValueAndEncodedEvent(t *testing.T) {
+	bus := services.EventBus
+	topic := newTestTopic("topic:publish")
+
+	var (
+		mu       sync.Mutex
+		received testPayload
+		value    any
+		message  string
+		args     []string
+	)
+	topic.Subscribe(func(ctx context.Context, p testPayload) {
+		mu.Lock()
+		defer mu.Unlock()
+		received, value = p, ctx.Value(contextKey{})
+	})
+	bus.On(topic.Event(), func(data *services.EventData, a ...string) {
+		mu.Lock()
+		defer mu.Unlock()
+		message, args = data.Message, a
+	})
+
+	ctx := context.WithValue(context.Background(), contextKey{}, "trace")
+	topic.Publish(ctx, testPayload{ID: "job-1", Count: 3})
+	bus.Wait()
+
+	if received != (testPayload{ID: "job-1", Count: 3}) || value != "trace" {
+		t.Errorf("Expected the typed value and the context, got %+v %v", received, value)
+	}
+	if message != "job-1=3" || len(args) != 2 || args[1] != "3" {
+		t.Errorf("Expected the encoded event, got %q %v", message, args)
+	}
+}
+
+func TestEmit_ShouldBeDecodedForSubscribers(t *testing.T) {
+	bus := services.EventBus
+	topic := newTestTopic("topic:emit")
+
+	var (
+		mu       sync.Mutex
+		received []testPayload
+	)
+	topic.Subscribe(func(ctx context.Context, p testPayload) {
+		mu.Lock()
+		defer mu.Unlock()
+		received = append(received, p)
+	})
+
+	bus.Emit(topic.Event(), &services.EventData{}, "job-2", "5")
+	bus.Emit(topic.Event(), &services.EventData{}, "undecodable")
+	bus.Wait()
+
+	if len(received) != 1 || received[0] != (testPayload{ID: "job-2", Count: 5}) {
+		t.Errorf("Expected only the decodable emission, got %+v", received)
+	}
+}
+
+func TestNewTopic_ShouldShareTheNamedEvent(t *testing.T) {
+	topic := newTestTopic("topic:shared")
+	if topic.Event() != services.EventBus.CreateEvent("topic:shared") {
+		t.Errorf("Expected the topic to use the event of the same name")
+	}
+}
+
+func TestJobStateTopic_ShouldBridgeLegacyHandlers(t *testing.T) {
+	bus := services.EventBus
+
+	var (
+		mu    sync.Mutex
+		args  []string
+		state services.JobState
+	)
+	bus.On(services.JobStateEvent, func(data *services.EventData, a ...string) {
+		mu.Lock()
+		defer mu.Unlock()
+		if len(a) == 2 && a[0] == "bridge-job" {
+			args = a
+		}
+	})
+	services.JobStateTopic.Subscribe(func(ctx context.Context, change services.JobStateChange) {
+		mu.Lock()
+		defer mu.Unlock()
+		if change.ID == "bridge-job" {
+			state = change.State
+		}
+	})
+
+	services.JobStateTopic.Publish(context.Background(), services.JobStateChange{ID: "bridge-job", State: services.JobUploading})
+	bus.Wait()
+
+	if len(args) != 2 || args[1] != string(services.JobUploading) || state != services.JobUploading {
+		t.Errorf("Expected both handlers to see the state, got %v %q", args, state)
+	}
+}
+
+func TestTopicUnsubscribe_ShouldStopDelivery(t *testing.T) {
+	bus := services.EventBus
+	topic := newTestTopic("topic:unsubscribe")
+
+	var mu sync.Mutex
+	calls := 0
+	sub := topic.Subscribe(func(ctx context.Context, p testPayload) {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+	})
+
+	topic.Publish(context.Background(), testPayload{ID: "a"})
+	bus.Wait()
+	sub.Unsubscribe()
+	topic.Publish(context.Background(), testPayload{ID: "b"})
+	bus.Wait()
+
+	if calls != 1 {
+		t.Errorf("Expected 1 call before the unsubscription, got %d", calls)
+	}
+}
@@ -1,67 +1,192 @@
 package services
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
 
-	tr "github.com/anacrolix/torrent"
+var (
+	// Max accepted size of a remote .torrent file
+	TorrentFileMaxSize int64 = 10 << 20
+	// Max duration of a remote .torrent file download
+	TorrentFileTimeout = 30 * time.Second
+
+	torrentContentTypes = []string{
+		"application/x-bittorrent",
+		"application/octet-stream",
+		"binary/octet-stream",
+		"application/force-download",
+		"application/x-download",
+	}
 )
 
-// Downloading a torrent file from source based on the provided URL
-func DownloadTorrentFile(url, destinationDir string) (string, error) {
-	return "", fmt.Errorf("not implemented function")
+// Downloading a torrent file from source based on the provided URL.
+// The file is validated and saved as `<infohash>.torrent` inside the destination directory.
+func DownloadTorrentFile(rawURL, destinationDir string) (string, error) {
+	return DownloadTorrentFileContext(context.Background(), rawURL, destinationDir)
 }
 
-// Downloading a torrent file specified in a filepath directory.
-func DownloadFromTorrentFile(torrentFilePath, downloadDir string) error {
-	// creating new torrent
-	clientConfig := tr.NewDefaultClientConfig()
-	client, err := tr.NewClient(clientConfig)
+// Same as DownloadTorrentFile but the request is aborted when the context is done
+func DownloadTorrentFileContext(ctx context.Context, rawURL, destinationDir string) (string, error) {
+	parsed, err := url.Parse(rawURL)
 	if err != nil {
-		return fmt.Errorf("error during the torrent client creation : %v", err)
+		return "", fmt.Errorf("invalid torrent url : %v", err)
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return "", fmt.Errorf("unsupported torrent url scheme: %q", parsed.Scheme)
 	}
-	defer client.Close()
 
-	torrent, err := client.AddTorrentFromFile(torrentFilePath)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, parsed.String(), nil)
+	if err != nil {
+		return "", fmt.Errorf("invalid torrent file request : %v", err)
+	}
+	client := &http.Client{Timeout: TorrentFileTimeout}
+	resp, err := client.Do(req)
 	if err != nil {
-		return fmt.Errorf("error during the torrent adding : %v", err)
+		return "", fmt.Errorf("error during the torrent file request : %w", err)
 	}
+	defer resp.Body.Close()
 
-	clientConfig.DataDir = downloadDir
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected torrent file response status: %s", resp.Status)
+	}
+	if !isTorrentContentType(resp.Header.Get("Content-Type")) {
+		return "", fmt.Errorf("unexpected torrent file content type: %s", resp.Header.Get("Content-Type"))
+	}
+	if resp.ContentLength > TorrentFileMaxSize {
+		return "", fmt.Errorf("torrent file too large: %d bytes", resp.ContentLength)
+	}
 
-	// Waiting to get the metadata
-	<-torrent.GotInfo()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, TorrentFileMaxSize+1))
+	if err != nil {
+		return "", fmt.Errorf("error during the torrent file reading : %v", err)
+	}
+	if int64(len(data)) > TorrentFileMaxSize {
+		return "", fmt.Errorf("torrent file exceeds %d bytes", TorrentFileMaxSize)
+	}
 
-	torrent.DownloadAll()
+	return saveTorrentFile(data, destinationDir)
+}
 
-	client.WaitAll()
+// Validate the bencoded metainfo and write it under its infohash name
+func saveTorrentFile(data []byte, destinationDir string) (string, error) {
+	mi, err := metainfo.Load(bytes.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("invalid torrent file : %v", err)
+	}
+	if _, err := mi.UnmarshalInfo(); err != nil {
+		return "", fmt.Errorf("invalid torrent info : %v", err)
+	}
 
-	return nil
+	if err := os.MkdirAll(destinationDir, 0755); err != nil {
+		return "", fmt.Errorf("can't create torrent destination dir: %v", err)
+	}
+
+	destination := filepath.Join(destinationDir, mi.HashInfoBytes().HexString()+".torrent")
+	tmp, err := os.CreateTemp(destinationDir, ".torrent-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), destination); err != nil {
+		return "", err
+	}
+	return destination, nil
+}
+
+func isTorrentContentType(contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, allowed := range torrentContentTypes {
+		if mediaType == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// Downloading a torrent file specified in a filepath directory.
+func DownloadFromTorrentFile(torrentFilePath, downloadDir string) error {
+	return DownloadFromTorrentFileContext(context.Background(), torrentFilePath, downloadDir)
+}
+
+// Same as DownloadFromTorrentFile but the torrent is dropped when the context is done
+func DownloadFromTorrentFileContext(ctx context.Context, torrentFilePath, downloadDir string) error {
+	return downloadTorrent(ctx, func(manager *TorrentManager) (string, error) {
+		return manager.AddTorrentFile(torrentFilePath, downloadDir)
+	}, nil, nil)
 }
 
 // Download torrent file specified by the magnet link.
 func DownloadFromMagnetLink(magnetLink, downloadDir string) error {
-	clientConfig := tr.NewDefaultClientConfig()
-	client, err := tr.NewClient(clientConfig)
+	return DownloadFromMagnetLinkContext(context.Background(), magnetLink, downloadDir)
+}
+
+// Same as DownloadFromMagnetLink but the torrent is dropped when the context is done
+func DownloadFromMagnetLinkContext(ctx context.Context, magnetLink, downloadDir string) error {
+	return downloadTorrent(ctx, func(manager *TorrentManager) (string, error) {
+		return manager.AddMagnet(magnetLink, downloadDir)
+	}, nil, nil)
+}
+
+// Add a torrent to the default manager and block until its completion.
+// Only the files kept by the optional selection are downloaded and
+// the optional onProgress callback receive the progress snapshots.
+// The torrent is dropped from the client on return, including on cancellation.
+func downloadTorrent(ctx context.Context, add func(*TorrentManager) (string, error), selection *FileSelection, onProgress func(TorrentProgress)) error {
+	manager, err := DefaultTorrentManager()
 	if err != nil {
-		return fmt.Errorf("error during the torrent client creation : %v", err)
+		return err
 	}
-	defer client.Close()
 
-	// Adding the magnet link
-	torrent, err := client.AddMagnet(magnetLink)
+	infoHash, err := add(manager)
 	if err != nil {
-		return fmt.Errorf("error during the magnet link adding : %v", err)
+		return err
 	}
+	defer manager.Remove(infoHash)
 
-	clientConfig.DataDir = downloadDir
-
-	<-torrent.GotInfo()
+	if selection != nil {
+		if _, err := manager.Select(infoHash, *selection); err != nil {
+			return err
+		}
+	}
 
-	torrent.DownloadAll()
+	if onProgress != nil {
+		stop := make(chan struct{})
+		defer close(stop)
+		go manager.pollProgress(infoHash, stop, onProgress)
+	}
 
-	client.WaitAll()
+	return manager.WaitCompleteContext(ctx, infoHash)
+}
 
-	return nil
+// Util func to check if the provided link is an HTTP(S) link
+func isTorrentURL(link string) bool {
+	return strings.HasPrefix(link, "http://") || strings.HasPrefix(link, "https://")
 }
 
 // Util func to check if the provided link is a magnet link
@@ -0,0 +1,212 @@
+package services
+
+import (
+	"errors"
+	"path"
+	"path/filepath"
+	"strings"
+
+	tr "github.com/anacrolix/torrent"
+)
+
+var ErrMetadataPending = errors.New("torrent metadata not received yet")
+
+// TorrentFile describe a file of a torrent
+type TorrentFile struct {
+	Index     int
+	Path      string
+	Length    int64
+	IsMedia   bool      // Audio, video or subtitle file
+	MediaType MediaType // Only meaningful when IsMedia is true
+}
+
+// FileSelection filter the files of a torrent.
+// Every non empty criterion must match, a criterion match when any of its values match.
+// An empty selection keep every file.
+type FileSelection struct {
+	Globs        []string // Matched against the file path and the file name
+	ExcludeGlobs []string // Files matching one of these globs are never selected
+	Extensions   []string
+	Indexes      []int
+	MediaTypes   []MediaType
+}
+
+// Keep only the audio and video files with their subtitles
+var MediaFilesSelection = FileSelection{
+	MediaTypes: []MediaType{Video, Audio, Subtitle},
+}
+
+// Check if the file is kept by the selection
+func (s FileSelection) Matches(file TorrentFile) bool {
+	if len(s.ExcludeGlobs) > 0 && matchesGlob(s.ExcludeGlobs, file.Path) {
+		return false
+	}
+	if len(s.Globs) > 0 && !matchesGlob(s.Globs, file.Path) {
+		return false
+	}
+	if len(s.Extensions) > 0 && !matchesExtension(s.Extensions, file.Path) {
+		return false
+	}
+	if len(s.Indexes) > 0 && !containsIndex(s.Indexes, file.Index) {
+		return false
+	}
+	if len(s.MediaTypes) > 0 && (!file.IsMedia || !containsMediaType(s.MediaTypes, file.MediaType)) {
+		return false
+	}
+	return true
+}
+
+// Keep the files matching the selection
+func (s FileSelection) Filter(files []TorrentFile) []TorrentFile {
+	var selected []TorrentFile
+	for _, file := range files {
+		if s.Matches(file) {
+			selected = append(selected, file)
+		}
+	}
+	return selected
+}
+
+func matchesGlob(globs []string, filePath string) bool {
+	lowerPath := strings.ToLower(filePath)
+	name := path.Base(lowerPath)
+	for _, glob := range globs {
+		glob = strings.ToLower(glob)
+		if ok, _ := path.Match(glob, lowerPath); ok {
+			return true
+		}
+		if ok, _ := path.Match(glob, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesExtension(extensions []string, filePath string) bool {
+	ext := strings.ToLower(filepath.Ext(filePath))
+	for _, allowed := range extensions {
+		allowed = strings.ToLower(allowed)
+		if !strings.HasPrefix(allowed, ".") {
+			allowed = "." + allowed
+		}
+		if ext == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+func containsIndex(indexes []int, index int) bool {
+	for _, i := range indexes {
+		if i == index {
+			return true
+		}
+	}
+	return false
+}
+
+func containsMediaType(types []MediaType, mediaType MediaType) bool {
+	for _, t := range types {
+		if t == mediaType {
+			return true
+		}
+	}
+	return false
+}
+
+func describeTorrentFiles(files []*tr.File) []TorrentFile {
+	described := make([]TorrentFile, len(files))
+	for i, f := range files {
+		described[i] = TorrentFile{
+			Index:     i,
+			Path:      f.DisplayPath(),
+			Length:    f.Length(),
+			IsMedia:   isMediaFile(f.DisplayPath()) || isSubtitleFile(f.DisplayPath()),
+			MediaType: detectMediaType(f.DisplayPath()),
+		}
+	}
+	return described
+}
+
+// List the files of a torrent. The metadata must have been received.
+func (m *TorrentManager) Files(infoHash string) ([]TorrentFile, error) {
+	managed, err := m.get(infoHash)
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case <-managed.torrent.GotInfo():
+	default:
+		return nil, ErrMetadataPending
+	}
+	return describeTorrentFiles(managed.torrent.Files()), nil
+}
+
+// Download only the files kept by the selection.
+// When the metadata is still pending the selection is applied on its arrival
+// and no file is returned.
+func (m *TorrentManager) Select(infoHash string, selection FileSelection) ([]TorrentFile, error) {
+	managed, err := m.get(infoHash)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	managed.selection = &selection
+	select {
+	case <-managed.torrent.GotInfo():
+		return managed.applySelection(), nil
+	default:
+		return nil, nil
+	}
+}
+
+// Set the piece priorities from the selection, or download everything without one.
+// Must be called with the manager lock held once the metadata is available.
+func (managed *managedTorrent) applySelection() []TorrentFile {
+	files := managed.torrent.Files()
+	described := describeTorrentFiles(files)
+
+	if managed.selection == nil {
+		managed.selected = nil
+		managed.torrent.DownloadAll()
+		return described
+	}
+
+	var selected []TorrentFile
+	managed.selected = make([]*tr.File, 0, len(files))
+	for i, file := range described {
+		if managed.selection.Matches(file) {
+			selected = append(selected, file)
+			managed.selected = append(managed.selected, files[i])
+			files[i].Download()
+		} else {
+			files[i].SetPriority(tr.PiecePriorityNone)
+		}
+	}
+	return selected
+}
+
+// Get the completed and wanted bytes of the selected files
+func (managed *managedTorrent) wantedBytes() (completed, length int64) {
+	if managed.selected == nil {
+		return managed.torrent.BytesCompleted(), managed.torrent.Length()
+	}
+	for _, f := range managed.selected {
+		completed += f.BytesCompleted()
+		length += f.Length()
+	}
+	return completed, length
+}
+
+// Check if every wanted byte is downloaded
+func (managed *managedTorrent) done() bool {
+	if managed.selected == nil {
+		return managed.torrent.Complete().Bool()
+	}
+	completed, length := managed.wantedBytes()
+	return completed == length
+}
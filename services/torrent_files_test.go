@@ -0,0 +1,146 @@
+package services
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+var testPackFiles = map[string][]byte{
+	"episode_01.mkv": bytes.Repeat([]byte("episode1"), 8192),
+	"sample.mkv":     bytes.Repeat([]byte("sample"), 1024),
+	"release.nfo":    []byte("release notes"),
+}
+
+// Build a multi file torrent named "pack" and write it to disk
+func writeTestPackTorrent(t *testing.T) string {
+	root := filepath.Join(t.TempDir(), "pack")
+	if err := os.MkdirAll(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range testPackFiles {
+		if err := os.WriteFile(filepath.Join(root, name), content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	info := metainfo.Info{PieceLength: 16 << 10}
+	if err := info.BuildFromFilePath(root); err != nil {
+		t.Fatalf("torrent info creation error: %v", err)
+	}
+	infoBytes, err := bencode.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mi := &metainfo.MetaInfo{InfoBytes: infoBytes}
+	path := filepath.Join(t.TempDir(), "pack.torrent")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := mi.Write(f); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestFileSelectionMatches(t *testing.T) {
+	episode := TorrentFile{Index: 0, Path: "Show/Episode.01.MKV", IsMedia: true, MediaType: Video}
+	sample := TorrentFile{Index: 1, Path: "Show/Sample/sample.mkv", IsMedia: true, MediaType: Video}
+	nfo := TorrentFile{Index: 2, Path: "Show/release.nfo", MediaType: Audio}
+	theme := TorrentFile{Index: 3, Path: "Show/theme.mp3", IsMedia: true, MediaType: Audio}
+	subtitle := TorrentFile{Index: 4, Path: "Show/Subs/Episode.01.en.srt", IsMedia: true, MediaType: Subtitle}
+
+	tests := []struct {
+		name      string
+		selection FileSelection
+		file      TorrentFile
+		expected  bool
+	}{
+		{"empty selection", FileSelection{}, nfo, true},
+		{"extension without dot", FileSelection{Extensions: []string{"mkv"}}, episode, true},
+		{"extension mismatch", FileSelection{Extensions: []string{".mp4"}}, episode, false},
+		{"glob on name", FileSelection{Globs: []string{"episode.*"}}, episode, true},
+		{"glob on path", FileSelection{Globs: []string{"show/*.nfo"}}, nfo, true},
+		{"exclude glob", FileSelection{MediaTypes: []MediaType{Video}, ExcludeGlobs: []string{"*sample*"}}, sample, false},
+		{"index", FileSelection{Indexes: []int{3}}, theme, true},
+		{"media type video", FileSelection{MediaTypes: []MediaType{Video}}, theme, false},
+		{"media type ignore non media", MediaFilesSelection, nfo, false},
+		{"media type keep subtitles", MediaFilesSelection, subtitle, true},
+		{"criteria combined", FileSelection{Extensions: []string{".mkv"}, Indexes: []int{1}}, episode, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.selection.Matches(tt.file); got != tt.expected {
+				t.Errorf("Matches(%s) = %v, expected %v", tt.file.Path, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestTorrentManagerSelectFiles(t *testing.T) {
+	manager := newTestTorrentManager(t)
+	manager.ProgressInterval = 10 * time.Millisecond
+	path := writeTestPackTorrent(t)
+
+	// Only the wanted episode is available on disk
+	downloadDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(downloadDir, "pack"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	episode := testPackFiles["episode_01.mkv"]
+	if err := os.WriteFile(filepath.Join(downloadDir, "pack", "episode_01.mkv"), episode, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	infoHash, err := manager.AddTorrentFile(path, downloadDir)
+	if err != nil {
+		t.Fatalf("add error: %v", err)
+	}
+
+	files, err := manager.Files(infoHash)
+	if err != nil {
+		t.Fatalf("files error: %v", err)
+	}
+	if len(files) != 3 {
+		t.Fatalf("expected 3 files, got %d", len(files))
+	}
+
+	selected, err := manager.Select(infoHash, FileSelection{
+		MediaTypes:   []MediaType{Video},
+		ExcludeGlobs: []string{"sample*"},
+	})
+	if err != nil {
+		t.Fatalf("select error: %v", err)
+	}
+	if len(selected) != 1 || selected[0].Path != "episode_01.mkv" {
+		t.Fatalf("unexpected selection: %+v", selected)
+	}
+
+	managed, _ := manager.get(infoHash)
+	managed.torrent.VerifyData()
+
+	done := make(chan error, 1)
+	go func() { done <- manager.WaitComplete(infoHash) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("wait error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("selected files never completed")
+	}
+
+	status, _ := manager.Status(infoHash)
+	if status.State != TorrentComplete || status.Length != int64(len(episode)) {
+		t.Errorf("expected a complete status over the selected file, got %+v", status)
+	}
+}
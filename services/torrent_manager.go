@@ -0,0 +1,389 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	tr "github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+)
+
+// TorrentState represent the lifecycle step of a managed torrent
+type TorrentState string
+
+const (
+	TorrentPendingMetadata TorrentState = "metadata"
+	TorrentDownloading     TorrentState = "downloading"
+	TorrentPaused          TorrentState = "paused"
+	TorrentComplete        TorrentState = "complete"
+)
+
+var (
+	ErrTorrentNotFound = errors.New("torrent not found")
+	ErrMetadataTimeout = errors.New("torrent metadata not received in time")
+	ErrTorrentStalled  = errors.New("torrent download stalled")
+	ErrTorrentDirInUse = errors.New("torrent already downloading into another directory")
+)
+
+// TorrentStatus is a snapshot of a managed torrent
+type TorrentStatus struct {
+	InfoHash       string
+	Name           string
+	State          TorrentState
+	BytesCompleted int64
+	Length         int64
+	Peers          int
+}
+
+// TorrentManager own a single torrent client shared by every download
+type TorrentManager struct {
+	Storage          TorrentStorageConfig // Storage created for each download directory
+	ProgressInterval time.Duration        // Delay between two progress snapshots
+	MetadataTimeout  time.Duration        // Max wait for the metadata of a torrent, 0 to wait forever
+	StallTimeout     time.Duration        // Max duration without any downloaded byte, 0 to disable
+	client           *tr.Client
+	mu               sync.Mutex
+	torrents         map[metainfo.Hash]*managedTorrent
+	storages         map[string]storage.ClientImplCloser
+	watchers         sync.WaitGroup
+}
+
+type managedTorrent struct {
+	torrent   *tr.Torrent
+	dir       string // Absolute download directory
+	refs      int    // Number of adds not removed yet
+	paused    bool
+	progress  TorrentProgress
+	selection *FileSelection
+	selected  []*tr.File // nil when every file is wanted
+}
+
+var (
+	defaultManager     *TorrentManager
+	defaultManagerErr  error
+	defaultManagerOnce sync.Once
+)
+
+// Create a new torrent manager with its own client
+func NewTorrentManager(config *tr.ClientConfig) (*TorrentManager, error) {
+	if config == nil {
+		config = tr.NewDefaultClientConfig()
+		config.DataDir = DefaultDownloadDir()
+	}
+	client, err := tr.NewClient(config)
+	if err != nil {
+		return nil, fmt.Errorf("error during the torrent client creation : %v", err)
+	}
+
+	return &TorrentManager{
+		Storage:          DefaultTorrentStorage,
+		ProgressInterval: time.Second,
+		MetadataTimeout:  5 * time.Minute,
+		StallTimeout:     10 * time.Minute,
+		client:           client,
+		torrents:         make(map[metainfo.Hash]*managedTorrent),
+		storages:         make(map[string]storage.ClientImplCloser),
+	}, nil
+}
+
+// Get the process wide torrent manager, created on first use
+func DefaultTorrentManager() (*TorrentManager, error) {
+	defaultManagerOnce.Do(func() {
+		defaultManager, defaultManagerErr = NewTorrentManager(nil)
+	})
+	return defaultManager, defaultManagerErr
+}
+
+// Add a torrent from a magnet link and return its infohash.
+// The data are written inside downloadDir, or DefaultDownloadDir when empty.
+func (m *TorrentManager) AddMagnet(magnetLink, downloadDir string) (string, error) {
+	spec, err := tr.TorrentSpecFromMagnetUri(magnetLink)
+	if err != nil {
+		return "", fmt.Errorf("error during the magnet link adding : %v", err)
+	}
+	return m.add(spec, downloadDir)
+}
+
+// Add a torrent from a .torrent file and return its infohash.
+// The data are written inside downloadDir, or DefaultDownloadDir when empty.
+func (m *TorrentManager) AddTorrentFile(torrentFilePath, downloadDir string) (string, error) {
+	mi, err := metainfo.LoadFromFile(torrentFilePath)
+	if err != nil {
+		return "", fmt.Errorf("error during the torrent adding : %v", err)
+	}
+	spec, err := tr.TorrentSpecFromMetaInfoErr(mi)
+	if err != nil {
+		return "", fmt.Errorf("error during the torrent adding : %v", err)
+	}
+	return m.add(spec, downloadDir)
+}
+
+// Add the torrent on the storage of its download directory and start
+// downloading every file once the metadata is received.
+// Adding a managed torrent again only count one more reference removed by Remove,
+// it fail with ErrTorrentDirInUse when the download directory differ.
+func (m *TorrentManager) add(spec *tr.TorrentSpec, downloadDir string) (string, error) {
+	if downloadDir == "" {
+		downloadDir = DefaultDownloadDir()
+	}
+	dir, err := filepath.Abs(downloadDir)
+	if err != nil {
+		return "", err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if managed, ok := m.torrents[spec.InfoHash]; ok {
+		if managed.dir != dir {
+			return "", fmt.Errorf("torrent %s : %w %s", spec.InfoHash.HexString(), ErrTorrentDirInUse, managed.dir)
+		}
+		managed.refs++
+		return spec.InfoHash.HexString(), nil
+	}
+
+	torrentStorage, err := m.storageFor(dir)
+	if err != nil {
+		return "", err
+	}
+	spec.Storage = torrentStorage
+
+	torrent, _, err := m.client.AddTorrentSpec(spec)
+	if err != nil {
+		m.releaseStorage(dir)
+		return "", fmt.Errorf("error during the torrent adding : %v", err)
+	}
+
+	managed := &managedTorrent{torrent: torrent, dir: dir, refs: 1}
+	m.torrents[torrent.InfoHash()] = managed
+	interval := m.ProgressInterval
+	m.watchers.Add(1)
+	go func() {
+		defer m.watchers.Done()
+		select {
+		case <-torrent.GotInfo():
+			m.mu.Lock()
+			managed.applySelection()
+			m.mu.Unlock()
+			m.watchProgress(managed, interval)
+		case <-torrent.Closed():
+		}
+	}()
+	return torrent.InfoHash().HexString(), nil
+}
+
+// Get or create the storage shared by every torrent of a download directory.
+// The piece completion database can't be opened twice for the same directory.
+func (m *TorrentManager) storageFor(dir string) (storage.ClientImplCloser, error) {
+	if existing, ok := m.storages[dir]; ok {
+		return existing, nil
+	}
+	created, err := NewTorrentStorage(dir, m.Storage)
+	if err != nil {
+		return nil, err
+	}
+	m.storages[dir] = created
+	return created, nil
+}
+
+// Close the storage of the download directory once no torrent use it
+func (m *TorrentManager) releaseStorage(dir string) {
+	for _, managed := range m.torrents {
+		if managed.dir == dir {
+			return
+		}
+	}
+	if torrentStorage, ok := m.storages[dir]; ok {
+		torrentStorage.Close()
+		delete(m.storages, dir)
+	}
+}
+
+func (m *TorrentManager) get(infoHash string) (*managedTorrent, error) {
+	var hash metainfo.Hash
+	if err := hash.FromHexString(infoHash); err != nil {
+		return nil, fmt.Errorf("invalid infohash %q : %v", infoHash, err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	managed, ok := m.torrents[hash]
+	if !ok {
+		return nil, ErrTorrentNotFound
+	}
+	return managed, nil
+}
+
+// Stop exchanging data for the torrent while keeping its peers and pieces
+func (m *TorrentManager) Pause(infoHash string) error {
+	managed, err := m.get(infoHash)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	managed.torrent.DisallowDataDownload()
+	managed.torrent.DisallowDataUpload()
+	managed.paused = true
+	return nil
+}
+
+// Resume a paused torrent
+func (m *TorrentManager) Resume(infoHash string) error {
+	managed, err := m.get(infoHash)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	managed.torrent.AllowDataDownload()
+	managed.torrent.AllowDataUpload()
+	managed.paused = false
+	return nil
+}
+
+// Drop the torrent from the client once every add of it is removed.
+// Downloaded data are kept on disk.
+func (m *TorrentManager) Remove(infoHash string) error {
+	managed, err := m.get(infoHash)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	if managed.refs--; managed.refs > 0 {
+		m.mu.Unlock()
+		return nil
+	}
+	delete(m.torrents, managed.torrent.InfoHash())
+	m.mu.Unlock()
+
+	managed.torrent.Drop()
+	m.mu.Lock()
+	m.releaseStorage(managed.dir)
+	m.mu.Unlock()
+	return nil
+}
+
+// Wait until every selected file of the torrent is downloaded
+func (m *TorrentManager) WaitComplete(infoHash string) error {
+	return m.WaitCompleteContext(context.Background(), infoHash)
+}
+
+// Wait until every selected file of the torrent is downloaded or the context is done.
+// Fail with ErrMetadataTimeout or ErrTorrentStalled when the torrent stop making progress.
+// Paused torrents are never considered stalled.
+func (m *TorrentManager) WaitCompleteContext(ctx context.Context, infoHash string) error {
+	if err := m.WaitMetadataContext(ctx, infoHash); err != nil {
+		return err
+	}
+	managed, err := m.get(infoHash)
+	if err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(m.ProgressInterval)
+	defer ticker.Stop()
+
+	var lastCompleted int64
+	lastActivity := time.Now()
+	for {
+		m.mu.Lock()
+		done := managed.done()
+		completed, _ := managed.wantedBytes()
+		paused := managed.paused
+		m.mu.Unlock()
+		if done {
+			return nil
+		}
+
+		now := time.Now()
+		if completed != lastCompleted || paused {
+			lastCompleted, lastActivity = completed, now
+		} else if m.StallTimeout > 0 && now.Sub(lastActivity) >= m.StallTimeout {
+			return fmt.Errorf("torrent %s : %w after %s without data", infoHash, ErrTorrentStalled, m.StallTimeout)
+		}
+
+		select {
+		case <-managed.torrent.Complete().On():
+		case <-ticker.C:
+		case <-managed.torrent.Closed():
+			return fmt.Errorf("torrent %s dropped before completion", infoHash)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Get the current status of a torrent
+func (m *TorrentManager) Status(infoHash string) (TorrentStatus, error) {
+	managed, err := m.get(infoHash)
+	if err != nil {
+		return TorrentStatus{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return managed.status(), nil
+}
+
+// List the status of every managed torrent
+func (m *TorrentManager) List() []TorrentStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	statuses := make([]TorrentStatus, 0, len(m.torrents))
+	for _, managed := range m.torrents {
+		statuses = append(statuses, managed.status())
+	}
+	return statuses
+}
+
+// Close the client and every managed torrent
+func (m *TorrentManager) Close() {
+	m.client.Close()
+	// Closing the client drop every torrent and stop their watchers
+	m.watchers.Wait()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for dir, torrentStorage := range m.storages {
+		torrentStorage.Close()
+		delete(m.storages, dir)
+	}
+	m.torrents = make(map[metainfo.Hash]*managedTorrent)
+}
+
+func (managed *managedTorrent) status() TorrentStatus {
+	torrent := managed.torrent
+	status := TorrentStatus{
+		InfoHash: torrent.InfoHash().HexString(),
+		Name:     torrent.Name(),
+		Peers:    torrent.Stats().ActivePeers,
+	}
+
+	select {
+	case <-torrent.GotInfo():
+	default:
+		status.State = TorrentPendingMetadata
+		return status
+	}
+
+	status.BytesCompleted, status.Length = managed.wantedBytes()
+	switch {
+	case managed.done():
+		status.State = TorrentComplete
+	case managed.paused:
+		status.State = TorrentPaused
+	default:
+		status.State = TorrentDownloading
+	}
+	return status
+}
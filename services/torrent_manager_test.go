@@ -0,0 +1,189 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	tr "github.com/anacrolix/torrent"
+)
+
+// Create an offline torrent manager listening on a random port
+func newTestTorrentManager(t *testing.T) *TorrentManager {
+	config := tr.NewDefaultClientConfig()
+	config.DataDir = t.TempDir()
+	config.ListenPort = 0
+	config.NoDHT = true
+	config.DisableTrackers = true
+	config.NoDefaultPortForwarding = true
+
+	manager, err := NewTorrentManager(config)
+	if err != nil {
+		t.Fatalf("torrent manager creation error: %v", err)
+	}
+	t.Cleanup(manager.Close)
+	return manager
+}
+
+func writeTestTorrent(t *testing.T, name string) (string, string) {
+	mi, data := createTestTorrent(t, name)
+	path := filepath.Join(t.TempDir(), "test.torrent")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path, mi.HashInfoBytes().HexString()
+}
+
+func TestTorrentManagerLifecycle(t *testing.T) {
+	manager := newTestTorrentManager(t)
+	path, expectedHash := writeTestTorrent(t, "episode.mp4")
+
+	infoHash, err := manager.AddTorrentFile(path, t.TempDir())
+	if err != nil {
+		t.Fatalf("add error: %v", err)
+	}
+	if infoHash != expectedHash {
+		t.Errorf("expected infohash %s, got %s", expectedHash, infoHash)
+	}
+
+	status, err := manager.Status(infoHash)
+	if err != nil {
+		t.Fatalf("status error: %v", err)
+	}
+	if status.State != TorrentDownloading || status.Name != "episode.mp4" || status.Length == 0 {
+		t.Errorf("unexpected status: %+v", status)
+	}
+
+	if err := manager.Pause(infoHash); err != nil {
+		t.Fatalf("pause error: %v", err)
+	}
+	if status, _ := manager.Status(infoHash); status.State != TorrentPaused {
+		t.Errorf("expected paused state, got %s", status.State)
+	}
+
+	if err := manager.Resume(infoHash); err != nil {
+		t.Fatalf("resume error: %v", err)
+	}
+	if status, _ := manager.Status(infoHash); status.State != TorrentDownloading {
+		t.Errorf("expected downloading state, got %s", status.State)
+	}
+
+	if len(manager.List()) != 1 {
+		t.Errorf("expected 1 managed torrent, got %d", len(manager.List()))
+	}
+
+	if err := manager.Remove(infoHash); err != nil {
+		t.Fatalf("remove error: %v", err)
+	}
+	if _, err := manager.Status(infoHash); !errors.Is(err, ErrTorrentNotFound) {
+		t.Errorf("expected ErrTorrentNotFound after removal, got %v", err)
+	}
+}
+
+func TestTorrentManagerMultipleTorrents(t *testing.T) {
+	manager := newTestTorrentManager(t)
+	first, _ := writeTestTorrent(t, "episode_01.mp4")
+	second, _ := writeTestTorrent(t, "episode_02.mp4")
+
+	if _, err := manager.AddTorrentFile(first, t.TempDir()); err != nil {
+		t.Fatalf("first add error: %v", err)
+	}
+	if _, err := manager.AddTorrentFile(second, t.TempDir()); err != nil {
+		t.Fatalf("second add error: %v", err)
+	}
+	if len(manager.List()) != 2 {
+		t.Errorf("expected 2 managed torrents, got %d", len(manager.List()))
+	}
+}
+
+func TestTorrentManagerDuplicateAdd(t *testing.T) {
+	manager := newTestTorrentManager(t)
+	path, _ := writeTestTorrent(t, "episode.mp4")
+	dir := t.TempDir()
+
+	infoHash, err := manager.AddTorrentFile(path, dir)
+	if err != nil {
+		t.Fatalf("first add error: %v", err)
+	}
+	if _, err := manager.AddTorrentFile(path, t.TempDir()); !errors.Is(err, ErrTorrentDirInUse) {
+		t.Errorf("expected ErrTorrentDirInUse for another directory, got %v", err)
+	}
+	if _, err := manager.AddTorrentFile(path, dir); err != nil {
+		t.Fatalf("second add error: %v", err)
+	}
+
+	// The torrent and its storage stay until every add is removed
+	manager.Remove(infoHash)
+	if _, err := manager.Status(infoHash); err != nil {
+		t.Errorf("expected the torrent to be kept after the first removal, got %v", err)
+	}
+	manager.Remove(infoHash)
+	if _, err := manager.Status(infoHash); !errors.Is(err, ErrTorrentNotFound) {
+		t.Errorf("expected ErrTorrentNotFound after the last removal, got %v", err)
+	}
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+	if len(manager.storages) != 0 {
+		t.Errorf("expected the unused storage to be closed, got %d storages", len(manager.storages))
+	}
+}
+
+func TestTorrentManagerUnknownTorrent(t *testing.T) {
+	manager := newTestTorrentManager(t)
+
+	if err := manager.Pause("0000000000000000000000000000000000000000"); !errors.Is(err, ErrTorrentNotFound) {
+		t.Errorf("expected ErrTorrentNotFound, got %v", err)
+	}
+	if err := manager.Pause("not-a-hash"); err == nil {
+		t.Error("expected an invalid infohash error")
+	}
+}
+
+func TestTorrentManagerMetadataTimeout(t *testing.T) {
+	manager := newTestTorrentManager(t)
+	manager.MetadataTimeout = 50 * time.Millisecond
+
+	infoHash, err := manager.AddMagnet("magnet:?xt=urn:btih:0123456789abcdef0123456789abcdef01234567", t.TempDir())
+	if err != nil {
+		t.Fatalf("add error: %v", err)
+	}
+
+	if err := manager.WaitComplete(infoHash); !errors.Is(err, ErrMetadataTimeout) {
+		t.Errorf("expected ErrMetadataTimeout, got %v", err)
+	}
+
+	manager.MetadataTimeout = 0
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := manager.WaitMetadataContext(ctx, infoHash); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the context error, got %v", err)
+	}
+}
+
+func TestTorrentManagerStallDetection(t *testing.T) {
+	manager := newTestTorrentManager(t)
+	manager.ProgressInterval = 10 * time.Millisecond
+	manager.StallTimeout = 50 * time.Millisecond
+	path, _ := writeTestTorrent(t, "episode.mp4")
+
+	// Nothing on disk and no peer, the download can't make any progress
+	infoHash, err := manager.AddTorrentFile(path, t.TempDir())
+	if err != nil {
+		t.Fatalf("add error: %v", err)
+	}
+
+	if err := manager.WaitComplete(infoHash); !errors.Is(err, ErrTorrentStalled) {
+		t.Errorf("expected ErrTorrentStalled, got %v", err)
+	}
+
+	// A paused torrent is waiting on purpose
+	manager.Pause(infoHash)
+	ctx, cancel := context.WithTimeout(context.Background(), 150*time.Millisecond)
+	defer cancel()
+	if err := manager.WaitCompleteContext(ctx, infoHash); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the context error for a paused torrent, got %v", err)
+	}
+}
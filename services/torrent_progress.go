@@ -0,0 +1,194 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Topic published periodically for every downloading torrent
+var TorrentProgressTopic *Topic[TorrentProgress]
+
+// Untyped event of TorrentProgressTopic.
+// The arguments are the encoded TorrentProgress, see TorrentProgressFromArgs.
+var TorrentProgressEvent *Event
+
+// Weight of the latest measure in the smoothed download rate
+const rateSmoothing = 0.3
+
+// TorrentProgress is a download progress snapshot of a torrent
+type TorrentProgress struct {
+	InfoHash       string
+	BytesCompleted int64
+	Length         int64
+	DownloadRate   float64 // Bytes per second
+	Peers          int
+	ETA            time.Duration // Zero when unknown
+	Time           time.Time
+}
+
+// Get the completion percentage
+func (p TorrentProgress) Percent() float64 {
+	if p.Length <= 0 {
+		return 0
+	}
+	return float64(p.BytesCompleted) * 100 / float64(p.Length)
+}
+
+func (p TorrentProgress) String() string {
+	return fmt.Sprintf("%.2f%% (%d/%d bytes) at %.0f B/s, %d peer(s), ETA %s",
+		p.Percent(), p.BytesCompleted, p.Length, p.DownloadRate, p.Peers, p.ETA)
+}
+
+// Encode the snapshot as event arguments
+func (p TorrentProgress) Args() []string {
+	return []string{
+		p.InfoHash,
+		strconv.FormatInt(p.BytesCompleted, 10),
+		strconv.FormatInt(p.Length, 10),
+		strconv.FormatFloat(p.DownloadRate, 'f', 2, 64),
+		strconv.Itoa(p.Peers),
+		strconv.FormatInt(int64(p.ETA), 10),
+		strconv.FormatInt(p.Time.UnixNano(), 10),
+	}
+}
+
+func encodeTorrentProgress(p TorrentProgress) (*EventData, []string) {
+	return &EventData{Message: p.String()}, p.Args()
+}
+
+func decodeTorrentProgress(data *EventData, args []string) (TorrentProgress, error) {
+	return TorrentProgressFromArgs(args)
+}
+
+// Decode the arguments of a TorrentProgressEvent
+func TorrentProgressFromArgs(args []string) (TorrentProgress, error) {
+	if len(args) != 7 {
+		return TorrentProgress{}, fmt.Errorf("expected 7 torrent progress arguments, got %d", len(args))
+	}
+
+	var (
+		progress = TorrentProgress{InfoHash: args[0]}
+		eta      int64
+		nanos    int64
+		err      error
+	)
+	if progress.BytesCompleted, err = strconv.ParseInt(args[1], 10, 64); err != nil {
+		return TorrentProgress{}, err
+	}
+	if progress.Length, err = strconv.ParseInt(args[2], 10, 64); err != nil {
+		return TorrentProgress{}, err
+	}
+	if progress.DownloadRate, err = strconv.ParseFloat(args[3], 64); err != nil {
+		return TorrentProgress{}, err
+	}
+	if progress.Peers, err = strconv.Atoi(args[4]); err != nil {
+		return TorrentProgress{}, err
+	}
+	if eta, err = strconv.ParseInt(args[5], 10, 64); err != nil {
+		return TorrentProgress{}, err
+	}
+	if nanos, err = strconv.ParseInt(args[6], 10, 64); err != nil {
+		return TorrentProgress{}, err
+	}
+	progress.ETA = time.Duration(eta)
+	progress.Time = time.Unix(0, nanos)
+	return progress, nil
+}
+
+// Compute a new snapshot from the previous one and the current counters
+func nextTorrentProgress(prev TorrentProgress, infoHash string, bytesCompleted, length int64, peers int, now time.Time) TorrentProgress {
+	progress := TorrentProgress{
+		InfoHash:       infoHash,
+		BytesCompleted: bytesCompleted,
+		Length:         length,
+		Peers:          peers,
+		Time:           now,
+		DownloadRate:   prev.DownloadRate,
+	}
+
+	if !prev.Time.IsZero() {
+		if elapsed := now.Sub(prev.Time).Seconds(); elapsed > 0 {
+			instant := float64(bytesCompleted-prev.BytesCompleted) / elapsed
+			if instant < 0 {
+				instant = 0
+			}
+			progress.DownloadRate = rateSmoothing*instant + (1-rateSmoothing)*prev.DownloadRate
+		}
+	}
+
+	if remaining := length - bytesCompleted; remaining > 0 && progress.DownloadRate > 0 {
+		progress.ETA = time.Duration(float64(remaining) / progress.DownloadRate * float64(time.Second))
+	}
+	return progress
+}
+
+// Get the last progress snapshot of a torrent
+func (m *TorrentManager) Progress(infoHash string) (TorrentProgress, error) {
+	managed, err := m.get(infoHash)
+	if err != nil {
+		return TorrentProgress{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if managed.progress.Time.IsZero() {
+		return managed.snapshot(TorrentProgress{}), nil
+	}
+	return managed.progress, nil
+}
+
+// Take a snapshot of the selected files. Must be called with the manager lock held.
+func (managed *managedTorrent) snapshot(prev TorrentProgress) TorrentProgress {
+	var length, completed int64
+	select {
+	case <-managed.torrent.GotInfo():
+		completed, length = managed.wantedBytes()
+	default:
+	}
+	return nextTorrentProgress(prev, managed.torrent.InfoHash().HexString(), completed, length, managed.torrent.Stats().ActivePeers, time.Now())
+}
+
+// Publish a snapshot at every interval until the selected files are complete or the torrent dropped
+func (m *TorrentManager) watchProgress(managed *managedTorrent, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-managed.torrent.Closed():
+			return
+		case <-managed.torrent.Complete().On():
+		case <-ticker.C:
+		}
+
+		m.mu.Lock()
+		managed.progress = managed.snapshot(managed.progress)
+		last := managed.progress
+		done := managed.done()
+		m.mu.Unlock()
+		TorrentProgressTopic.Publish(context.Background(), last)
+
+		if done {
+			return
+		}
+	}
+}
+
+// Call onProgress with the last snapshot of the torrent until stop is closed
+func (m *TorrentManager) pollProgress(infoHash string, stop <-chan struct{}, onProgress func(TorrentProgress)) {
+	ticker := time.NewTicker(m.ProgressInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if progress, err := m.Progress(infoHash); err == nil {
+				onProgress(progress)
+			}
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package services
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNextTorrentProgress(t *testing.T) {
+	start := time.Now()
+	first := nextTorrentProgress(TorrentProgress{}, "hash", 0, 1000, 3, start)
+	if first.DownloadRate != 0 || first.ETA != 0 {
+		t.Errorf("expected unknown rate and ETA on the first snapshot, got %+v", first)
+	}
+
+	second := nextTorrentProgress(first, "hash", 500, 1000, 3, start.Add(time.Second))
+	expectedRate := rateSmoothing * 500
+	if second.DownloadRate != expectedRate {
+		t.Errorf("expected rate %.2f, got %.2f", expectedRate, second.DownloadRate)
+	}
+	expectedETA := time.Duration(500 / expectedRate * float64(time.Second))
+	if second.ETA != expectedETA {
+		t.Errorf("expected ETA %s, got %s", expectedETA, second.ETA)
+	}
+	if second.Percent() != 50 {
+		t.Errorf("expected 50%%, got %.2f", second.Percent())
+	}
+}
+
+func TestTorrentProgressArgs(t *testing.T) {
+	progress := TorrentProgress{
+		InfoHash:       "abc",
+		BytesCompleted: 42,
+		Length:         84,
+		DownloadRate:   12.5,
+		Peers:          4,
+		ETA:            3 * time.Second,
+		Time:           time.Unix(0, 1700000000),
+	}
+
+	decoded, err := TorrentProgressFromArgs(progress.Args())
+	if err != nil {
+		t.Fatalf("decode error: %v", err)
+	}
+	if decoded != progress {
+		t.Errorf("expected %+v, got %+v", progress, decoded)
+	}
+
+	if _, err := TorrentProgressFromArgs([]string{"abc"}); err == nil {
+		t.Error("expected an error for missing arguments")
+	}
+}
+
+func TestTorrentManagerPublishesProgress(t *testing.T) {
+	manager := newTestTorrentManager(t)
+	manager.ProgressInterval = 10 * time.Millisecond
+	path, expectedHash := writeTestTorrent(t, "episode.mp4")
+
+	var (
+		mu       sync.Mutex
+		complete = make(chan TorrentProgress, 1)
+	)
+	EventBus.On(TorrentProgressEvent, func(data *EventData, args ...string) {
+		progress, err := TorrentProgressFromArgs(args)
+		if err != nil || progress.InfoHash != expectedHash {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if progress.Percent() == 100 && len(complete) == 0 {
+			complete <- progress
+		}
+	})
+
+	downloadDir := t.TempDir()
+	content := bytes.Repeat([]byte("ghostify"), 8192)
+	if err := os.WriteFile(filepath.Join(downloadDir, "episode.mp4"), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	infoHash, err := manager.AddTorrentFile(path, downloadDir)
+	if err != nil {
+		t.Fatalf("add error: %v", err)
+	}
+	managed, _ := manager.get(infoHash)
+	managed.torrent.VerifyData()
+
+	select {
+	case progress := <-complete:
+		if progress.Length != int64(len(content)) {
+			t.Errorf("expected length %d, got %d", len(content), progress.Length)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no complete progress event received")
+	}
+
+	polled, err := manager.Progress(infoHash)
+	if err != nil {
+		t.Fatalf("progress error: %v", err)
+	}
+	if polled.Percent() != 100 {
+		t.Errorf("expected the polled progress to be complete, got %.2f%%", polled.Percent())
+	}
+}
@@ -0,0 +1,99 @@
+package services
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/anacrolix/torrent/storage"
+)
+
+// StorageBackend select how the torrent data are written on disk
+type StorageBackend string
+
+const (
+	StorageFile StorageBackend = "file"
+	StorageMMap StorageBackend = "mmap"
+)
+
+// PieceCompletionBackend select where the verified pieces state is kept
+type PieceCompletionBackend string
+
+const (
+	// sqlite when built with cgo, bolt otherwise
+	CompletionDefault PieceCompletionBackend = "default"
+	CompletionBolt    PieceCompletionBackend = "bolt"
+	CompletionMemory  PieceCompletionBackend = "memory"
+)
+
+// Directory used when no download directory is provided
+const defaultDownloadDir = "./downloads"
+
+// TorrentStorageConfig describe the storage created for each torrent
+type TorrentStorageConfig struct {
+	Backend    StorageBackend
+	Completion PieceCompletionBackend
+}
+
+// Default storage: native files with the default piece completion
+var DefaultTorrentStorage = TorrentStorageConfig{
+	Backend:    StorageFile,
+	Completion: CompletionDefault,
+}
+
+// Get the download directory from the `TORRENT_TMP_DIR` environment variable
+func DefaultDownloadDir() string {
+	if dir := os.Getenv("TORRENT_TMP_DIR"); dir != "" {
+		return dir
+	}
+	return defaultDownloadDir
+}
+
+// Build the storage writing the torrent data inside the provided directory
+func NewTorrentStorage(dir string, config TorrentStorageConfig) (storage.ClientImplCloser, error) {
+	if dir == "" {
+		dir = DefaultDownloadDir()
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("can't create download dir: %v", err)
+	}
+
+	completion, err := newPieceCompletion(dir, config.Completion)
+	if err != nil {
+		return nil, err
+	}
+
+	switch config.Backend {
+	case StorageFile, "":
+		return storage.NewFileOpts(storage.NewFileClientOpts{
+			ClientBaseDir:   dir,
+			PieceCompletion: completion,
+		}), nil
+	case StorageMMap:
+		return storage.NewMMapWithCompletion(dir, completion), nil
+	default:
+		completion.Close()
+		return nil, fmt.Errorf("unknown storage backend: %q", config.Backend)
+	}
+}
+
+func newPieceCompletion(dir string, backend PieceCompletionBackend) (storage.PieceCompletion, error) {
+	var (
+		completion storage.PieceCompletion
+		err        error
+	)
+
+	switch backend {
+	case CompletionDefault, "":
+		completion, err = storage.NewDefaultPieceCompletionForDir(dir)
+	case CompletionBolt:
+		completion, err = storage.NewBoltPieceCompletion(dir)
+	case CompletionMemory:
+		completion = storage.NewMapPieceCompletion()
+	default:
+		return nil, fmt.Errorf("unknown piece completion backend: %q", backend)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error during the piece completion creation : %v", err)
+	}
+	return completion, nil
+}
@@ -0,0 +1,71 @@
+package services
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDefaultDownloadDir(t *testing.T) {
+	t.Setenv("TORRENT_TMP_DIR", "")
+	if dir := DefaultDownloadDir(); dir != defaultDownloadDir {
+		t.Errorf("expected %s, got %s", defaultDownloadDir, dir)
+	}
+
+	t.Setenv("TORRENT_TMP_DIR", "/data/torrents")
+	if dir := DefaultDownloadDir(); dir != "/data/torrents" {
+		t.Errorf("expected /data/torrents, got %s", dir)
+	}
+}
+
+func TestNewTorrentStorageUnknownBackend(t *testing.T) {
+	if _, err := NewTorrentStorage(t.TempDir(), TorrentStorageConfig{Backend: "tape"}); err == nil {
+		t.Error("expected an unknown storage backend error")
+	}
+	if _, err := NewTorrentStorage(t.TempDir(), TorrentStorageConfig{Completion: "redis"}); err == nil {
+		t.Error("expected an unknown piece completion backend error")
+	}
+}
+
+func TestTorrentManagerUsesDownloadDir(t *testing.T) {
+	configs := map[string]TorrentStorageConfig{
+		"file": {Backend: StorageFile, Completion: CompletionBolt},
+		"mmap": {Backend: StorageMMap, Completion: CompletionMemory},
+	}
+
+	for name, config := range configs {
+		t.Run(name, func(t *testing.T) {
+			manager := newTestTorrentManager(t)
+			manager.Storage = config
+			path, _ := writeTestTorrent(t, "episode.mp4")
+
+			// Seed the download dir with the complete data so the torrent
+			// only complete if its storage point to this directory
+			downloadDir := t.TempDir()
+			content := bytes.Repeat([]byte("ghostify"), 8192)
+			if err := os.WriteFile(filepath.Join(downloadDir, "episode.mp4"), content, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			infoHash, err := manager.AddTorrentFile(path, downloadDir)
+			if err != nil {
+				t.Fatalf("add error: %v", err)
+			}
+			managed, _ := manager.get(infoHash)
+			managed.torrent.VerifyData()
+
+			done := make(chan error, 1)
+			go func() { done <- manager.WaitComplete(infoHash) }()
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Fatalf("wait error: %v", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("torrent never completed from the seeded download dir")
+			}
+		})
+	}
+}
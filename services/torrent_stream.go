@@ -0,0 +1,104 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	tr "github.com/anacrolix/torrent"
+)
+
+// Bytes prioritized ahead of the read position when streaming a torrent file
+var StreamReadahead int64 = 16 << 20
+
+// Wait until the torrent metadata is received
+func (m *TorrentManager) WaitMetadata(infoHash string) error {
+	return m.WaitMetadataContext(context.Background(), infoHash)
+}
+
+// Wait until the torrent metadata is received, the MetadataTimeout elapse or the context is done
+func (m *TorrentManager) WaitMetadataContext(ctx context.Context, infoHash string) error {
+	managed, err := m.get(infoHash)
+	if err != nil {
+		return err
+	}
+
+	var timeout <-chan time.Time
+	if m.MetadataTimeout > 0 {
+		timer := time.NewTimer(m.MetadataTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-managed.torrent.GotInfo():
+		return nil
+	case <-managed.torrent.Closed():
+		return fmt.Errorf("torrent %s dropped before receiving its metadata", infoHash)
+	case <-timeout:
+		return fmt.Errorf("torrent %s : %w after %s", infoHash, ErrMetadataTimeout, m.MetadataTimeout)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Open a sequential reader over a torrent file.
+// The pieces ahead of the read position are downloaded first and the reads
+// block until the requested data is available.
+func (m *TorrentManager) OpenFile(infoHash string, fileIndex int) (tr.Reader, TorrentFile, error) {
+	managed, err := m.get(infoHash)
+	if err != nil {
+		return nil, TorrentFile{}, err
+	}
+
+	select {
+	case <-managed.torrent.GotInfo():
+	default:
+		return nil, TorrentFile{}, ErrMetadataPending
+	}
+
+	files := managed.torrent.Files()
+	if fileIndex < 0 || fileIndex >= len(files) {
+		return nil, TorrentFile{}, fmt.Errorf("torrent %s has no file at index %d", infoHash, fileIndex)
+	}
+
+	reader := files[fileIndex].NewReader()
+	reader.SetReadahead(StreamReadahead)
+	return reader, describeTorrentFiles(files)[fileIndex], nil
+}
+
+// Transcode a torrent file while it is still downloading.
+// The output files are returned, several parts when the output exceeded the profile MaxSize.
+func (m *TorrentManager) StreamTranscode(infoHash string, fileIndex int, outputPath string, profile QualityProfile, progressCallback func(float64)) ([]string, error) {
+	return m.StreamTranscodeContext(context.Background(), infoHash, fileIndex, outputPath, profile, progressCallback)
+}
+
+// Transcode a torrent file while it is still downloading until the context is done
+func (m *TorrentManager) StreamTranscodeContext(ctx context.Context, infoHash string, fileIndex int, outputPath string, profile QualityProfile, progressCallback func(float64)) ([]string, error) {
+	reader, file, err := m.OpenFile(infoHash, fileIndex)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	optimizer, err := NewStreamMediaOptimizer(file.Path, outputPath)
+	if err != nil {
+		return nil, err
+	}
+	optimizer.SetProfile(profile)
+
+	if err := optimizer.OptimizeStreamContext(ctx, contextReader{ctx, reader}, file.Length, progressCallback); err != nil {
+		return nil, err
+	}
+	return optimizer.Outputs(), nil
+}
+
+// contextReader unblock the pending torrent reads when the context is done
+type contextReader struct {
+	ctx    context.Context
+	reader tr.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	return r.reader.ReadContext(r.ctx, p)
+}
@@ -0,0 +1,75 @@
+package services
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTorrentManagerOpenFile(t *testing.T) {
+	manager := newTestTorrentManager(t)
+	path := writeTestPackTorrent(t)
+
+	downloadDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(downloadDir, "pack"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	episode := testPackFiles["episode_01.mkv"]
+	if err := os.WriteFile(filepath.Join(downloadDir, "pack", "episode_01.mkv"), episode, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	infoHash, err := manager.AddTorrentFile(path, downloadDir)
+	if err != nil {
+		t.Fatalf("add error: %v", err)
+	}
+	if err := manager.WaitMetadata(infoHash); err != nil {
+		t.Fatalf("metadata error: %v", err)
+	}
+
+	selected, err := manager.Select(infoHash, FileSelection{Globs: []string{"episode_*"}})
+	if err != nil || len(selected) != 1 {
+		t.Fatalf("unexpected selection %+v: %v", selected, err)
+	}
+	managed, _ := manager.get(infoHash)
+	managed.torrent.VerifyData()
+
+	reader, file, err := manager.OpenFile(infoHash, selected[0].Index)
+	if err != nil {
+		t.Fatalf("open error: %v", err)
+	}
+	defer reader.Close()
+
+	if file.Path != "episode_01.mkv" || file.Length != int64(len(episode)) {
+		t.Errorf("unexpected file description: %+v", file)
+	}
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("read error: %v", err)
+	}
+	if !bytes.Equal(data, episode) {
+		t.Error("streamed content differ from the file content")
+	}
+
+	if _, _, err := manager.OpenFile(infoHash, 42); err == nil {
+		t.Error("expected an error for an unknown file index")
+	}
+}
+
+func TestProgressReader(t *testing.T) {
+	var last float64
+	reader := &progressReader{
+		reader:   bytes.NewReader(make([]byte, 400)),
+		size:     400,
+		callback: func(progress float64) { last = progress },
+	}
+
+	if _, err := io.CopyBuffer(io.Discard, reader, make([]byte, 100)); err != nil {
+		t.Fatal(err)
+	}
+	if last != 100 {
+		t.Errorf("expected 100%%, got %.2f", last)
+	}
+}
@@ -0,0 +1,130 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// Build a single file torrent and return its metainfo with the encoded bytes
+func createTestTorrent(t *testing.T, name string) (*metainfo.MetaInfo, []byte) {
+	dir := t.TempDir()
+	content := filepath.Join(dir, name)
+	if err := os.WriteFile(content, bytes.Repeat([]byte("ghostify"), 8192), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	info := metainfo.Info{PieceLength: 16 << 10}
+	if err := info.BuildFromFilePath(content); err != nil {
+		t.Fatalf("torrent info creation error: %v", err)
+	}
+	infoBytes, err := bencode.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mi := &metainfo.MetaInfo{InfoBytes: infoBytes}
+	var buf bytes.Buffer
+	if err := mi.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return mi, buf.Bytes()
+}
+
+func TestDownloadTorrentFile(t *testing.T) {
+	mi, data := createTestTorrent(t, "episode.mp4")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/valid.torrent":
+			w.Header().Set("Content-Type", "application/x-bittorrent")
+			w.Write(data)
+		case "/page.html":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("<html></html>"))
+		case "/garbage.torrent":
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Write([]byte("not bencoded"))
+		case "/huge.torrent":
+			w.Header().Set("Content-Type", "application/x-bittorrent")
+			w.Write(bytes.Repeat([]byte("d"), int(TorrentFileMaxSize)+1))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	t.Run("valid torrent", func(t *testing.T) {
+		dir := t.TempDir()
+		path, err := DownloadTorrentFile(server.URL+"/valid.torrent", dir)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		expected := filepath.Join(dir, mi.HashInfoBytes().HexString()+".torrent")
+		if path != expected {
+			t.Errorf("expected path %s, got %s", expected, path)
+		}
+		saved, err := os.ReadFile(path)
+		if err != nil || !bytes.Equal(saved, data) {
+			t.Errorf("saved torrent differs from the served one: %v", err)
+		}
+	})
+
+	failures := map[string]string{
+		"wrong content type": "/page.html",
+		"invalid bencode":    "/garbage.torrent",
+		"size limit":         "/huge.torrent",
+		"not found":          "/missing.torrent",
+	}
+	for name, route := range failures {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			if _, err := DownloadTorrentFile(server.URL+route, dir); err == nil {
+				t.Error("expected an error")
+			}
+			entries, _ := os.ReadDir(dir)
+			if len(entries) != 0 {
+				t.Errorf("expected no file written, got %d", len(entries))
+			}
+		})
+	}
+
+	t.Run("unsupported scheme", func(t *testing.T) {
+		_, err := DownloadTorrentFile("ftp://example.com/file.torrent", t.TempDir())
+		if err == nil || !strings.Contains(err.Error(), "scheme") {
+			t.Errorf("expected a scheme error, got %v", err)
+		}
+	})
+
+	t.Run("cancelled request", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := DownloadTorrentFileContext(ctx, server.URL+"/valid.torrent", t.TempDir())
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("expected the context error, got %v", err)
+		}
+	})
+}
+
+func TestIsMagnet(t *testing.T) {
+	tests := map[string]bool{
+		"magnet:?xt=urn:btih:abc":       true,
+		"https://example.com/a.torrent": false,
+		"magnet:":                       false,
+	}
+	for link, expected := range tests {
+		if IsMagnet(link) != expected {
+			t.Errorf("IsMagnet(%q) = %v, expected %v", link, !expected, expected)
+		}
+	}
+}